@@ -1,14 +1,21 @@
 package gin
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"github.com/gin-gonic/gin/internal/json"
 	"github.com/gin-gonic/gin/internal/profile"
+	pprofprofile "github.com/google/pprof/profile"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	runtimepprof "runtime/pprof"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -81,3 +88,525 @@ func doRequest(t *testing.T, client *http.Client, url string) {
 	assert.Equal(t, "it worked", string(body), "resp body should match")
 	assert.Equal(t, "200 OK", resp.Status, "should get a 200")
 }
+
+func TestForceArchiveHandler(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	admin := router.Group("/admin", BasicAuth(Accounts{"admin": "password"}))
+	admin.POST("/profile/archive", ForceArchiveHandler())
+	auth := header{"Authorization", authorizationHeader("admin", "password")}
+
+	w := performRequest(router, http.MethodPost, "/admin/profile/archive")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequest(router, http.MethodPost, "/admin/profile/archive", auth)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	assert.NoError(t, profile.EnableProfile(&profile.Option{
+		Y:            1100 * time.Millisecond,
+		X:            100 * time.Millisecond,
+		StoreDir:     storeDir,
+		Compress:     true,
+		LogOutput:    ioutil.Discard,
+		ErrLogOutput: ioutil.Discard,
+	}, profile.Heap))
+	defer profile.StopProfile()
+	time.Sleep(1200 * time.Millisecond)
+
+	w = performRequest(router, http.MethodPost, "/admin/profile/archive", auth)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Archives []string `json:"archives"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Archives, 1)
+	archives, err := filepath.Glob(filepath.Join(storeDir, "archive", "*.zip"))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	assert.Equal(t, filepath.Base(archives[0]), resp.Archives[0])
+}
+
+func TestProfileArchiveHandler(t *testing.T) {
+	router := New()
+	router.GET("/debug/profile/archives/:name", ProfileArchiveHandler())
+
+	w := performRequest(router, http.MethodGet, "/debug/profile/archives/2020-01-02.zip")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	for format, contentType := range map[profile.CompressionFormat]string{
+		profile.Zip:  "application/zip",
+		profile.Zstd: "application/zstd",
+	} {
+		storeDir, err := ioutil.TempDir("", "profiles")
+		assert.NoError(t, err)
+		assert.NoError(t, profile.EnableProfile(&profile.Option{
+			Y:                 1100 * time.Millisecond,
+			X:                 100 * time.Millisecond,
+			StoreDir:          storeDir,
+			Compress:          true,
+			CompressionFormat: format,
+			LogOutput:         ioutil.Discard,
+			ErrLogOutput:      ioutil.Discard,
+		}, profile.Heap))
+		time.Sleep(1200 * time.Millisecond)
+		archives, err := profile.ForceArchive()
+		assert.NoError(t, err)
+		name := filepath.Base(archives[0])
+
+		w = performRequest(router, http.MethodGet, "/debug/profile/archives/"+name)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+		assert.Equal(t, format.ContentType(), w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="`+name+`"`, w.Header().Get("Content-Disposition"))
+		data, err := ioutil.ReadFile(archives[0])
+		assert.NoError(t, err)
+		assert.Equal(t, data, w.Body.Bytes())
+
+		for _, missing := range []string{"2020-01-02.zip", "..%2F..%2Fetc%2Fpasswd", "."} {
+			w = performRequest(router, http.MethodGet, "/debug/profile/archives/"+missing)
+			assert.Equal(t, http.StatusNotFound, w.Code, missing)
+		}
+		assert.NoError(t, profile.StopProfile())
+		os.RemoveAll(storeDir)
+	}
+}
+
+func TestProfileStatusHandler(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	router.GET("/debug/profile/status", ProfileStatusHandler())
+	getStatus := func() map[string]interface{} {
+		w := performRequest(router, http.MethodGet, "/debug/profile/status")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var status map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return status
+	}
+
+	status := getStatus()
+	assert.Equal(t, false, status["enabled"])
+	assert.Equal(t, false, status["healthy"])
+	assert.Equal(t, 0.0, status["pending_files"])
+
+	assert.NoError(t, profile.EnableProfile(&profile.Option{
+		Y:            1100 * time.Millisecond,
+		X:            100 * time.Millisecond,
+		StoreDir:     storeDir,
+		Compress:     true,
+		LogOutput:    ioutil.Discard,
+		ErrLogOutput: ioutil.Discard,
+	}, profile.Heap))
+	defer profile.StopProfile()
+	time.Sleep(1200 * time.Millisecond)
+
+	status = getStatus()
+	assert.Equal(t, true, status["enabled"])
+	assert.Equal(t, false, status["paused"])
+	assert.Equal(t, []interface{}{"heap"}, status["profiles"])
+	assert.Equal(t, "1.1s", status["every"])
+	assert.Equal(t, true, status["healthy"])
+	assert.Equal(t, 1.0, status["pending_files"])
+	assert.Equal(t, 1.0, status["captures"])
+	assert.Equal(t, 0.0, status["archives"])
+	assert.Nil(t, status["last_archive"])
+
+	archives, err := profile.ForceArchive()
+	assert.NoError(t, err)
+	status = getStatus()
+	assert.Equal(t, 0.0, status["pending_files"])
+	assert.Equal(t, 1.0, status["archives"])
+	assert.Equal(t, filepath.Base(archives[0]), status["last_archive"])
+	assert.NotNil(t, status["last_archive_time"])
+	assert.Equal(t, 0.0, status["errors"])
+}
+
+func TestProfileConfigHandler(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	admin := router.Group("/debug", BasicAuth(Accounts{"admin": "password"}))
+	admin.POST("/profile/config", ProfileConfigHandler())
+	postConfig := func(body string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/debug/profile/config", bytes.NewBufferString(body))
+		if auth {
+			req.Header.Set("Authorization", authorizationHeader("admin", "password"))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	config := `{"profiles":["goroutine"],"every":"1.1s","duration":"100ms"}`
+
+	assert.Equal(t, http.StatusUnauthorized, postConfig(config, false).Code)
+	assert.Equal(t, http.StatusConflict, postConfig(config, true).Code)
+
+	assert.NoError(t, profile.EnableProfile(&profile.Option{
+		Y:            time.Hour,
+		X:            time.Second,
+		StoreDir:     storeDir,
+		LogOutput:    ioutil.Discard,
+		ErrLogOutput: ioutil.Discard,
+	}, profile.Heap))
+	defer profile.StopProfile()
+
+	for _, invalid := range []string{`{"profiles":["nope"]}`, `{"every":"soon"}`, `{"every":"1s","duration":"2s"}`, `{`} {
+		assert.Equal(t, http.StatusBadRequest, postConfig(invalid, true).Code, invalid)
+	}
+	w := postConfig(config, true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, config, w.Body.String())
+
+	// the next tick is 1.1s from now, and captures the goroutine profile only
+	time.Sleep(1300 * time.Millisecond)
+	files, err := filepath.Glob(filepath.Join(storeDir, "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	for _, f := range files {
+		assert.True(t, strings.HasPrefix(filepath.Base(f), "goroutine_"), f)
+	}
+}
+
+func TestProfileIndexHandler(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	router.GET("/debug/pprof/", ProfileIndexHandler())
+
+	w := performRequest(router, http.MethodGet, "/debug/pprof/")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	assert.NoError(t, profile.EnableProfile(&profile.Option{
+		Y:            time.Hour,
+		X:            time.Second,
+		StoreDir:     storeDir,
+		LogOutput:    ioutil.Discard,
+		ErrLogOutput: ioutil.Discard,
+	}, profile.Cpu, profile.Heap, profile.Goroutine))
+	defer profile.StopProfile()
+
+	w = performRequest(router, http.MethodGet, "/debug/pprof/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	for _, link := range []string{`href="profile"`, `href="heap?debug=1"`, `href="goroutine?debug=1"`} {
+		assert.Contains(t, body, link)
+	}
+	assert.NotContains(t, body, "mutex")
+	assert.NotContains(t, body, "trace")
+}
+
+func TestProfileRequestCounter(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	var lock sync.Mutex
+	var served []time.Time
+	router := New()
+	router.Use(ProfileRequestCounter())
+	router.GET("/", func(c *Context) {
+		lock.Lock()
+		served = append(served, time.Now())
+		lock.Unlock()
+	})
+
+	results := make(chan profile.CaptureResult, 1)
+	assert.NoError(t, profile.EnableProfile(&profile.Option{
+		Y:                1100 * time.Millisecond,
+		X:                500 * time.Millisecond,
+		StoreDir:         storeDir,
+		LogOutput:        ioutil.Discard,
+		ErrLogOutput:     ioutil.Discard,
+		OnProfileWritten: func(result profile.CaptureResult) { results <- result },
+	}, profile.Cpu))
+	defer profile.StopProfile()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline := time.Now().Add(1900 * time.Millisecond); time.Now().Before(deadline); {
+			performRequest(router, http.MethodGet, "/")
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+	var result profile.CaptureResult
+	select {
+	case result = <-results:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no cpu profile captured")
+	}
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	var requests int64
+	for _, at := range served {
+		if !at.Before(result.Start) && !at.After(result.End) {
+			requests++
+		}
+	}
+	elapsed := result.End.Sub(result.Start).Seconds()
+	assert.True(t, requests > 50, "%d requests", requests)
+	assert.InDelta(t, requests, result.Requests, 2)
+	assert.InEpsilon(t, float64(requests)/elapsed, result.QPS, 0.1)
+}
+
+func TestSLOProfile(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	router.Use(SLOProfile(SLOProfileConfig{
+		Threshold: 10 * time.Millisecond,
+		Window:    10,
+		Cooldown:  time.Minute,
+		Option:    &profile.Option{StoreDir: storeDir, X: 100 * time.Millisecond},
+	}))
+	router.GET("/fast", func(c *Context) {})
+	router.GET("/slow", func(c *Context) { time.Sleep(20 * time.Millisecond) })
+
+	for i := 0; i < 20; i++ {
+		performRequest(router, http.MethodGet, "/fast")
+	}
+	time.Sleep(150 * time.Millisecond)
+	profiles, err := filepath.Glob(filepath.Join(storeDir, "cpu_*"))
+	assert.NoError(t, err)
+	assert.Empty(t, profiles)
+
+	for i := 0; i < 5; i++ {
+		performRequest(router, http.MethodGet, "/slow")
+	}
+	time.Sleep(150 * time.Millisecond)
+	profiles, err = filepath.Glob(filepath.Join(storeDir, "cpu_*"))
+	assert.NoError(t, err)
+	assert.Len(t, profiles, 1)
+}
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow(100)
+	assert.Equal(t, time.Duration(0), w.p99())
+	for i := 1; i <= 200; i++ {
+		w.add(time.Duration(i))
+	}
+	// only 101..200 are left
+	assert.Equal(t, time.Duration(199), w.p99())
+	w.add(1000)
+	assert.Equal(t, time.Duration(200), w.p99())
+}
+
+func TestRegisterPprofHandlers(t *testing.T) {
+	router := New()
+	router.GET("/debug/vars", func(c *Context) {})
+	basePath := "/internal/profiling/pprof"
+	RegisterPprofHandlers(router, basePath)
+
+	w := performRequest(router, http.MethodGet, basePath+"/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href='heap?debug=1'`)
+
+	w = performRequest(router, http.MethodGet, basePath+"/heap")
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err := pprofprofile.Parse(w.Body)
+	assert.NoError(t, err)
+
+	w = performRequest(router, http.MethodGet, basePath+"/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "goroutine profile: total")
+
+	w = performRequest(router, http.MethodGet, basePath+"/cmdline")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), os.Args[0])
+	w = performRequest(router, http.MethodGet, basePath+"/symbol")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "num_symbols")
+
+	w = performRequest(router, http.MethodGet, DefaultPprofBasePath+"/heap")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRegisterPprofHandlersScrape(t *testing.T) {
+	router := New()
+	RegisterPprofHandlers(router, "")
+
+	w := performRequest(router, http.MethodGet, DefaultPprofBasePath+"/profile?seconds=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	p, err := pprofprofile.Parse(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", p.SampleType[len(p.SampleType)-1].Type)
+	assert.Equal(t, time.Second, time.Duration(p.DurationNanos).Round(100*time.Millisecond))
+
+	// a delta profile over seconds
+	w = performRequest(router, http.MethodGet, DefaultPprofBasePath+"/allocs?seconds=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	_, err = pprofprofile.Parse(w.Body)
+	assert.NoError(t, err)
+
+	w = performRequest(router, http.MethodGet, DefaultPprofBasePath+"/heap?debug=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "heap profile:")
+}
+
+func TestRequestProfile(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storeDir)
+	router := New()
+	router.Use(RequestProfile(RequestProfileConfig{Option: &profile.Option{StoreDir: storeDir}}))
+	router.GET("/", func(c *Context) { time.Sleep(20 * time.Millisecond) })
+
+	performRequest(router, http.MethodGet, "/", header{"X-Trace-Id", "4bf92f3577b34da6"})
+	profiles, err := filepath.Glob(filepath.Join(storeDir, "cpu_*"))
+	assert.NoError(t, err)
+	assert.Empty(t, profiles)
+
+	w := performRequest(router, http.MethodGet, "/", header{"X-Debug-Profile", "true"},
+		header{"X-Trace-Id", "../4bf92f3577b34da6"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	file, err := os.Open(filepath.Join(storeDir, "cpu_4bf92f3577b34da6.profile"))
+	assert.NoError(t, err)
+	defer file.Close()
+	_, err = pprofprofile.Parse(file)
+	assert.NoError(t, err)
+}
+
+func TestRouteCPUProfiler(t *testing.T) {
+	router := New()
+	profileRoute, dump := RouteCPUProfiler("checkout")
+	router.GET("/checkout", profileRoute, func(c *Context) {
+		// burn some cpu so that the profile has samples
+		sum := 0
+		for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+			sum += rand.Intn(10)
+		}
+		c.String(http.StatusOK, "%d", sum)
+	})
+	router.GET("/profile/checkout", dump)
+
+	w := performRequest(router, http.MethodGet, "/profile/checkout")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for i := 0; i < 4; i++ {
+		w = performRequest(router, http.MethodGet, "/checkout")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = performRequest(router, http.MethodGet, "/profile/checkout")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	p, err := pprofprofile.Parse(w.Body)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.Sample)
+	labelled := false
+	for _, s := range p.Sample {
+		if len(s.Label["route"]) > 0 && s.Label["route"][0] == "checkout" {
+			labelled = true
+		}
+	}
+	assert.True(t, labelled)
+}
+
+func TestSampledLabels(t *testing.T) {
+	var requests, labelled int64
+	router := New()
+	router.Use(SampledLabels(SampledLabelsConfig{Fraction: 0.25}))
+	router.GET("/checkout", func(c *Context) {
+		requests++
+		if route, ok := runtimepprof.Label(c.Request.Context(), "route"); ok {
+			assert.Equal(t, "/checkout", route)
+			labelled++
+		}
+		// burn some cpu so that the profile has samples
+		sum := 0
+		for start := time.Now(); time.Since(start) < 500*time.Microsecond; {
+			sum += rand.Intn(10)
+		}
+		c.String(http.StatusOK, "%d", sum)
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			performRequest(router, http.MethodGet, "/checkout")
+		}
+	}()
+	var buf bytes.Buffer
+	assert.NoError(t, profile.CaptureCPU(time.Second, &buf))
+	close(stop)
+	<-done
+
+	assert.True(t, requests > 500, "%d requests", requests)
+	assert.InDelta(t, 0.25, float64(labelled)/float64(requests), 0.05)
+	p, err := pprofprofile.Parse(&buf)
+	assert.NoError(t, err)
+	var samples, labelledSamples int64
+	for _, s := range p.Sample {
+		samples += s.Value[0]
+		if len(s.Label["route"]) > 0 && s.Label["route"][0] == "/checkout" {
+			labelledSamples += s.Value[0]
+		}
+	}
+	assert.InDelta(t, 0.25, float64(labelledSamples)/float64(samples), 0.15)
+}
+
+var heapProfileHeaderSink []byte
+
+//go:noinline
+func allocateInHandler() int {
+	// big enough to be always sampled by the heap profile
+	heapProfileHeaderSink = make([]byte, 16<<20)
+	return len(heapProfileHeaderSink)
+}
+
+func TestHeapProfileHeader(t *testing.T) {
+	router := New()
+	router.Use(HeapProfileHeader(HeapProfileHeaderConfig{}))
+	router.GET("/", func(c *Context) {
+		c.String(http.StatusOK, "%d", allocateInHandler())
+	})
+
+	w := performRequest(router, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Result().Trailer.Get("X-Heap-Profile"))
+
+	w = performRequest(router, http.MethodGet, "/", header{"X-Debug-Heap-Profile", "true"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "16777216", w.Body.String())
+	encoded := w.Result().Trailer.Get("X-Heap-Profile")
+	assert.NotEmpty(t, encoded)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	p, err := pprofprofile.ParseData(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "alloc_objects", p.SampleType[0].Type)
+	// the allocation of the handler is in the delta
+	var allocated int64
+	for _, s := range p.Sample {
+		for _, l := range s.Location {
+			for _, line := range l.Line {
+				if strings.HasSuffix(line.Function.Name, ".allocateInHandler") {
+					allocated += s.Value[1]
+				}
+			}
+		}
+	}
+	assert.True(t, allocated >= 16<<20, allocated)
+
+	router = New()
+	router.Use(HeapProfileHeader(HeapProfileHeaderConfig{MaxSize: 1}))
+	router.GET("/", func(c *Context) {})
+	w = performRequest(router, http.MethodGet, "/", header{"X-Debug-Heap-Profile", "true"})
+	assert.Empty(t, w.Result().Trailer.Get("X-Heap-Profile"))
+}
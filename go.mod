@@ -6,7 +6,9 @@ require (
 	github.com/gin-contrib/sse v0.1.0
 	github.com/go-playground/validator/v10 v10.0.1
 	github.com/golang/protobuf v1.3.2
+	github.com/google/pprof v0.0.0-20191218002539-d4f498aebedc
 	github.com/json-iterator/go v1.1.7
+	github.com/klauspost/compress v1.10.3
 	github.com/mattn/go-isatty v0.0.9
 	github.com/stretchr/testify v1.4.0
 	github.com/ugorji/go/codec v1.1.7
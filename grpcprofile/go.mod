@@ -0,0 +1,13 @@
+module github.com/gin-gonic/gin/grpcprofile
+
+go 1.12
+
+require (
+	github.com/gin-gonic/gin v0.0.0-00010101000000-000000000000
+	github.com/golang/protobuf v1.3.2
+	github.com/google/pprof v0.0.0-20191218002539-d4f498aebedc
+	github.com/stretchr/testify v1.4.0
+	google.golang.org/grpc v1.27.0
+)
+
+replace github.com/gin-gonic/gin => ../
@@ -0,0 +1,95 @@
+// Package grpcprofile serves the profiles of the process over gRPC, for the environments where the admin
+// interfaces are gRPC rather than HTTP. The messages and the service are generated from profile.proto.
+// It is a module of its own, so that gin doesn't depend on gRPC.
+package grpcprofile
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. profile.proto
+
+import (
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin/internal/profile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSeconds     = 30
+	defaultMaxDuration = time.Minute
+	defaultChunkSize   = 64 * 1024
+)
+
+// Server serves the profiles captured in memory on request, e.g.
+//
+//	s := grpc.NewServer()
+//	grpcprofile.RegisterProfileServiceServer(s, &grpcprofile.Server{})
+//
+// It is an admin service, serve it behind an authenticating interceptor or on an admin port only.
+type Server struct {
+	// MaxDuration is the longest a duration profile may be recorded for, 1m by default.
+	MaxDuration time.Duration
+	// ChunkSize is the size of the chunks the profile is streamed in, 64KB by default.
+	ChunkSize int
+}
+
+// GetProfile captures the requested profile and streams it back.
+func (s *Server) GetProfile(req *GetProfileRequest, stream ProfileService_GetProfileServer) error {
+	seconds := req.GetSeconds()
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	d := time.Duration(seconds) * time.Second
+	maxDuration := s.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = defaultMaxDuration
+	}
+	if d > maxDuration {
+		return status.Errorf(codes.InvalidArgument, "seconds should not > %v", maxDuration)
+	}
+	data, err := profile.CaptureBytes(profile.Profile(req.GetType()), d)
+	if err != nil {
+		return status.Error(captureCode(err), err.Error())
+	}
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if err = stream.Send(&ProfileChunk{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// captureCode is the status code of the capture error err.
+func captureCode(err error) codes.Code {
+	switch {
+	case profile.IsError(err, profile.ErrInvalidProfile), profile.IsError(err, profile.ErrInvalidInterval):
+		return codes.InvalidArgument
+	case profile.IsError(err, profile.ErrCPUProfilingActive), profile.IsError(err, profile.ErrTraceActive):
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// ReadProfile receives the chunks of stream until its end and returns the profile they make up.
+func ReadProfile(stream ProfileService_GetProfileClient) ([]byte, error) {
+	var data []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk.GetData()...)
+	}
+}
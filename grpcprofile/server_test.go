@@ -0,0 +1,62 @@
+package grpcprofile
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves srv in process and returns a client of it.
+func newTestClient(t *testing.T, srv *Server) (ProfileServiceClient, func()) {
+	listener := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	RegisterProfileServiceServer(s, srv)
+	go func() {
+		_ = s.Serve(listener)
+	}()
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(
+		func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	assert.NoError(t, err)
+	return NewProfileServiceClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	// small chunks, so that the profile is streamed in several
+	client, stop := newTestClient(t, &Server{ChunkSize: 256})
+	defer stop()
+
+	stream, err := client.GetProfile(context.Background(), &GetProfileRequest{Type: "heap"})
+	assert.NoError(t, err)
+	data, err := ReadProfile(stream)
+	assert.NoError(t, err)
+	assert.True(t, len(data) > 256)
+	p, err := profile.Parse(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, p.CheckValid())
+	assert.Equal(t, "inuse_space", p.SampleType[len(p.SampleType)-1].Type)
+}
+
+func TestGetProfileInvalid(t *testing.T) {
+	client, stop := newTestClient(t, &Server{})
+	defer stop()
+
+	for _, req := range []*GetProfileRequest{{Type: "nope"}, {Type: "cpu", Seconds: 3600}} {
+		stream, err := client.GetProfile(context.Background(), req)
+		assert.NoError(t, err)
+		_, err = ReadProfile(stream)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), req.String())
+	}
+}
@@ -1,11 +1,13 @@
 package profile
 
 import (
-	"archive/zip"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +19,9 @@ const (
 
 type ArchivePolicy interface {
 	needArchive(fileCollection []string) bool
+	// archiveRan is called once the archive needArchive asked for runs, rather than being suppressed by
+	// MinArchiveInterval, so that the policy asks again on the next tick until it does.
+	archiveRan()
 }
 
 type FileNumArchivePolicy struct {
@@ -30,8 +35,13 @@ func (f *FileNumArchivePolicy) needArchive(fileCollection []string) bool {
 	return len(fileCollection) >= f.MaxFileNum
 }
 
+func (f *FileNumArchivePolicy) archiveRan() {}
+
 type TimeArchivePolicy struct {
-	MaxHistory      time.Duration
+	MaxHistory time.Duration
+	// ArchiveOnStart archives on the first tick, by default the first archive waits for MaxHistory
+	// rather than archiving the few profiles taken right after the start.
+	ArchiveOnStart  bool
 	lastArchiveTime time.Time
 }
 
@@ -41,46 +51,433 @@ func (f *TimeArchivePolicy) needArchive(fileCollection []string) bool {
 	}
 	if f.lastArchiveTime.IsZero() {
 		f.lastArchiveTime = time.Now()
-		return true
+		return f.ArchiveOnStart
 	}
 	return time.Since(f.lastArchiveTime) >= f.MaxHistory
 }
 
-func (m *profileManager) doArchive0(collection []string) {
-	zipFilePath := filepath.Join(m.archiveDir, time.Now().Format(defaultTimeFormat)+".zip")
-	zipFile, err := os.Create(zipFilePath)
-	if err != nil {
-		m.errorLog("create archive file failed", err)
+func (f *TimeArchivePolicy) archiveRan() {
+	f.lastArchiveTime = time.Now()
+}
+
+// DailyArchivePolicy archives once a day, after midnight, the profiles of the previous days into an archive
+// per capture day named after it, e.g. 2020-01-02.zip. The days are in UTC unless Location is set.
+type DailyArchivePolicy struct {
+	Location *time.Location
+	lastDay  string
+}
+
+func (d *DailyArchivePolicy) needArchive(fileCollection []string) bool {
+	today := d.dayOf(now())
+	if d.lastDay == "" {
+		d.lastDay = today
+		return false
+	}
+	return today != d.lastDay
+}
+
+func (d *DailyArchivePolicy) archiveRan() {
+	d.lastDay = d.dayOf(now())
+}
+
+// dayOf is the day of t, which names its archive.
+func (d *DailyArchivePolicy) dayOf(t time.Time) string {
+	if d.Location != nil {
+		return t.In(d.Location).Format("2006-01-02")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// beforeToday returns the profiles of collection captured before today, today's are archived tomorrow.
+func (m *profileManager) beforeToday(d *DailyArchivePolicy, collection []string) []string {
+	today := d.dayOf(now())
+	var before []string
+	for _, f := range collection {
+		if d.dayOf(m.fileInfo(f).captured) != today {
+			before = append(before, f)
+		}
+	}
+	return before
+}
+
+// excludedFromArchive tells whether filePath matches one of the ArchiveExclude patterns.
+func (m *profileManager) excludedFromArchive(filePath string) bool {
+	for _, pattern := range m.ArchiveExclude {
+		if ok, _ := filepath.Match(pattern, filepath.Base(filePath)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filePath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ForceArchive archives the pending profiles of the running profiler right away, regardless of
+// the ArchivePolicy, and returns the paths of the created archives.
+func ForceArchive() ([]string, error) {
+	m := currentManager()
+	if m == nil {
+		return nil, ErrNotEnabled
+	}
+	return m.forceArchive()
+}
+
+// OpenArchive opens the archive named name in the archive directory of the running profiler, e.g. one
+// returned by ForceArchive. The archives of a partitioned StoreDir, spread over the partitions, are not found.
+func OpenArchive(name string) (*os.File, error) {
+	m := currentManager()
+	if m == nil {
+		return nil, ErrNotEnabled
+	}
+	return m.openArchive(name)
+}
+
+func (m *profileManager) openArchive(name string) (*os.File, error) {
+	if !m.Compress {
+		return nil, ErrCompressDisabled
+	}
+	_, archiveDir := m.dirs()
+	if archiveDir == "" || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, detailError(ErrArchiveNotFound, "%q", name)
+	}
+	path := filepath.Join(archiveDir, name)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return nil, detailError(ErrArchiveNotFound, "%q", name)
+	}
+	return os.Open(path)
+}
+
+func (m *profileManager) forceArchive() ([]string, error) {
+	if !m.Compress {
+		return nil, ErrCompressDisabled
+	}
+	archives, pending, err := m.startForceArchive()
+	if pending != nil {
+		// waited for out of archiveLock, so that the ticks go on meanwhile
+		result := <-pending
+		archives = append(archives, result.archives...)
+		if err == nil {
+			err = result.err
+		}
+	}
+	return archives, err
+}
+
+// startForceArchive archives the pending profiles, or hands them over to the archiver whose result is then
+// received from pending.
+func (m *profileManager) startForceArchive() (archives []string, pending <-chan archiveResult, err error) {
+	m.archiveLock.Lock()
+	defer m.archiveLock.Unlock()
+	if atomic.LoadInt32(&m.stopped) == 1 {
+		return nil, nil, ErrNotEnabled
+	}
+	collection := m.getFileCollection()
+	if len(collection) == 0 {
+		return nil, nil, ErrNothingToArchive
+	}
+	if m.IncrementalArchive {
+		return m.rotateRolling()
+	}
+	m.infoLog(fmt.Sprintf("start to force archive files:%v", collection))
+	if m.archiveQueue != nil {
+		return nil, m.archiveOnArchiver(collection), nil
+	}
+	archives, done, err := m.archiveWithRetries(collection)
+	m.archived(done)
+	return archives, nil, err
+}
+
+// archiveJob is a batch of profiles for the archiver, out of the collection until archived, or back in it
+// if the archive fails.
+type archiveJob struct {
+	collection []string
+	result     chan archiveResult // receives the result of the archive if not nil
+}
+
+type archiveResult struct {
+	archives []string
+	err      error
+}
+
+// startArchiver runs the archiving in the background, so that a big archive doesn't delay the next tick.
+func (m *profileManager) startArchiver() {
+	size := m.ArchiveQueueSize
+	if size <= 0 {
+		size = 1
+	}
+	queue := make(chan archiveJob, size)
+	m.archiveQueue = queue
+	m.archiverDone = make(chan struct{})
+	go func() {
+		defer close(m.archiverDone)
+		for job := range queue {
+			m.infoLog(fmt.Sprintf("start to archive files:%v", job.collection))
+			archives, done, err := m.archiveWithRetries(job.collection)
+			m.removeArchivedFiles(done)
+			if err != nil {
+				// the files left are archived with the next batch
+				m.restoreCollection(withoutFiles(job.collection, done))
+			}
+			if job.result != nil {
+				job.result <- archiveResult{archives: archives, err: err}
+			}
+		}
+	}()
+}
+
+// archiveOnArchiver hands collection over to the archiver, so that the retries wait there rather than on
+// the calling goroutine, and returns the channel receiving the result. m.archiveLock must be held.
+func (m *profileManager) archiveOnArchiver(collection []string) <-chan archiveResult {
+	result := make(chan archiveResult, 1)
+	m.removeCollection(collection)
+	m.archiveQueue <- archiveJob{collection: collection, result: result}
+	return result
+}
+
+// stopArchiver waits for the queued archives to be done.
+func (m *profileManager) stopArchiver() {
+	m.archiveLock.Lock()
+	queue := m.archiveQueue
+	if queue == nil {
+		m.archiveLock.Unlock()
 		return
 	}
-	defer zipFile.Close()
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	// closed under archiveLock, which ForceArchive sends under once it checked the profiler is not stopped
+	close(queue)
+	m.archiveQueue = nil
+	m.archiveLock.Unlock()
+	<-m.archiverDone
+}
+
+// archiveRetryBackoff is the wait before the first archive retry, it doubles for every retry.
+var archiveRetryBackoff = time.Second
+
+// archiveWithRetries archives the collection, retrying up to ArchiveRetries times on failure, and returns
+// the archives created and the files archived. A retry archives only the files a failure left out. The
+// retries are given up once stopping, so that StopProfile isn't held back by the backoff.
+func (m *profileManager) archiveWithRetries(collection []string) (archives, done []string, err error) {
+	backoff := archiveRetryBackoff
+	for retry := 0; ; retry++ {
+		created, archived, err := m.doArchive0(collection)
+		archives = append(archives, created...)
+		done = append(done, archived...)
+		if err == nil || retry >= m.ArchiveRetries {
+			return archives, done, err
+		}
+		collection = withoutFiles(collection, archived)
+		m.errorLog(fmt.Sprintf("archive failed, retrying in %v", backoff), err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-m.stop:
+			timer.Stop()
+			return archives, done, err
+		}
+		backoff *= 2
+	}
+}
+
+// doArchive0 archives the collection and returns the paths of the archives created and the files archived,
+// those of a failed archive left out.
+func (m *profileManager) doArchive0(collection []string) (archives, done []string, err error) {
+	defer m.observeArchiveDuration(time.Now())
+	defer m.overhead.spent(time.Now(), 0)
+	if storeDir, archiveDir := m.dirs(); !isPartitioned(storeDir) {
+		return m.archiveToSinks(archiveDir, collection)
+	}
+	// archive every partition on its own, into the partition's archive directory
+	var partitions []string
+	files := make(map[string][]string)
 	for _, f := range collection {
-		info, err := os.Stat(f)
-		if err != nil {
-			m.errorLog(fmt.Sprintf("read status of file %q failed", f), err)
-			continue
+		dir := filepath.Dir(f)
+		if _, ok := files[dir]; !ok {
+			partitions = append(partitions, dir)
 		}
-		fileHeader, err := zip.FileInfoHeader(info)
-		if err != nil {
-			m.errorLog(fmt.Sprintf("get fileHeader of %q failed", f), err)
+		files[dir] = append(files[dir], f)
+	}
+	for _, dir := range partitions {
+		archiveDir := filepath.Join(dir, "archive")
+		if e := createDirIfNotExists(archiveDir); e != nil {
+			m.errorLog("create archive directory failed", e)
+			err = e
 			continue
 		}
-		writer, err := zipWriter.CreateHeader(fileHeader)
+		partitionArchives, partitionDone, e := m.archiveToSinks(archiveDir, files[dir])
+		if e != nil {
+			err = e
+		}
+		archives = append(archives, partitionArchives...)
+		done = append(done, partitionDone...)
+	}
+	return archives, done, err
+}
+
+// withoutFiles returns the files of collection not in removed, in their order.
+func withoutFiles(collection, removed []string) []string {
+	skip := make(map[string]struct{}, len(removed))
+	for _, f := range removed {
+		skip[f] = struct{}{}
+	}
+	var left []string
+	for _, f := range collection {
+		if _, ok := skip[f]; !ok {
+			left = append(left, f)
+		}
+	}
+	return left
+}
+
+// archiveTo archives collection into archiveDir, into an archive named name, after the time if empty.
+// An existing archive of the same name is kept, the new one is numbered, e.g. 2020-01-02_1.zip.
+func (m *profileManager) archiveTo(archiveDir string, collection []string, name string) (archivePath string,
+	err error) {
+	if name == "" {
+		name = m.timestamp().Format(defaultTimeFormat)
+	}
+	archiveFile, archivePath, err := createArchiveFile(archiveDir, name, m.archiveExtension())
+	if err != nil {
+		m.errorLog("create archive file failed", err)
+		return "", err
+	}
+	defer archiveFile.Close()
+	workers := m.ArchiveWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	writer, err := newArchiveWriter(m.CompressionFormat, archiveFile, workers, m.EncryptionKey)
+	if err != nil {
+		m.errorLog("create archive writer failed", err)
+		return "", err
+	}
+	var archived []string
+	defer func() {
+		if err == nil {
+			m.markArchived(archived)
+			m.incArchivesExpvar()
+			m.counters.archive(archivePath)
+		}
+	}()
+	defer func() {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
 		if err != nil {
-			m.errorLog(fmt.Sprintf("write fileHeader of %q failed", f), err)
+			// don't leave a broken archive behind
+			archiveFile.Close()
+			_ = os.Remove(archivePath)
+		}
+	}()
+	if m.ReproducibleArchives {
+		collection = append([]string(nil), collection...)
+		sort.Strings(collection)
+	}
+	// the workers deflate the zip entries too, while the gzip or zstd streams compress in parallel themselves
+	var precompress func([]byte) ([]byte, error)
+	compressor, ok := precompressorOf(writer)
+	if ok && workers > 1 {
+		precompress = compressor.precompress
+	}
+	reader := newArchiveReader(collection, workers, precompress)
+	defer reader.close()
+	for i, f := range collection {
+		entry := reader.next(i)
+		if entry.statErr != nil {
+			m.errorLog(fmt.Sprintf("read status of file %q failed", f), entry.statErr)
+			m.incArchiveFileFailures()
 			continue
 		}
-		data, err := ioutil.ReadFile(f)
-		if err != nil {
-			m.errorLog(fmt.Sprintf("read profile %q failed", f), err)
+		data := entry.data
+		if entry.readErr != nil {
+			m.errorLog(fmt.Sprintf("read profile %q failed", f), entry.readErr)
+			m.incArchiveFileFailures()
 			data = []byte{0}
 		}
-		_, err = writer.Write(data)
+		name, info := m.archiveEntryName(f), m.archiveEntryInfo(entry.info)
+		if entry.compressed != nil && entry.readErr == nil {
+			err = compressor.WriteCompressedFile(name, info, data, entry.compressed)
+		} else {
+			err = writer.WriteFile(name, info, data)
+		}
 		if err != nil {
-			m.errorLog(fmt.Sprintf("write zip of file %q failed", f), err)
-			return
+			m.errorLog(fmt.Sprintf("write archive of file %q failed", f), err)
+			m.incArchiveFileFailures()
+			return "", err
+		}
+		archived = append(archived, f)
+	}
+	return archivePath, nil
+}
+
+// createArchiveFile creates the archive name+ext in dir, or name_<n>+ext for the first n free.
+func createArchiveFile(dir, name, ext string) (*os.File, string, error) {
+	path := filepath.Join(dir, name+ext)
+	for n := 1; ; n++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, path, err
 		}
+		path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name, n, ext))
 	}
 }
+
+type archiveEntry struct {
+	info    os.FileInfo
+	data    []byte
+	statErr error
+	readErr error
+	// compressed is data compressed ahead, nil if it isn't
+	compressed []byte
+}
+
+// archiveReader reads the files of an archive ahead with up to workers goroutines, holding at most
+// workers files at once. The workers compress the files too with precompress if set.
+type archiveReader struct {
+	entries []chan archiveEntry
+	tokens  chan struct{}
+	done    chan struct{}
+}
+
+func newArchiveReader(collection []string, workers int, precompress func([]byte) ([]byte, error)) *archiveReader {
+	r := &archiveReader{
+		entries: make([]chan archiveEntry, len(collection)),
+		tokens:  make(chan struct{}, workers),
+		done:    make(chan struct{}),
+	}
+	for i := range r.entries {
+		r.entries[i] = make(chan archiveEntry, 1)
+	}
+	go func() {
+		for i, f := range collection {
+			select {
+			case r.tokens <- struct{}{}:
+			case <-r.done:
+				return
+			}
+			go func(entry chan<- archiveEntry, f string) {
+				var e archiveEntry
+				if e.info, e.statErr = os.Stat(f); e.statErr == nil {
+					e.data, e.readErr = ioutil.ReadFile(f)
+				}
+				if precompress != nil && e.statErr == nil && e.readErr == nil {
+					// a failure is left to the archive writer, which compresses the file again
+					e.compressed, _ = precompress(e.data)
+				}
+				entry <- e
+			}(r.entries[i], f)
+		}
+	}()
+	return r
+}
+
+// next returns the i-th file of the collection, files must be taken in order.
+func (r *archiveReader) next(i int) archiveEntry {
+	e := <-r.entries[i]
+	<-r.tokens
+	return e
+}
+
+// close stops reading ahead, it must be called once done with the reader.
+func (r *archiveReader) close() {
+	close(r.done)
+}
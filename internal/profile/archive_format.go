@@ -0,0 +1,361 @@
+package profile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionFormat is the format of the archives.
+type CompressionFormat int
+
+const (
+	// Zip archives the profiles into a .zip file, it is the default.
+	Zip CompressionFormat = iota
+	// Zstd archives the profiles into a zstd compressed tarball (.tar.zst), which is faster and
+	// smaller than zip for profiles.
+	Zstd
+	// Gzip archives the profiles into a gzip compressed tarball (.tar.gz), compressed with up to
+	// ArchiveWorkers goroutines.
+	Gzip
+)
+
+// archiveFormat is the extension and the MIME type of the archives of a CompressionFormat.
+type archiveFormat struct {
+	extension   string
+	contentType string
+}
+
+// archiveFormats maps the compression formats to their archiveFormat, for the naming of the archives and
+// their Content-Type.
+var archiveFormats = map[CompressionFormat]archiveFormat{
+	Zip:  {extension: ".zip", contentType: "application/zip"},
+	Zstd: {extension: ".tar.zst", contentType: "application/zstd"},
+	Gzip: {extension: ".tar.gz", contentType: "application/gzip"},
+}
+
+// defaultArchiveContentType is the MIME type of the archives encrypted with EncryptionKey, and of the unknown
+// ones.
+const defaultArchiveContentType = "application/octet-stream"
+
+func (f CompressionFormat) archiveFormat() archiveFormat {
+	if format, ok := archiveFormats[f]; ok {
+		return format
+	}
+	return archiveFormats[Zip]
+}
+
+func (f CompressionFormat) extension() string {
+	return f.archiveFormat().extension
+}
+
+// ContentType returns the MIME type of the archives of f, e.g. application/zip.
+func (f CompressionFormat) ContentType() string {
+	return f.archiveFormat().contentType
+}
+
+// ArchiveContentType returns the MIME type of the archive named name after its extension, the one of the
+// encrypted archives and of the unknown ones is application/octet-stream.
+func ArchiveContentType(name string) string {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(name, format.extension) {
+			return format.contentType
+		}
+	}
+	return defaultArchiveContentType
+}
+
+// archiveWriter adds profiles to an archive.
+type archiveWriter interface {
+	// WriteFile adds data as the entry name, with the mode and modification time of info.
+	WriteFile(name string, info os.FileInfo, data []byte) error
+	// Flush writes out what is buffered, the archive is complete only once closed.
+	Flush() error
+	Close() error
+}
+
+// precompressor is an archiveWriter whose entries can be compressed ahead, concurrently, e.g. by the
+// workers of an archiveReader.
+type precompressor interface {
+	// precompress returns data compressed for WriteCompressedFile, it is safe for concurrent use.
+	precompress(data []byte) ([]byte, error)
+	// WriteCompressedFile is WriteFile of data, whose compressed form is compressed.
+	WriteCompressedFile(name string, info os.FileInfo, data, compressed []byte) error
+}
+
+// precompressorOf returns w as a precompressor, if its archives can be compressed ahead.
+func precompressorOf(w archiveWriter) (precompressor, bool) {
+	if e, ok := w.(*encryptedArchiveWriter); ok {
+		w = e.archiveWriter
+	}
+	p, ok := w.(precompressor)
+	return p, ok
+}
+
+// newArchiveWriter returns a writer of format into w, compressing with up to workers goroutines, and
+// encrypting with key if set.
+func newArchiveWriter(format CompressionFormat, w io.Writer, workers int, key []byte) (archiveWriter, error) {
+	if len(key) == 0 {
+		return newPlainArchiveWriter(format, w, workers)
+	}
+	encrypter, err := newEncryptWriter(w, key)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newPlainArchiveWriter(format, encrypter, workers)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedArchiveWriter{archiveWriter: writer, encrypter: encrypter}, nil
+}
+
+func newPlainArchiveWriter(format CompressionFormat, w io.Writer, workers int) (archiveWriter, error) {
+	// the zstd encoder doesn't check the count written
+	w = fullWriter{w}
+	switch format {
+	case Zstd:
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(workers))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tw: tar.NewWriter(encoder), encoder: encoder}, nil
+	case Gzip:
+		encoder := newParallelGzipWriter(w, workers)
+		return &tarArchiveWriter{tw: tar.NewWriter(encoder), encoder: encoder}, nil
+	default:
+		return newZipArchiveWriter(w), nil
+	}
+}
+
+// archiveEntryName is the name of the profile at path in the archives, its base name unless
+// ArchiveEntryName is set. The name is made relative and slash separated, so that it extracts cleanly.
+func (opt *Option) archiveEntryName(path string) string {
+	name := filepath.Base(path)
+	if opt.ArchiveEntryName != nil {
+		name = opt.ArchiveEntryName(path)
+	}
+	name = strings.TrimLeft(filepath.ToSlash(filepath.Clean(name)), "/")
+	for strings.HasPrefix(name, "../") {
+		name = name[len("../"):]
+	}
+	if name == "" || name == "." || name == ".." {
+		return filepath.Base(path)
+	}
+	return name
+}
+
+// reproducibleModTime is the modification time of the entries of ReproducibleArchives, the zip epoch.
+var reproducibleModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveEntryInfo is the info the entry of a profile is written with, which has the fixed
+// reproducibleModTime and no owner under ReproducibleArchives.
+func (opt *Option) archiveEntryInfo(info os.FileInfo) os.FileInfo {
+	if !opt.ReproducibleArchives {
+		return info
+	}
+	return reproducibleInfo{info}
+}
+
+type reproducibleInfo struct {
+	os.FileInfo
+}
+
+func (reproducibleInfo) ModTime() time.Time {
+	return reproducibleModTime
+}
+
+func (reproducibleInfo) Sys() interface{} {
+	return nil
+}
+
+// writeFull writes data into w, a short write without an error is one rather than a truncated entry.
+func writeFull(w io.Writer, data []byte) error {
+	_, err := fullWriter{w}.Write(data)
+	return err
+}
+
+// fullWriter turns the short writes into w into errors.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(data []byte) (int, error) {
+	n, err := f.w.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// encryptedArchiveWriter is an archiveWriter into an encryptWriter.
+type encryptedArchiveWriter struct {
+	archiveWriter
+	encrypter *encryptWriter
+}
+
+func (e *encryptedArchiveWriter) Flush() error {
+	if err := e.archiveWriter.Flush(); err != nil {
+		return err
+	}
+	return e.encrypter.Flush()
+}
+
+func (e *encryptedArchiveWriter) Close() error {
+	if err := e.archiveWriter.Close(); err != nil {
+		return err
+	}
+	return e.encrypter.Close()
+}
+
+// zipDeflateLevel is the level archive/zip deflates the entries with.
+const zipDeflateLevel = 5
+
+type zipArchiveWriter struct {
+	zw         *zip.Writer
+	compressed []byte // the entry WriteCompressedFile is writing, deflated ahead
+}
+
+func newZipArchiveWriter(w io.Writer) *zipArchiveWriter {
+	z := &zipArchiveWriter{zw: zip.NewWriter(w)}
+	z.zw.RegisterCompressor(zip.Deflate, z.compressor)
+	return z
+}
+
+// compressor deflates the entries as archive/zip does, or writes the one deflated ahead, so that the
+// archives are the same either way.
+func (z *zipArchiveWriter) compressor(w io.Writer) (io.WriteCloser, error) {
+	if z.compressed != nil {
+		return &precompressedWriter{w: w, compressed: z.compressed}, nil
+	}
+	return newFlateWriter(w), nil
+}
+
+func (z *zipArchiveWriter) precompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw := newFlateWriter(&buf)
+	if err := writeFull(fw, data); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// flateWriters are the flate.Writers of zipDeflateLevel, which are costly to allocate.
+var flateWriters sync.Pool
+
+// pooledFlateWriter is a flate.Writer back into flateWriters once closed.
+type pooledFlateWriter struct {
+	*flate.Writer
+}
+
+func newFlateWriter(w io.Writer) *pooledFlateWriter {
+	fw, ok := flateWriters.Get().(*flate.Writer)
+	if !ok {
+		// only fails on an invalid level
+		fw, _ = flate.NewWriter(w, zipDeflateLevel)
+		return &pooledFlateWriter{fw}
+	}
+	fw.Reset(w)
+	return &pooledFlateWriter{fw}
+}
+
+func (p *pooledFlateWriter) Close() error {
+	err := p.Writer.Close()
+	flateWriters.Put(p.Writer)
+	return err
+}
+
+func (z *zipArchiveWriter) WriteCompressedFile(name string, info os.FileInfo, data, compressed []byte) error {
+	z.compressed = compressed
+	defer func() {
+		z.compressed = nil
+	}()
+	return z.WriteFile(name, info, data)
+}
+
+func (z *zipArchiveWriter) WriteFile(name string, info os.FileInfo, data []byte) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	writer, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return writeFull(writer, data)
+}
+
+func (z *zipArchiveWriter) Flush() error {
+	return z.zw.Flush()
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+// precompressedWriter drops the data of a zip entry, which archive/zip still checksums and counts, and
+// writes its compressed form instead once closed.
+type precompressedWriter struct {
+	w          io.Writer
+	compressed []byte
+}
+
+func (p *precompressedWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (p *precompressedWriter) Close() error {
+	return writeFull(p.w, p.compressed)
+}
+
+type tarArchiveWriter struct {
+	tw      *tar.Writer
+	encoder tarEncoder
+}
+
+// tarEncoder compresses a tarball, e.g. a zstd.Encoder.
+type tarEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (t *tarArchiveWriter) WriteFile(name string, info os.FileInfo, data []byte) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Size = int64(len(data))
+	if err = t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	return writeFull(t.tw, data)
+}
+
+func (t *tarArchiveWriter) Flush() error {
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+	return t.encoder.Flush()
+}
+
+func (t *tarArchiveWriter) Close() error {
+	err := t.tw.Close()
+	if closeErr := t.encoder.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
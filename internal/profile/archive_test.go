@@ -0,0 +1,625 @@
+package profile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+// zipEntries returns the entry names of all the zip archives in dir.
+func zipEntries(t *testing.T, dir string) []string {
+	archives, err := filepath.Glob(filepath.Join(dir, "*.zip"))
+	assert.NoError(t, err)
+	var names []string
+	for _, archive := range archives {
+		r, err := zip.OpenReader(archive)
+		assert.NoError(t, err)
+		for _, f := range r.File {
+			names = append(names, f.Name)
+		}
+		r.Close()
+	}
+	return names
+}
+
+type archiveContent struct {
+	name string
+	data []byte
+}
+
+// archiveContents extracts the archive at path, in order.
+func archiveContents(t *testing.T, path string) []archiveContent {
+	var contents []archiveContent
+	if strings.HasSuffix(path, Zip.extension()) {
+		r, err := zip.OpenReader(path)
+		assert.NoError(t, err)
+		defer r.Close()
+		for _, f := range r.File {
+			rc, err := f.Open()
+			assert.NoError(t, err)
+			data, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			rc.Close()
+			contents = append(contents, archiveContent{f.Name, data})
+		}
+		return contents
+	}
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	var decoder io.Reader
+	if strings.HasSuffix(path, Gzip.extension()) {
+		gr, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+		defer gr.Close()
+		decoder = gr
+	} else {
+		zr, err := zstd.NewReader(file)
+		assert.NoError(t, err)
+		defer zr.Close()
+		decoder = zr
+	}
+	tr := tar.NewReader(decoder)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		contents = append(contents, archiveContent{header.Name, data})
+	}
+	return contents
+}
+
+func TestArchiveExclude(t *testing.T) {
+	m := newTestManager(t, &Option{
+		Compress:       true,
+		ArchivePolicy:  &FileNumArchivePolicy{MaxFileNum: 1},
+		ArchiveExclude: []string{"goroutine_*"},
+	})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	excluded, err := filepath.Glob(filepath.Join(m.StoreDir, "goroutine_*"))
+	assert.NoError(t, err)
+	assert.Len(t, excluded, 1)
+	heap := m.getFileCollection()
+	assert.Len(t, heap, 1)
+	m.checkArchive()
+
+	assert.Equal(t, []string{filepath.Base(heap[0])}, zipEntries(t, m.archiveDir))
+	assert.FileExists(t, excluded[0])
+	_, err = os.Stat(heap[0])
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchiveExcludeInvalidPattern(t *testing.T) {
+	err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir(), ArchiveExclude: []string{"["}}, Heap)
+	assert.Error(t, err)
+}
+
+func TestZstdArchive(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, CompressionFormat: Zstd})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	collection := m.getFileCollection()
+	want := make(map[string][]byte)
+	for _, f := range collection {
+		data, err := ioutil.ReadFile(f)
+		assert.NoError(t, err)
+		want[filepath.Base(f)] = data
+	}
+	_, _, err := m.doArchive0(collection)
+	assert.NoError(t, err)
+
+	archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.tar.zst"))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	got := make(map[string][]byte)
+	for _, entry := range archiveContents(t, archives[0]) {
+		got[entry.name] = entry.data
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestForceArchive(t *testing.T) {
+	_, err := ForceArchive()
+	assert.Equal(t, ErrNotEnabled, err)
+
+	m := newTestManager(t, &Option{Compress: true, ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 100}})
+	defer os.RemoveAll(m.StoreDir)
+	manager = m
+	defer func() { manager = nil }()
+	_, err = ForceArchive()
+	assert.Equal(t, ErrNothingToArchive, err)
+
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+	archives, err := ForceArchive()
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	assert.Equal(t, m.archiveDir, filepath.Dir(archives[0]))
+	assert.Equal(t, []string{filepath.Base(collection[0])}, zipEntries(t, m.archiveDir))
+	assert.Empty(t, m.getFileCollection())
+}
+
+// writeTestProfiles writes n files of random content into dir.
+func writeTestProfiles(t testing.TB, dir string, n int) []string {
+	var collection []string
+	for i := 0; i < n; i++ {
+		data := make([]byte, 64*1024+rand.Intn(64*1024))
+		rand.Read(data)
+		f := filepath.Join(dir, "heap_"+strconv.Itoa(i)+".profile")
+		assert.NoError(t, ioutil.WriteFile(f, data, 0644))
+		collection = append(collection, f)
+	}
+	return collection
+}
+
+func TestParallelArchive(t *testing.T) {
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		m := newTestManager(t, &Option{Compress: true, CompressionFormat: format})
+		collection := writeTestProfiles(t, m.StoreDir, 20)
+
+		var contents [][]archiveContent
+		var archives [][]byte
+		for _, workers := range []int{1, 4} {
+			m.ArchiveWorkers = workers
+			dir := filepath.Join(m.StoreDir, "archive"+strconv.Itoa(workers))
+			assert.NoError(t, createDirIfNotExists(dir))
+			archive, err := m.archiveTo(dir, collection, "")
+			assert.NoError(t, err)
+			contents = append(contents, archiveContents(t, archive))
+			data, err := ioutil.ReadFile(archive)
+			assert.NoError(t, err)
+			archives = append(archives, data)
+		}
+		assert.Len(t, contents[0], len(collection))
+		assert.Equal(t, contents[0], contents[1])
+		if format != Zstd {
+			// the zip entries deflated ahead and the gzip members don't depend on the workers
+			assert.True(t, bytes.Equal(archives[0], archives[1]), format.extension())
+		}
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestReproducibleArchives(t *testing.T) {
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		m := newTestManager(t, &Option{Compress: true, CompressionFormat: format, ReproducibleArchives: true})
+		collection := writeTestProfiles(t, m.StoreDir, 5)
+
+		var archives [][]byte
+		for i, order := range [][]string{collection, {collection[3], collection[0], collection[4], collection[2],
+			collection[1]}} {
+			// the modification time of the profiles must not matter
+			later := time.Now().Add(time.Duration(i) * time.Hour)
+			for _, f := range collection {
+				assert.NoError(t, os.Chtimes(f, later, later))
+			}
+			archive, err := m.archiveTo(m.archiveDir, order, "")
+			assert.NoError(t, err)
+			data, err := ioutil.ReadFile(archive)
+			assert.NoError(t, err)
+			archives = append(archives, data)
+		}
+		assert.True(t, bytes.Equal(archives[0], archives[1]), format.extension())
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func BenchmarkArchive(b *testing.B) {
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		for _, workers := range []int{1, 4} {
+			b.Run(format.extension()+"/"+strconv.Itoa(workers), func(b *testing.B) {
+				dir, err := ioutil.TempDir("", "profiles")
+				assert.NoError(b, err)
+				defer os.RemoveAll(dir)
+				m := &profileManager{Option: &Option{
+					StoreDir:          dir,
+					CompressionFormat: format,
+					ArchiveWorkers:    workers,
+					ErrLogOutput:      ioutil.Discard,
+				}, storeDir: dir}
+				collection := writeTestProfiles(b, dir, 100)
+				var size int64
+				for _, f := range collection {
+					info, err := os.Stat(f)
+					assert.NoError(b, err)
+					size += info.Size()
+				}
+				// the speedup of the workers is up to GOMAXPROCS
+				b.SetBytes(size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					archive, err := m.archiveTo(dir, collection, "")
+					assert.NoError(b, err)
+					os.Remove(archive)
+				}
+			})
+		}
+	}
+}
+
+func TestOnArchiveDecision(t *testing.T) {
+	var decisions []bool
+	var pending []int
+	m := newTestManager(t, &Option{
+		Compress:      true,
+		ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 2},
+		OnArchiveDecision: func(shouldArchive bool, pendingFiles int) {
+			decisions = append(decisions, shouldArchive)
+			pending = append(pending, pendingFiles)
+		},
+	})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.checkArchive()
+	m.doInstantProfile(Heap)
+	m.checkArchive()
+	m.doInstantProfile(Goroutine)
+	m.checkArchive()
+	assert.Equal(t, []bool{false, false, true}, decisions)
+	assert.Equal(t, []int{0, 1, 2}, pending)
+}
+
+func TestMinArchiveInterval(t *testing.T) {
+	m := newTestManager(t, &Option{
+		Compress:           true,
+		ArchivePolicy:      &FileNumArchivePolicy{MaxFileNum: 1},
+		MinArchiveInterval: 300 * time.Millisecond,
+	})
+	defer os.RemoveAll(m.StoreDir)
+
+	countArchives := func() int {
+		archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.zip"))
+		assert.NoError(t, err)
+		return len(archives)
+	}
+	for i := 0; i < 3; i++ {
+		m.doInstantProfile(Heap)
+		m.checkArchive()
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, 1, countArchives())
+	assert.Len(t, m.getFileCollection(), 2)
+
+	time.Sleep(200 * time.Millisecond)
+	m.checkArchive()
+	assert.Equal(t, 2, countArchives())
+	assert.Empty(t, m.getFileCollection())
+}
+
+func TestOpenFilesNotArchived(t *testing.T) {
+	m := newTestManager(t, &Option{
+		X:             300 * time.Millisecond,
+		Compress:      true,
+		ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 1},
+	})
+	defer os.RemoveAll(m.StoreDir)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.doDurationProfile(Trace)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	heap := m.getFileCollection()
+	m.checkArchive()
+	traces, err := filepath.Glob(filepath.Join(m.StoreDir, "trace_*"))
+	assert.NoError(t, err)
+	assert.Len(t, traces, 1)
+	m.lock.Lock()
+	_, open := m.openFiles[traces[0]]
+	m.lock.Unlock()
+	assert.True(t, open)
+	assert.Equal(t, []string{filepath.Base(heap[0])}, zipEntries(t, m.archiveDir))
+	// nor does a scan of the store dir pick it up
+	m.scanStoreDir(m.StoreDir)
+	assert.Empty(t, m.getFileCollection())
+
+	// once closed, the trace is archived with the next batch
+	<-done
+	assert.Equal(t, traces, m.getFileCollection())
+	time.Sleep(5 * time.Millisecond)
+	m.checkArchive()
+	assert.ElementsMatch(t, []string{filepath.Base(heap[0]), filepath.Base(traces[0])}, zipEntries(t, m.archiveDir))
+	_, err = os.Stat(traces[0])
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTimeArchivePolicy(t *testing.T) {
+	policy := &TimeArchivePolicy{MaxHistory: 200 * time.Millisecond}
+	assert.False(t, policy.needArchive(nil))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, policy.needArchive(nil))
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, policy.needArchive(nil))
+	// asks again until the archive runs
+	assert.True(t, policy.needArchive(nil))
+	policy.archiveRan()
+	// the next archive is MaxHistory later
+	assert.False(t, policy.needArchive(nil))
+
+	policy = &TimeArchivePolicy{MaxHistory: 200 * time.Millisecond, ArchiveOnStart: true}
+	assert.True(t, policy.needArchive(nil))
+	policy.archiveRan()
+	assert.False(t, policy.needArchive(nil))
+}
+
+func TestMinArchiveIntervalTimePolicy(t *testing.T) {
+	m := newTestManager(t, &Option{
+		Compress:           true,
+		ArchivePolicy:      &TimeArchivePolicy{MaxHistory: 300 * time.Millisecond},
+		MinArchiveInterval: 400 * time.Millisecond,
+	})
+	defer os.RemoveAll(m.StoreDir)
+	countArchives := func() int {
+		archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.zip"))
+		assert.NoError(t, err)
+		return len(archives)
+	}
+
+	m.doInstantProfile(Heap)
+	m.checkArchive()
+	time.Sleep(350 * time.Millisecond)
+	m.checkArchive()
+	assert.Equal(t, 1, countArchives())
+
+	// suppressed by MinArchiveInterval, the policy still asks for the archive once it is over
+	m.doInstantProfile(Heap)
+	time.Sleep(350 * time.Millisecond)
+	m.checkArchive()
+	assert.Equal(t, 1, countArchives())
+	time.Sleep(100 * time.Millisecond)
+	m.checkArchive()
+	assert.Equal(t, 2, countArchives())
+}
+
+func TestArchiveRetries(t *testing.T) {
+	defer func(backoff time.Duration) {
+		archiveRetryBackoff = backoff
+	}(archiveRetryBackoff)
+	archiveRetryBackoff = 100 * time.Millisecond
+	m := newTestManager(t, &Option{
+		Compress:       true,
+		ArchivePolicy:  &FileNumArchivePolicy{MaxFileNum: 1},
+		ArchiveRetries: 2,
+	})
+	defer os.RemoveAll(m.StoreDir)
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+
+	// the archive fails until the archive directory is back, between the second and the third attempt
+	assert.NoError(t, os.Remove(m.archiveDir))
+	assert.NoError(t, ioutil.WriteFile(m.archiveDir, nil, 0644))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.checkArchive()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	assert.FileExists(t, collection[0])
+	assert.NoError(t, os.Remove(m.archiveDir))
+	assert.NoError(t, os.Mkdir(m.archiveDir, 0755))
+	<-done
+
+	assert.Equal(t, []string{filepath.Base(collection[0])}, zipEntries(t, m.archiveDir))
+	_, err := os.Stat(collection[0])
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, m.getFileCollection())
+}
+
+func TestArchiveRetriesOnArchiver(t *testing.T) {
+	defer func(backoff time.Duration) {
+		archiveRetryBackoff = backoff
+	}(archiveRetryBackoff)
+	archiveRetryBackoff = time.Hour
+	m := newTestManager(t, &Option{
+		Compress:       true,
+		ArchivePolicy:  &FileNumArchivePolicy{MaxFileNum: 1},
+		ArchiveRetries: 2,
+	})
+	defer os.RemoveAll(m.StoreDir)
+	m.stop = make(chan struct{})
+	m.startArchiver()
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+
+	assert.NoError(t, os.Remove(m.archiveDir))
+	assert.NoError(t, ioutil.WriteFile(m.archiveDir, nil, 0644))
+	forced := make(chan error, 1)
+	go func() {
+		_, err := m.forceArchive()
+		forced <- err
+	}()
+	// the archiver waits for the retry, the ticks don't
+	time.Sleep(50 * time.Millisecond)
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		m.checkArchive()
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("checkArchive waited for the archive retries")
+	}
+
+	// stopping gives the retries up
+	close(m.stop)
+	select {
+	case err := <-forced:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the archive retries went on once stopped")
+	}
+	m.stopArchiver()
+	assert.FileExists(t, collection[0])
+	assert.Equal(t, collection, m.getFileCollection())
+}
+
+func TestArchiveFailureKeepsFiles(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 1}})
+	defer os.RemoveAll(m.StoreDir)
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+
+	assert.NoError(t, os.Remove(m.archiveDir))
+	assert.NoError(t, ioutil.WriteFile(m.archiveDir, nil, 0644))
+	m.checkArchive()
+	assert.FileExists(t, collection[0])
+	assert.Equal(t, collection, m.getFileCollection())
+}
+
+func TestArchiveEntryNames(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true})
+	defer os.RemoveAll(m.StoreDir)
+	collection := writeTestProfiles(t, m.StoreDir, 2)
+
+	_, err := m.archiveTo(m.archiveDir, collection, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"heap_0.profile", "heap_1.profile"}, zipEntries(t, m.archiveDir))
+
+	for _, name := range []string{"heap", "/abs/heap", "../../heap", "./x/../heap"} {
+		m.ArchiveEntryName = func(string) string { return name }
+		assert.NotContains(t, m.archiveEntryName(collection[0]), "..")
+		assert.False(t, filepath.IsAbs(m.archiveEntryName(collection[0])))
+	}
+	m.ArchiveEntryName = func(path string) string {
+		rel, _ := filepath.Rel(filepath.Dir(m.StoreDir), path)
+		return rel
+	}
+	assert.Equal(t, filepath.Base(m.StoreDir)+"/heap_0.profile", m.archiveEntryName(collection[0]))
+}
+
+func TestDailyArchivePolicy(t *testing.T) {
+	defer func(f func() time.Time) {
+		now = f
+	}(now)
+	clock := time.Date(2020, 1, 1, 23, 59, 0, 0, time.UTC)
+	now = func() time.Time {
+		// every call is a little later, so that the profile names differ
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	m := newTestManager(t, &Option{Compress: true, ArchivePolicy: &DailyArchivePolicy{}})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	m.checkArchive()
+	firstDay := m.getFileCollection()
+	assert.Len(t, firstDay, 2)
+
+	clock = time.Date(2020, 1, 2, 0, 0, 30, 0, time.UTC)
+	m.doInstantProfile(Heap)
+	m.checkArchive()
+	secondDay := m.getFileCollection()
+	assert.Len(t, secondDay, 1)
+	assert.Equal(t, baseNames(firstDay), zipEntries(t, m.archiveDir))
+
+	clock = time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+	m.doInstantProfile(Heap)
+	secondDay = m.getFileCollection()
+	clock = time.Date(2020, 1, 3, 0, 0, 1, 0, time.UTC)
+	m.checkArchive()
+	assert.Empty(t, m.getFileCollection())
+
+	archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.zip"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(m.archiveDir, "2020-01-01.zip"),
+		filepath.Join(m.archiveDir, "2020-01-02.zip"),
+	}, archives)
+	assert.Equal(t, baseNames(secondDay), entryNames(archiveContents(t, archives[1])))
+}
+
+func baseNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+func entryNames(contents []archiveContent) []string {
+	names := make([]string, len(contents))
+	for i, content := range contents {
+		names[i] = content.name
+	}
+	return names
+}
+
+// shortWriter writes half of what it is given and reports no error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, nil
+}
+
+func TestArchiveShortWrite(t *testing.T) {
+	assert.Equal(t, io.ErrShortWrite, writeFull(shortWriter{}, []byte("profile")))
+
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f := writeTestProfiles(t, dir, 1)[0]
+	info, err := os.Stat(f)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(f)
+	assert.NoError(t, err)
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		writer, err := newArchiveWriter(format, shortWriter{}, 1, nil)
+		assert.NoError(t, err)
+		err = writer.WriteFile(filepath.Base(f), info, data)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		assert.Equal(t, io.ErrShortWrite, err, format.extension())
+	}
+}
+
+func TestCreateArchiveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, want := range []string{"2020-01-02.zip", "2020-01-02_1.zip", "2020-01-02_2.zip"} {
+		file, path, err := createArchiveFile(dir, "2020-01-02", ".zip")
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, want), path)
+		file.Close()
+	}
+}
+
+func TestArchiveContentType(t *testing.T) {
+	assert.Equal(t, "application/zip", Zip.ContentType())
+	assert.Equal(t, "application/zstd", Zstd.ContentType())
+	assert.Equal(t, "application/gzip", Gzip.ContentType())
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		assert.Equal(t, format.ContentType(), ArchiveContentType("2020-01-02"+format.extension()))
+		opt := &Option{CompressionFormat: format, EncryptionKey: make([]byte, 16)}
+		assert.Equal(t, "application/octet-stream", ArchiveContentType("2020-01-02"+opt.archiveExtension()))
+	}
+	assert.Equal(t, "application/octet-stream", ArchiveContentType("2020-01-02.tar"))
+}
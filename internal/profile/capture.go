@@ -0,0 +1,226 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+)
+
+// CaptureCPU records a CPU profile for d into w.
+func CaptureCPU(d time.Duration, w io.Writer) error {
+	return captureCPU(d, w, 0)
+}
+
+// captureCPU is CaptureCPU sampling at rate Hz, 0 keeps the runtime default.
+func captureCPU(d time.Duration, w io.Writer, rate int) error {
+	if err := startCPUProfile(w, rate); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// startCPUProfile starts the cpu profile into w sampling at rate Hz, 0 keeps the default of 100Hz.
+// The rate can only be set while the profiling is off, so right before StartCPUProfile, which then complains
+// about it on stderr. It can't be read back to be saved, but it needs no restoring: StopCPUProfile turns the
+// profiling off along with its rate, and the next StartCPUProfile, ours or another tool's, samples at the
+// default rate again. A rate set while another profile runs is ignored by the runtime.
+// The samples carry the pprof labels of the goroutines they were taken on, e.g. those set with pprof.Do,
+// there is nothing to turn on for it, which RouteCPUProfiler and RequestProfile rely on.
+func startCPUProfile(w io.Writer, rate int) error {
+	if rate > 0 {
+		runtime.SetCPUProfileRate(rate)
+	}
+	if err := pprof.StartCPUProfile(w); err != nil {
+		return ErrCPUProfilingActive
+	}
+	return nil
+}
+
+// CaptureTrace records an execution trace for d into w.
+func CaptureTrace(d time.Duration, w io.Writer) error {
+	if err := trace.Start(w); err != nil {
+		return ErrTraceActive
+	}
+	time.Sleep(d)
+	trace.Stop()
+	return nil
+}
+
+// CaptureSync does a single capture of profile p into opt.StoreDir and returns the path of the written file.
+// Cpu, Trace and WallClock profiles block for opt.X. No background loop is started and the manager used by
+// EnableProfile is left untouched, which makes it handy for tests and benchmarks.
+func CaptureSync(p Profile, opt *Option) (string, error) {
+	if err := checkProfiles([]Profile{p}); err != nil {
+		return "", err
+	}
+	if isDurationProfile(p) && opt.X <= 0 {
+		return "", invalidInterval("X should not <= 0")
+	}
+	if err := checkCPUProfileRate(opt.CPUProfileRate); err != nil {
+		return "", err
+	}
+	format := opt.FileFormat
+	if format == nil {
+		format = defaultFormat
+	}
+	filePath := getFilePath(p, opt.StoreDir, format, opt.timestamp())
+	file, err := createProfileFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	err = writeProfile(file, p, opt)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filePath)
+		return "", err
+	}
+	return filePath, nil
+}
+
+// CaptureBytes captures profile p in memory and returns it, without a StoreDir. Cpu, Trace and WallClock
+// profiles are recorded for d, which is ignored for the others.
+func CaptureBytes(p Profile, d time.Duration) ([]byte, error) {
+	if err := checkProfiles([]Profile{p}); err != nil {
+		return nil, err
+	}
+	if isDurationProfile(p) && d <= 0 {
+		return nil, invalidInterval("duration should not <= 0")
+	}
+	var buf bytes.Buffer
+	if err := writeProfile(&buf, p, &Option{X: d}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CaptureCPUDuring records a cpu profile while f runs into opt.StoreDir/cpu_<name>.profile and returns its
+// path. f runs under pprof.Do with labels, so that its samples can be told apart from the ones of the other
+// goroutines, e.g. `go tool pprof -tagfocus trace_id=<name>`. f runs even if the profile cannot be started.
+func CaptureCPUDuring(ctx context.Context, name string, opt *Option, labels pprof.LabelSet,
+	f func(context.Context)) (string, error) {
+	if name == "" || name != filepath.Base(name) {
+		f(ctx)
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+	if err := checkCPUProfileRate(opt.CPUProfileRate); err != nil {
+		f(ctx)
+		return "", err
+	}
+	filePath := filepath.Join(opt.StoreDir, string(Cpu)+"_"+name+".profile")
+	file, err := createProfileFile(filePath)
+	if err != nil {
+		f(ctx)
+		return "", err
+	}
+	if err = startCPUProfile(file, opt.CPUProfileRate); err != nil {
+		file.Close()
+		_ = os.Remove(filePath)
+		f(ctx)
+		return "", err
+	}
+	pprof.Do(ctx, labels, f)
+	pprof.StopCPUProfile()
+	if err = file.Close(); err != nil {
+		_ = os.Remove(filePath)
+		return "", err
+	}
+	return filePath, nil
+}
+
+// createProfileFile creates the file of a single capture, it fails if it exists already.
+func createProfileFile(filePath string) (*os.File, error) {
+	if err := createDirIfNotExists(filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+func isDurationProfile(p Profile) bool {
+	return p == Cpu || p == Trace || p == WallClock
+}
+
+// writeProfile writes profile p into w, recording duration profiles for opt.X, or opt.TraceDuration
+// for the trace if set.
+func writeProfile(w io.Writer, p Profile, opt *Option) error {
+	switch p {
+	case Cpu:
+		return captureCPU(opt.X, w, opt.CPUProfileRate)
+	case Trace:
+		if opt.TraceDuration > 0 {
+			return CaptureTrace(opt.TraceDuration, w)
+		}
+		return CaptureTrace(opt.X, w)
+	case WallClock:
+		return CaptureWallClock(opt.X, w)
+	default:
+		if c, ok := customProfile(p); ok {
+			return c.WriteProfile(w)
+		}
+		opt.beforeCapture(p)
+		return p.lookup().WriteTo(w, opt.debug(p))
+	}
+}
+
+// beforeCapture prepares the runtime for the capture of the instant profile p.
+func (opt *Option) beforeCapture(p Profile) {
+	if p == Heap && opt.HeapForceGC {
+		runtime.GC()
+	}
+}
+
+// lookup returns the runtime profile p is written from.
+func (p Profile) lookup() *pprof.Profile {
+	if p == FullGoroutineDump {
+		return pprof.Lookup(string(Goroutine))
+	}
+	return pprof.Lookup(string(p))
+}
+
+// debug is the debug parameter profile p is written with.
+func (opt *Option) debug(p Profile) int {
+	switch {
+	case p == FullGoroutineDump:
+		return 2
+	case p == ThreadCreate && opt.ThreadCreateText:
+		return 1
+	}
+	return 0
+}
+
+// CaptureToCommand captures profile p and pipes it into the stdin of cmd, e.g. `go tool pprof -http :0 -`.
+// Cpu, Trace and WallClock profiles are recorded for d. It waits for cmd to exit.
+func CaptureToCommand(p Profile, d time.Duration, cmd *exec.Cmd) error {
+	if err := checkProfiles([]Profile{p}); err != nil {
+		return err
+	}
+	if isDurationProfile(p) && d <= 0 {
+		return invalidInterval("duration should not <= 0")
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	err = writeProfile(stdin, p, &Option{X: d})
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
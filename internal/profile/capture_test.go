@@ -0,0 +1,260 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, err := CaptureSync(Heap, &Option{StoreDir: dir})
+	assert.NoError(t, err)
+	assert.FileExists(t, filePath)
+
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.SampleType)
+}
+
+func TestCaptureSyncInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = CaptureSync("unknown", &Option{StoreDir: dir})
+	assert.Error(t, err)
+	_, err = CaptureSync(Cpu, &Option{StoreDir: dir})
+	assert.Error(t, err)
+}
+
+func TestCaptureCPU(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, CaptureCPU(200*time.Millisecond, &buf))
+	p, err := profile.Parse(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", p.PeriodType.Type)
+}
+
+func TestCaptureCPUAlreadyActive(t *testing.T) {
+	done := make(chan error)
+	go func() {
+		done <- CaptureCPU(500*time.Millisecond, ioutil.Discard)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, ErrCPUProfilingActive, CaptureCPU(100*time.Millisecond, ioutil.Discard))
+	assert.NoError(t, <-done)
+}
+
+func TestCaptureTrace(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, CaptureTrace(100*time.Millisecond, &buf))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte("go 1.")))
+}
+
+func TestCaptureSyncCPUProfileRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, err := CaptureSync(Cpu, &Option{StoreDir: dir, X: 200 * time.Millisecond, CPUProfileRate: 500})
+	assert.NoError(t, err)
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(time.Second/500), p.Period)
+
+	_, err = CaptureSync(Cpu, &Option{StoreDir: dir, X: time.Millisecond, CPUProfileRate: maxCPUProfileRate + 1})
+	assert.Error(t, err)
+}
+
+func TestCPUProfileRateRestored(t *testing.T) {
+	period := func(rate int) int64 {
+		var buf bytes.Buffer
+		assert.NoError(t, captureCPU(50*time.Millisecond, &buf, rate))
+		p, err := profile.Parse(&buf)
+		assert.NoError(t, err)
+		return p.Period
+	}
+	assert.Equal(t, int64(time.Second/500), period(500))
+	// the next profile, which doesn't set a rate, samples at the default one
+	assert.Equal(t, int64(time.Second/100), period(0))
+
+	var buf bytes.Buffer
+	assert.NoError(t, pprof.StartCPUProfile(&buf))
+	pprof.StopCPUProfile()
+	p, err := profile.Parse(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(time.Second/100), p.Period)
+}
+
+func TestCPUProfileLabels(t *testing.T) {
+	m := newTestManager(t, &Option{X: 300 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+
+	stop := make(chan struct{})
+	go pprof.Do(context.Background(), pprof.Labels("route", "checkout"), func(context.Context) {
+		burnCPU(stop)
+	})
+	m.doDurationProfile(Cpu)
+	close(stop)
+
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 1)
+	file, err := os.Open(collection[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+	var labelled int64
+	for _, s := range p.Sample {
+		if len(s.Label["route"]) == 1 && s.Label["route"][0] == "checkout" {
+			assert.True(t, inStack(s, "burnCPU"))
+			labelled += s.Value[1]
+		}
+	}
+	assert.True(t, labelled > 0)
+}
+
+func TestCaptureToCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("cat")
+	cmd.Stdout = &out
+	assert.NoError(t, CaptureToCommand(Heap, 0, cmd))
+	p, err := profile.Parse(&out)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.SampleType)
+
+	assert.Error(t, CaptureToCommand(Heap, 0, exec.Command("false")))
+}
+
+func TestThreadCreateProfile(t *testing.T) {
+	for _, text := range []bool{false, true} {
+		m := newTestManager(t, &Option{ThreadCreateText: text})
+		m.doInstantProfile(ThreadCreate)
+		collection := m.getFileCollection()
+		assert.Len(t, collection, 1)
+		data, err := ioutil.ReadFile(collection[0])
+		assert.NoError(t, err)
+		assert.NotEmpty(t, data)
+		assert.Equal(t, text, bytes.HasPrefix(data, []byte("threadcreate profile: total")))
+		p, err := profile.Parse(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.NotEmpty(t, p.Sample)
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestCaptureBytes(t *testing.T) {
+	data, err := CaptureBytes(Heap, 0)
+	assert.NoError(t, err)
+	p, err := profile.ParseData(data)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.SampleType)
+
+	data, err = CaptureBytes(Cpu, 50*time.Millisecond)
+	assert.NoError(t, err)
+	p, err = profile.ParseData(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", p.SampleType[1].Type)
+
+	_, err = CaptureBytes(Trace, 0)
+	assert.True(t, IsError(err, ErrInvalidInterval))
+	_, err = CaptureBytes("unknown", 0)
+	assert.True(t, IsError(err, ErrInvalidProfile))
+}
+
+func TestFullGoroutineDump(t *testing.T) {
+	m := newTestManager(t, &Option{})
+	defer os.RemoveAll(m.StoreDir)
+	blocked := make(chan struct{})
+	defer close(blocked)
+	go func() { <-blocked }()
+
+	m.doInstantProfile(FullGoroutineDump)
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 1)
+	assert.True(t, strings.HasPrefix(filepath.Base(collection[0]), "goroutine_full_"))
+	data, err := ioutil.ReadFile(collection[0])
+	assert.NoError(t, err)
+	dump := string(data)
+	assert.True(t, strings.HasPrefix(dump, "goroutine "), dump)
+	assert.Contains(t, dump, "[running]:")
+	assert.Contains(t, dump, "[chan receive]:")
+	assert.Contains(t, dump, "created by ")
+	assert.Contains(t, dump, "TestFullGoroutineDump")
+}
+
+var heapSink [][]byte
+
+//go:noinline
+func allocateForGC() {
+	for i := 0; i < 2; i++ {
+		heapSink = append(heapSink, make([]byte, 8<<20))
+	}
+}
+
+func TestHeapForceGC(t *testing.T) {
+	inuse := func(gc bool) int64 {
+		allocateForGC()
+		runtime.GC()
+		heapSink = nil
+		m := newTestManager(t, &Option{HeapForceGC: gc})
+		defer os.RemoveAll(m.StoreDir)
+		m.doInstantProfile(Heap)
+		file, err := os.Open(m.getFileCollection()[0])
+		assert.NoError(t, err)
+		defer file.Close()
+		p, err := profile.Parse(file)
+		assert.NoError(t, err)
+		idx := -1
+		for i, st := range p.SampleType {
+			if st.Type == "inuse_space" {
+				idx = i
+			}
+		}
+		var total int64
+		for _, s := range p.Sample {
+			for _, loc := range s.Location {
+				if len(loc.Line) > 0 && strings.HasSuffix(loc.Line[0].Function.Name, "allocateForGC") {
+					total += s.Value[idx]
+					break
+				}
+			}
+		}
+		return total
+	}
+	// the freed allocation is still in use as of the last collection
+	assert.True(t, inuse(false) >= 16<<20)
+	assert.Zero(t, inuse(true))
+}
+
+func TestCaptureCPUDuringInvalidName(t *testing.T) {
+	ran := false
+	_, err := CaptureCPUDuring(context.Background(), "../cpu", &Option{}, pprof.Labels(),
+		func(context.Context) { ran = true })
+	assert.Error(t, err)
+	assert.True(t, ran)
+}
@@ -0,0 +1,85 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// defaultArchiveChannelTimeout is the ArchiveChannelTimeout when not set.
+const defaultArchiveChannelTimeout = time.Minute
+
+// ArchiveReady is an archive received from Archives.
+type ArchiveReady struct {
+	// Name is the base name of the archive, e.g. 2020-01-02_15-04-05.zip.
+	Name string
+	// ReadCloser reads the archive, the receiver must close it.
+	io.ReadCloser
+}
+
+// Archives returns the channel the archives of the profiler enabled with ArchiveChannel are sent to, once
+// written to the archive directory. It is closed when the profiling stops, and is a closed one if no
+// profiler sends its archives to it.
+func Archives() <-chan ArchiveReady {
+	m := currentManager()
+	if m == nil || m.archives == nil {
+		closed := make(chan ArchiveReady)
+		close(closed)
+		return closed
+	}
+	return m.archives
+}
+
+// sendArchive sends archive to the channel of Archives, waiting up to ArchiveChannelTimeout for the
+// receiver, not at all with ArchiveChannelDrop. The archives not received are dropped and counted.
+// Nothing is sent once stopping, the final archive of StopProfile included, as the channel is closed.
+func (m *profileManager) sendArchive(archive string) {
+	if m.archives == nil || atomic.LoadInt32(&m.stopped) == 1 {
+		return
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		m.errorLog(fmt.Sprintf("open archive %q failed", archive), err)
+		return
+	}
+	ready := ArchiveReady{Name: filepath.Base(archive), ReadCloser: file}
+	if m.ArchiveChannelDrop {
+		select {
+		case m.archives <- ready:
+			return
+		default:
+		}
+	} else {
+		timeout := m.ArchiveChannelTimeout
+		if timeout <= 0 {
+			timeout = defaultArchiveChannelTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case m.archives <- ready:
+			return
+		case <-timer.C:
+		case <-m.stop:
+		}
+	}
+	file.Close()
+	atomic.AddInt64(&m.archiveDrops, 1)
+	m.warnLog(fmt.Sprintf("archive %q not received from the archive channel, dropped", archive))
+}
+
+// closeArchives closes the channel of Archives once the profiling stopped. The senders hold archiveLock,
+// or rollingLock for the rolling archive of a new partition, and give up once stopped.
+func (m *profileManager) closeArchives() {
+	if m.archives == nil {
+		return
+	}
+	m.archiveLock.Lock()
+	defer m.archiveLock.Unlock()
+	m.rollingLock.Lock()
+	defer m.rollingLock.Unlock()
+	close(m.archives)
+}
@@ -0,0 +1,88 @@
+package profile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchives(t *testing.T) {
+	enableTestProfile(t, &Option{Y: time.Hour, X: time.Second, Compress: true, ArchiveChannel: true}, Heap)
+	m := manager
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	archives := make(chan []string, 1)
+	go func() {
+		forced, err := ForceArchive()
+		assert.NoError(t, err)
+		archives <- forced
+	}()
+	ready := <-Archives()
+	data, err := ioutil.ReadAll(ready)
+	assert.NoError(t, err)
+	assert.NoError(t, ready.Close())
+	forced := <-archives
+	if assert.Len(t, forced, 1) {
+		assert.Equal(t, filepath.Base(forced[0]), ready.Name)
+		archive, err := ioutil.ReadFile(forced[0])
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(archive, data))
+	}
+
+	assert.NoError(t, StopProfile())
+	_, ok := <-m.archives
+	assert.False(t, ok)
+	_, ok = <-Archives()
+	assert.False(t, ok)
+}
+
+func TestArchivesDropped(t *testing.T) {
+	enableTestProfile(t, &Option{Y: time.Hour, X: time.Second, Compress: true, ArchiveChannel: true,
+		ArchiveChannelDrop: true}, Heap)
+	defer resetForTest()
+	m := manager
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	forced, err := ForceArchive()
+	assert.NoError(t, err)
+	assert.Len(t, forced, 1)
+	status, err := GetStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), status.ArchivesDropped)
+	// the archive stays in the archive directory
+	_, err = os.Stat(forced[0])
+	assert.NoError(t, err)
+}
+
+func TestArchivesStop(t *testing.T) {
+	enableTestProfile(t, &Option{Y: time.Hour, X: time.Second, Compress: true, ArchiveChannel: true}, Heap)
+	m := manager
+	defer os.RemoveAll(m.StoreDir)
+
+	// nobody receives, neither the pending force archive nor the final one hold StopProfile back
+	m.doInstantProfile(Heap)
+	forced := make(chan error, 1)
+	go func() {
+		_, err := m.forceArchive()
+		forced <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	start := time.Now()
+	assert.NoError(t, StopProfile())
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.NoError(t, <-forced)
+	_, ok := <-m.archives
+	assert.False(t, ok)
+
+	// a ForceArchive racing StopProfile doesn't send on the closed channel
+	_, err := m.forceArchive()
+	assert.Equal(t, ErrNotEnabled, err)
+}
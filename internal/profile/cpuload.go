@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cpuUtilization returns the utilization of the host cpus in [0, 1] since its previous call, since the boot
+// on the first one. Tests replace it.
+var cpuUtilization = (&procStat{}).utilization
+
+// procStat reads the cpu utilization from /proc/stat.
+type procStat struct {
+	lock        sync.Mutex
+	idle, total uint64
+}
+
+func (s *procStat) utilization() (float64, error) {
+	idle, total, err := readProcStat("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if total <= s.total {
+		return 0, nil
+	}
+	busy := 1 - float64(idle-s.idle)/float64(total-s.total)
+	s.idle, s.total = idle, total
+	return busy, nil
+}
+
+// readProcStat returns the idle and total times of the cpus, in ticks, from the first line of path.
+func readProcStat(path string) (idle, total uint64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		if err = scanner.Err(); err == nil {
+			err = errors.New("empty " + path)
+		}
+		return 0, 0, err
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected %s line %q", path, scanner.Text())
+	}
+	// user nice system idle iowait irq softirq steal, guest is accounted in user already
+	for i, field := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += n
+		if i == 3 || i == 4 {
+			idle += n
+		}
+	}
+	return idle, total, nil
+}
+
+// cpuSaturated tells whether the cpu utilization is above MaxCPUForCapture, in which case the cpu profile is
+// skipped. It is not if the utilization can't be read, e.g. on a system without /proc.
+func (m *profileManager) cpuSaturated() bool {
+	if m.MaxCPUForCapture <= 0 {
+		return false
+	}
+	utilization, err := cpuUtilization()
+	if err != nil {
+		m.errorLogOnce("cpu utilization", "read cpu utilization failed", err)
+		return false
+	}
+	if utilization <= m.MaxCPUForCapture {
+		return false
+	}
+	m.infoLog(fmt.Sprintf("cpu profile skipped, the cpu utilization %.0f%% is above %.0f%%",
+		utilization*100, m.MaxCPUForCapture*100))
+	return true
+}
@@ -0,0 +1,56 @@
+package profile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxCPUForCapture(t *testing.T) {
+	utilization := 0.0
+	defer func(f func() (float64, error)) {
+		cpuUtilization = f
+	}(cpuUtilization)
+	cpuUtilization = func() (float64, error) {
+		return utilization, nil
+	}
+	log := new(bytes.Buffer)
+	m := newTestManager(t, &Option{X: 10 * time.Millisecond, MaxCPUForCapture: 0.8, LogOutput: log})
+	defer os.RemoveAll(m.StoreDir)
+
+	for _, u := range []float64{0.95, 0.3, 0.81, 0.8} {
+		utilization = u
+		m.capture(Cpu)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Len(t, m.getFileCollection(), 2)
+	assert.Contains(t, log.String(), "cpu profile skipped, the cpu utilization 95% is above 80%")
+
+	// the other profiles are not gated
+	utilization = 1
+	m.capture(Heap)
+	assert.Len(t, m.getFileCollection(), 3)
+}
+
+func TestReadProcStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stat")
+	assert.NoError(t, ioutil.WriteFile(path,
+		[]byte("cpu  100 10 50 800 40 0 0 0 20 0\ncpu0 100 10 50 800 40 0 0 0 20 0\n"), 0644))
+
+	idle, total, err := readProcStat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(840), idle)
+	assert.Equal(t, uint64(1000), total)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("intr 1 2 3\n"), 0644))
+	_, _, err = readProcStat(path)
+	assert.Error(t, err)
+}
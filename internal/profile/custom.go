@@ -0,0 +1,78 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// CustomProfile is a profile of the application, e.g. a dump of the cache stats, captured on the schedule
+// of the instant profiles once registered with RegisterProfile.
+type CustomProfile interface {
+	// Name is the type of the profile, it names its files like the built-in types.
+	Name() string
+	// WriteProfile writes the profile into w.
+	WriteProfile(w io.Writer) error
+}
+
+var (
+	customProfiles    = make(map[Profile]CustomProfile)
+	customProfileLock sync.RWMutex
+)
+
+// RegisterProfile makes c a profile type, which is then enabled like the built-in ones, e.g.
+// EnableProfile(opt, Heap, Profile(c.Name())). Its name must be new, and usable in a file name.
+func RegisterProfile(c CustomProfile) error {
+	p := Profile(c.Name())
+	if p == "" || strings.ContainsAny(string(p), `/\`) || strings.Contains(string(p), "..") {
+		return &InvalidProfileError{Profile: p}
+	}
+	customProfileLock.Lock()
+	defer customProfileLock.Unlock()
+	if _, ok := profileCollection[p]; ok {
+		return detailError(ErrProfileRegistered, "%q", p)
+	}
+	if _, ok := customProfiles[p]; ok {
+		return detailError(ErrProfileRegistered, "%q", p)
+	}
+	customProfiles[p] = c
+	return nil
+}
+
+// customProfile returns the registered profile of type p.
+func customProfile(p Profile) (CustomProfile, bool) {
+	customProfileLock.RLock()
+	defer customProfileLock.RUnlock()
+	c, ok := customProfiles[p]
+	return c, ok
+}
+
+func (m *profileManager) doCustomProfile(profile Profile, c CustomProfile) {
+	start := startCapture()
+	filePath := m.newFilePath(profile)
+	file, err := m.openFile(filePath)
+	if m.skipCapture(err) {
+		return
+	}
+	if err != nil {
+		m.errorLog("open file failed", err)
+		m.recordCapture(false)
+		return
+	}
+	succeed := false
+	defer func() {
+		m.finishCapture(profile, file, filePath, start, succeed)
+	}()
+	w := m.bufferFile(file)
+	err = c.WriteProfile(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		m.errorLog(fmt.Sprintf("%s profile failed", string(profile)), err)
+		return
+	}
+	succeed = true
+	m.infoLog(fmt.Sprintf("%s profile finished", string(profile)))
+}
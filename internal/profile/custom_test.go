@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheStats struct{}
+
+func (cacheStats) Name() string {
+	return "cachestats"
+}
+
+func (cacheStats) WriteProfile(w io.Writer) error {
+	_, err := io.WriteString(w, "hits=42 misses=7\n")
+	return err
+}
+
+func TestCustomProfile(t *testing.T) {
+	assert.NoError(t, RegisterProfile(cacheStats{}))
+	defer func() {
+		customProfileLock.Lock()
+		delete(customProfiles, "cachestats")
+		customProfileLock.Unlock()
+	}()
+	assert.True(t, IsError(RegisterProfile(cacheStats{}), ErrProfileRegistered))
+	assert.NoError(t, checkProfiles([]Profile{Heap, "cachestats"}))
+	// not renamed after the pprof format it is not in
+	opt := &Option{PprofExtension: true}
+	assert.Equal(t, "cachestats_1.profile", opt.pprofPath("cachestats", "cachestats_1.profile"))
+	assert.Equal(t, "heap_1.pb.gz", opt.pprofPath(Heap, "heap_1.profile"))
+
+	m := newTestManager(t, &Option{Y: 20 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+	startTestLoop(m, "cachestats")
+	time.Sleep(70 * time.Millisecond)
+	stopTestLoop(m)
+	m.waitCaptures(time.Second)
+
+	collection := m.getFileCollection()
+	assert.True(t, len(collection) >= 2, collection)
+	for _, f := range collection {
+		assert.True(t, strings.HasPrefix(filepath.Base(f), "cachestats_"), f)
+		data, err := ioutil.ReadFile(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "hits=42 misses=7\n", string(data))
+	}
+}
+
+type namedProfile string
+
+func (p namedProfile) Name() string {
+	return string(p)
+}
+
+func (namedProfile) WriteProfile(io.Writer) error {
+	return nil
+}
+
+func TestRegisterProfileBuiltinName(t *testing.T) {
+	assert.True(t, IsError(RegisterProfile(namedProfile(Heap)), ErrProfileRegistered))
+	for _, name := range []string{"", "cache/stats", `cache\stats`, "..", "../cachestats"} {
+		assert.True(t, IsError(RegisterProfile(namedProfile(name)), ErrInvalidProfile), name)
+	}
+}
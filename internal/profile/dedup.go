@@ -0,0 +1,33 @@
+package profile
+
+import (
+	"crypto/sha256"
+
+	"github.com/google/pprof/profile"
+)
+
+// isDuplicate tells whether data holds the same profile as the previous capture of that type.
+// The capture timestamps are ignored, they differ every time.
+func (m *profileManager) isDuplicate(p Profile, data []byte) bool {
+	prof, err := profile.ParseData(data)
+	if err != nil {
+		return false
+	}
+	prof.TimeNanos = 0
+	prof.DurationNanos = 0
+	h := sha256.New()
+	if err = prof.WriteUncompressed(h); err != nil {
+		return false
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.lastDigests == nil {
+		m.lastDigests = make(map[Profile][sha256.Size]byte)
+	}
+	last, ok := m.lastDigests[p]
+	m.lastDigests[p] = digest
+	return ok && last == digest
+}
@@ -0,0 +1,37 @@
+package profile
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipDuplicates(t *testing.T) {
+	m := newTestManager(t, &Option{SkipDuplicates: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	// stop recording new allocations so that the heap profile stays the same between captures
+	defer func(rate int) {
+		runtime.MemProfileRate = rate
+	}(runtime.MemProfileRate)
+	runtime.MemProfileRate = 0
+	runtime.GC()
+
+	m.doInstantProfile(Heap)
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	assert.Len(t, m.getFileCollection(), 1)
+}
+
+func TestSkipDuplicatesDisabled(t *testing.T) {
+	m := newTestManager(t, &Option{})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	assert.Len(t, m.getFileCollection(), 2)
+}
@@ -0,0 +1,192 @@
+package profile
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The encrypted archives of EncryptionKey are the archive stream sealed with AES-GCM in chunks: a random
+// nonce, then the chunks, each the 4 bytes big endian length of the sealed chunk, whose high bit marks the
+// last one, and the sealed chunk. The nonce of a chunk is the random one with its index xored into the last
+// 8 bytes, so that the chunks can't be reordered, and the mark of the last one being sealed with it, that the
+// archive can't be truncated.
+
+// encryptedExtension is appended to the extension of the encrypted archives.
+const encryptedExtension = ".enc"
+
+// encryptChunkSize is the size of the chunks the archives are sealed in.
+const encryptChunkSize = 64 << 10
+
+const lastChunk = 1 << 31
+
+// archiveExtension is the extension of the archives, of the CompressionFormat, encrypted with EncryptionKey.
+func (opt *Option) archiveExtension() string {
+	if len(opt.EncryptionKey) > 0 {
+		return opt.CompressionFormat.extension() + encryptedExtension
+	}
+	return opt.CompressionFormat.extension()
+}
+
+// newArchiveCipher returns the AES-GCM cipher of key. Its error doesn't hold the key.
+func newArchiveCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("EncryptionKey not valid, it must be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk index.
+func chunkNonce(nonce []byte, index uint64) []byte {
+	n := append([]byte(nil), nonce...)
+	tail := n[len(n)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^index)
+	return n
+}
+
+// chunkData is the additional data the chunks are sealed with, which authenticates the mark of the last one.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter seals what is written into w in chunks, it must be closed to mark the last one.
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	buf   []byte
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newArchiveCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	if err = writeFull(w, nonce); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, nonce: nonce, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], data)
+		e.buf = e.buf[:len(e.buf)+n]
+		data = data[n:]
+		written += n
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush seals what is buffered into a chunk of its own.
+func (e *encryptWriter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return e.seal(false)
+}
+
+// Close seals the last chunk, it doesn't close w.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.index), e.buf, chunkData(last))
+	length := uint32(len(sealed))
+	if last {
+		length |= lastChunk
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, length)
+	e.index++
+	e.buf = e.buf[:0]
+	if err := writeFull(e.w, header); err != nil {
+		return err
+	}
+	return writeFull(e.w, sealed)
+}
+
+// DecryptArchive returns the reader of the archive r encrypted with key, see EncryptionKey. Reading fails
+// with ErrDecryption if key is not the one of the archive, or the archive was altered or truncated.
+func DecryptArchive(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newArchiveCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(br, nonce); err != nil {
+		return nil, ErrDecryption
+	}
+	return &decryptReader{r: br, aead: aead, nonce: nonce}, nil
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	chunk []byte
+	last  bool
+	err   error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.last {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk.
+func (d *decryptReader) open() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return ErrDecryption
+	}
+	length := binary.BigEndian.Uint32(header)
+	d.last = length&lastChunk != 0
+	length &^= lastChunk
+	if length > encryptChunkSize+uint32(d.aead.Overhead()) {
+		return ErrDecryption
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return ErrDecryption
+	}
+	chunk, err := d.aead.Open(sealed[:0], chunkNonce(d.nonce, d.index), sealed, chunkData(d.last))
+	if err != nil {
+		return ErrDecryption
+	}
+	d.index++
+	d.chunk = chunk
+	return nil
+}
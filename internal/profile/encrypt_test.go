@@ -0,0 +1,77 @@
+package profile
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		log := new(bytes.Buffer)
+		m := newTestManager(t, &Option{Compress: true, CompressionFormat: format, EncryptionKey: key,
+			LogOutput: log, ErrLogOutput: log})
+		collection := writeTestProfiles(t, m.StoreDir, 3)
+
+		archive, err := m.archiveTo(m.archiveDir, collection, "")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(archive, format.extension()+".enc"), archive)
+		data, err := ioutil.ReadFile(archive)
+		assert.NoError(t, err)
+
+		// not readable without the key
+		_, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		assert.Error(t, err)
+		r, err := DecryptArchive(bytes.NewReader(data), []byte("fedcba9876543210fedcba9876543210"))
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrDecryption, err)
+
+		// nor altered or truncated
+		altered := append([]byte(nil), data...)
+		altered[len(altered)/2] ^= 1
+		r, _ = DecryptArchive(bytes.NewReader(altered), key)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrDecryption, err)
+		r, _ = DecryptArchive(bytes.NewReader(data[:len(data)-100]), key)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrDecryption, err)
+
+		// round-trips with it
+		r, err = DecryptArchive(bytes.NewReader(data), key)
+		assert.NoError(t, err)
+		plain, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		plainPath := filepath.Join(m.StoreDir, "plain"+format.extension())
+		assert.NoError(t, ioutil.WriteFile(plainPath, plain, 0644))
+		contents := archiveContents(t, plainPath)
+		if assert.Len(t, contents, len(collection)) {
+			for i, f := range collection {
+				profile, err := ioutil.ReadFile(f)
+				assert.NoError(t, err)
+				assert.Equal(t, filepath.Base(f), contents[i].name)
+				assert.True(t, bytes.Equal(profile, contents[i].data))
+			}
+		}
+		assert.NotContains(t, log.String(), string(key))
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestEncryptionKeyOption(t *testing.T) {
+	opt := Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir(), EncryptionKey: []byte("secret")}
+	assert.EqualError(t, checkOpt(opt, []Profile{Heap}), "EncryptionKey requires Compress")
+	opt.Compress = true
+	err := checkOpt(opt, []Profile{Heap})
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "secret")
+	}
+}
@@ -0,0 +1,113 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrAlreadyEnabled is returned by EnableProfile when profiling is already enabled.
+	ErrAlreadyEnabled = errors.New("cannot call EnableProfile repeatedly")
+	// ErrNotEnabled is returned when profiling is expected to be enabled but is not.
+	ErrNotEnabled = errors.New("profile is not enabled")
+	// ErrInvalidInterval is returned when X and Y are not consistent, the returned error wraps it with details.
+	ErrInvalidInterval = errors.New("invalid profile interval")
+	// ErrNoProfiles is returned when no profile type is given.
+	ErrNoProfiles = errors.New("no profile set")
+	// ErrInvalidProfile matches the InvalidProfileError returned for unknown profile types.
+	ErrInvalidProfile = errors.New("profile not valid")
+	// ErrCPUProfilingActive is returned when CPU profiling has already been started elsewhere.
+	ErrCPUProfilingActive = errors.New("cpu profiling already active")
+	// ErrTraceActive is returned when a runtime trace is already running.
+	ErrTraceActive = errors.New("trace already active")
+	// ErrCompressDisabled is returned by ForceArchive when Compress is not set.
+	ErrCompressDisabled = errors.New("compress is not enabled")
+	// ErrNothingToArchive is returned by ForceArchive when there is no pending profile.
+	ErrNothingToArchive = errors.New("nothing to archive")
+	// ErrInertProfile is returned with FailOnInertProfiles for a profile which would be empty, the returned
+	// error wraps it with details.
+	ErrInertProfile = errors.New("profile would be empty")
+	// ErrProfileRegistered is returned by RegisterProfile for the name of a known profile type.
+	ErrProfileRegistered = errors.New("profile already registered")
+	// ErrArchiveNotFound is returned by OpenArchive for a name which is not the one of an archive, the returned
+	// error wraps it with the name.
+	ErrArchiveNotFound = errors.New("archive not found")
+	// ErrNotDirectory is returned when StoreDir, the archive directory or a component of their path is not a
+	// directory, the returned error wraps it with the path.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrDecryption is returned reading the archive of DecryptArchive with a wrong key, or an altered archive.
+	ErrDecryption = errors.New("archive decryption failed")
+)
+
+// IsError reports whether err is target or wraps it, as errors.Is does from go1.13 on.
+func IsError(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		if e, ok := err.(interface{ Is(error) bool }); ok && e.Is(target) {
+			return true
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
+
+// wrappedError is an error with the message msg wrapping err, which errors.Is and IsError match.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the wrapped error.
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// detailError returns err with details in its message, e.g. "archive not found: \"name\"".
+func detailError(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: err.Error() + ": " + fmt.Sprintf(format, args...), err: err}
+}
+
+// InvalidProfileError is returned for an unknown profile type, errors.Is and IsError match it with
+// ErrInvalidProfile.
+type InvalidProfileError struct {
+	Profile Profile
+}
+
+func (e *InvalidProfileError) Error() string {
+	return fmt.Sprintf("profile %q not valid", e.Profile)
+}
+
+// Is reports whether target is ErrInvalidProfile.
+func (e *InvalidProfileError) Is(target error) bool {
+	return target == ErrInvalidProfile
+}
+
+func invalidInterval(msg string) error {
+	return detailError(ErrInvalidInterval, "%s", msg)
+}
+
+// checkProfiles makes sure profiles is not empty and only holds known profile types.
+func checkProfiles(profiles []Profile) error {
+	if len(profiles) == 0 {
+		return ErrNoProfiles
+	}
+	for _, p := range profiles {
+		if _, ok := profileCollection[p]; ok {
+			continue
+		}
+		if _, ok := customProfile(p); !ok {
+			return &InvalidProfileError{Profile: p}
+		}
+	}
+	return nil
+}
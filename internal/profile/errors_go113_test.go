@@ -0,0 +1,33 @@
+//go:build go1.13
+// +build go1.13
+
+package profile
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableProfileAlreadyEnabled(t *testing.T) {
+	enableTestProfile(t, &Option{}, Heap)
+	defer os.RemoveAll(manager.StoreDir)
+	defer StopProfile()
+
+	err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: manager.StoreDir}, Heap)
+	assert.True(t, errors.Is(err, ErrAlreadyEnabled))
+}
+
+func TestErrorsIs(t *testing.T) {
+	err := EnableProfile(&Option{Y: time.Second, X: 2 * time.Second, StoreDir: os.TempDir()}, Heap)
+	assert.True(t, errors.Is(err, ErrInvalidInterval))
+
+	err = EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir()}, Heap, "unknown")
+	assert.True(t, errors.Is(err, ErrInvalidProfile))
+	var invalid *InvalidProfileError
+	assert.True(t, errors.As(err, &invalid))
+	assert.Equal(t, Profile("unknown"), invalid.Profile)
+}
@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableProfileErrors(t *testing.T) {
+	dir := os.TempDir()
+	err := EnableProfile(&Option{Y: time.Second, X: 2 * time.Second, StoreDir: dir}, Heap)
+	assert.True(t, IsError(err, ErrInvalidInterval))
+	err = EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir})
+	assert.True(t, IsError(err, ErrNoProfiles))
+
+	err = EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir}, Heap, "unknown")
+	assert.True(t, IsError(err, ErrInvalidProfile))
+	invalid, ok := err.(*InvalidProfileError)
+	assert.True(t, ok)
+	assert.Equal(t, Profile("unknown"), invalid.Profile)
+
+	assert.True(t, IsError(StopProfile(), ErrNotEnabled))
+	assert.Nil(t, manager)
+}
+
+func TestIsError(t *testing.T) {
+	err := detailError(ErrArchiveNotFound, "%q", "2020-01-02.zip")
+	assert.EqualError(t, err, `archive not found: "2020-01-02.zip"`)
+	assert.True(t, IsError(err, ErrArchiveNotFound))
+	assert.True(t, IsError(&wrappedError{msg: "wrapped twice", err: err}, ErrArchiveNotFound))
+	assert.False(t, IsError(err, ErrNotEnabled))
+	assert.False(t, IsError(errors.New("archive not found"), ErrArchiveNotFound))
+	assert.False(t, IsError(nil, ErrArchiveNotFound))
+	assert.True(t, IsError(&InvalidProfileError{Profile: "unknown"}, ErrInvalidProfile))
+}
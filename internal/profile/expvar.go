@@ -0,0 +1,47 @@
+package profile
+
+import (
+	"expvar"
+	"sync"
+)
+
+// the counters published under "gin_profile" by the profilers with PublishExpvar set
+var (
+	expvarOnce     sync.Once
+	expvarProfiles *expvar.Map // by profile type
+	expvarArchives *expvar.Int
+	expvarErrors   *expvar.Int
+)
+
+func publishExpvar() {
+	expvarOnce.Do(func() {
+		expvarProfiles = new(expvar.Map).Init()
+		expvarArchives = new(expvar.Int)
+		expvarErrors = new(expvar.Int)
+		vars := expvar.NewMap("gin_profile")
+		vars.Set("profiles_total", expvarProfiles)
+		vars.Set("archives_total", expvarArchives)
+		vars.Set("errors_total", expvarErrors)
+	})
+}
+
+func (m *profileManager) incProfilesExpvar(profile Profile) {
+	if m.PublishExpvar {
+		publishExpvar()
+		expvarProfiles.Add(string(profile), 1)
+	}
+}
+
+func (m *profileManager) incArchivesExpvar() {
+	if m.PublishExpvar {
+		publishExpvar()
+		expvarArchives.Add(1)
+	}
+}
+
+func (m *profileManager) incErrorsExpvar() {
+	if m.PublishExpvar {
+		publishExpvar()
+		expvarErrors.Add(1)
+	}
+}
@@ -0,0 +1,42 @@
+package profile
+
+import (
+	"expvar"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func expvarValue(t *testing.T, name string, key ...string) int64 {
+	vars, ok := expvar.Get("gin_profile").(*expvar.Map)
+	assert.True(t, ok)
+	v := vars.Get(name)
+	if len(key) > 0 {
+		v = v.(*expvar.Map).Get(key[0])
+	}
+	if v == nil {
+		return 0
+	}
+	return v.(*expvar.Int).Value()
+}
+
+func TestPublishExpvar(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, PublishExpvar: true, ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 1}})
+	defer os.RemoveAll(m.StoreDir)
+	publishExpvar()
+	heaps := expvarValue(t, "profiles_total", string(Heap))
+	archives := expvarValue(t, "archives_total")
+	errors := expvarValue(t, "errors_total")
+
+	m.doInstantProfile(Heap)
+	assert.Equal(t, heaps+1, expvarValue(t, "profiles_total", string(Heap)))
+	m.checkArchive()
+	assert.Equal(t, archives+1, expvarValue(t, "archives_total"))
+	assert.Equal(t, errors, expvarValue(t, "errors_total"))
+
+	assert.NoError(t, os.RemoveAll(m.StoreDir))
+	m.doInstantProfile(Heap)
+	assert.Equal(t, heaps+1, expvarValue(t, "profiles_total", string(Heap)))
+	assert.Equal(t, errors+1, expvarValue(t, "errors_total"))
+}
@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errNoFIFOReader is returned opening the FIFO StoreDir while no one reads it, the capture is skipped.
+var errNoFIFOReader = errors.New("no reader of the fifo")
+
+// isFIFO tells whether path is a named pipe. When StoreDir is one, e.g. read by a sidecar shipping the
+// profiles, every profile is written into it in turn and nothing is archived nor removed.
+func isFIFO(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// newFilePath returns the path the next profile of type profile is written to.
+func (m *profileManager) newFilePath(profile Profile) string {
+	if m.fifo {
+		return m.StoreDir
+	}
+	storeDir, _ := m.dirs()
+	return m.pprofPath(profile, getFilePath(profile, storeDir, m.FileFormat, m.timestamp()))
+}
+
+// openFIFO opens StoreDir for writing, errNoFIFOReader if there is no reader rather than waiting for one,
+// so that the captures don't pile up behind it. The FIFO is held until closeFIFO so that concurrent captures
+// don't interleave.
+func (m *profileManager) openFIFO() (*os.File, error) {
+	m.fifoLock.Lock()
+	file, err := openFIFOWriter(m.StoreDir)
+	if err != nil {
+		m.fifoLock.Unlock()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (m *profileManager) closeFIFO(file *os.File) bool {
+	defer m.fifoLock.Unlock()
+	if err := file.Close(); err != nil {
+		m.errorLog(fmt.Sprintf("close fifo %q failed", m.StoreDir), err)
+		return false
+	}
+	return true
+}
+
+// skipCapture tells whether the capture whose file failed to open with err is skipped rather than failed,
+// as it is while the FIFO StoreDir has no reader.
+func (m *profileManager) skipCapture(err error) bool {
+	if err != errNoFIFOReader {
+		return false
+	}
+	m.infoLog(fmt.Sprintf("no reader of the fifo %q, capture skipped", m.StoreDir))
+	return true
+}
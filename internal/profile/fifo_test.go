@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package profile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFIFOStoreDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "profiles.fifo")
+	assert.NoError(t, syscall.Mkfifo(fifo, 0644))
+
+	assert.Error(t, EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: fifo, Compress: true}, Heap))
+
+	// opened read-write so that the profiler doesn't block on opening nor the reader on EOF
+	reader, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer reader.Close()
+	enableTestProfile(t, &Option{Y: 1100 * time.Millisecond, X: 100 * time.Millisecond, StoreDir: fifo}, Heap)
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, 2)
+		n, _ := reader.Read(buf)
+		received <- buf[:n]
+	}()
+	select {
+	case data := <-received:
+		// gzipped protobuf
+		assert.Equal(t, []byte{0x1f, 0x8b}, data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no profile written into the fifo")
+	}
+	assert.NoError(t, StopProfile())
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "profiles.fifo", entries[0].Name())
+}
+
+func TestFIFOStoreDirWithoutReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "profiles.fifo")
+	assert.NoError(t, syscall.Mkfifo(fifo, 0644))
+
+	// the captures are skipped while no one reads, rather than waiting for a reader
+	m := newTestManager(t, &Option{StoreDir: fifo, X: 100 * time.Millisecond})
+	m.fifo = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.doInstantProfile(Heap)
+		m.doDurationProfile(Cpu)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("capture blocked on the fifo without a reader")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&m.failures))
+
+	// a reader which comes later gets the next profile, written blocking
+	reader, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer reader.Close()
+	go m.doInstantProfile(Heap)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(reader, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1f, 0x8b}, buf)
+}
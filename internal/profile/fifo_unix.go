@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package profile
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFIFOWriter opens the FIFO at path for writing without waiting for a reader, errNoFIFOReader if there
+// is none. The file is then blocking, a write waits for the reader to catch up.
+func openFIFOWriter(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+			return nil, errNoFIFOReader
+		}
+		return nil, err
+	}
+	if err = syscall.SetNonblock(int(file.Fd()), false); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
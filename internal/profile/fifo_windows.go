@@ -0,0 +1,8 @@
+package profile
+
+import "os"
+
+// openFIFOWriter opens path for writing, there are no FIFOs to wait for a reader of on windows.
+func openFIFOWriter(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
@@ -0,0 +1,53 @@
+package profile
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// gcPollInterval is how often the garbage collections are looked for, see ProfileAfterGC. Tests shorten it.
+var gcPollInterval = 100 * time.Millisecond
+
+// defaultProfileAfterGCInterval is the ProfileAfterGCInterval when not set.
+const defaultProfileAfterGCInterval = 10 * time.Second
+
+// watchGC captures a heap profile after the garbage collections until stopped, at most one per
+// ProfileAfterGCInterval, see ProfileAfterGC. The collections are found from the NumGC deltas of the memory
+// statistics, there is no notification of them without a finalizer.
+func (m *profileManager) watchGC() {
+	ticker := time.NewTicker(gcPollInterval)
+	defer ticker.Stop()
+	interval := m.ProfileAfterGCInterval
+	if interval <= 0 {
+		interval = defaultProfileAfterGCInterval
+	}
+	numGC := readNumGC()
+	var last time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+		n := readNumGC()
+		if n == numGC {
+			continue
+		}
+		numGC = n
+		if atomic.LoadInt32(&m.paused) == 1 || !m.isLeader() || time.Since(last) < interval {
+			continue
+		}
+		last = time.Now()
+		m.syncCapture(Heap)
+		// the collection of HeapForceGC is not one to capture after
+		numGC = readNumGC()
+	}
+}
+
+// readNumGC returns the number of the completed garbage collections.
+func readNumGC() uint32 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.NumGC
+}
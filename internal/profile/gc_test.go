@@ -0,0 +1,56 @@
+package profile
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileAfterGC(t *testing.T) {
+	defer func(d time.Duration) {
+		gcPollInterval = d
+	}(gcPollInterval)
+	gcPollInterval = 5 * time.Millisecond
+
+	heapProfiles := func(m *profileManager) int {
+		n := 0
+		for _, path := range m.getFileCollection() {
+			if strings.Contains(path, string(Heap)) {
+				n++
+			}
+		}
+		return n
+	}
+	watch := func(m *profileManager, gcs int, every time.Duration) {
+		m.stop = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.watchGC()
+		}()
+		time.Sleep(4 * gcPollInterval)
+		for i := 0; i < gcs; i++ {
+			runtime.GC()
+			time.Sleep(every)
+		}
+		close(m.stop)
+		<-done
+	}
+
+	m := newTestManager(t, &Option{ProfileAfterGC: true, ProfileAfterGCInterval: time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+	watch(m, 0, 0)
+	assert.Equal(t, 0, heapProfiles(m))
+	watch(m, 3, 10*gcPollInterval)
+	assert.Equal(t, 3, heapProfiles(m))
+
+	// rate-limited
+	m = newTestManager(t, &Option{ProfileAfterGC: true, ProfileAfterGCInterval: time.Hour})
+	defer os.RemoveAll(m.StoreDir)
+	watch(m, 3, 10*gcPollInterval)
+	assert.Equal(t, 1, heapProfiles(m))
+}
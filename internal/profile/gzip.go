@@ -0,0 +1,147 @@
+package profile
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// gzipBlockSize is the size of the blocks parallelGzipWriter compresses concurrently.
+const gzipBlockSize = 1 << 20
+
+// gzipWriters are the gzip.Writers of the blocks, which are costly to allocate.
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+// parallelGzipWriter compresses into w with up to workers goroutines. Every block is a gzip member of its
+// own, the members are written in order and make up one gzip stream, as gzip.Reader or tar xzf read it.
+// The output only depends on the data and the Flush calls, not on the number of workers.
+type parallelGzipWriter struct {
+	w       io.Writer
+	block   []byte
+	results chan chan gzipResult // of the blocks being compressed, in order
+	tokens  chan struct{}
+	written chan struct{} // closed once the results are written out
+	lock    sync.Mutex
+	err     error // the first error, guarded by lock
+	members int
+}
+
+// gzipResult is a compressed block, or a flush barrier if flushed is set.
+type gzipResult struct {
+	data    []byte
+	err     error
+	flushed chan struct{}
+}
+
+func newParallelGzipWriter(w io.Writer, workers int) *parallelGzipWriter {
+	g := &parallelGzipWriter{
+		w:       w,
+		results: make(chan chan gzipResult, workers),
+		tokens:  make(chan struct{}, workers),
+		written: make(chan struct{}),
+	}
+	go g.writeOut()
+	return g
+}
+
+// writeOut writes the compressed blocks into w in order.
+func (g *parallelGzipWriter) writeOut() {
+	defer close(g.written)
+	for result := range g.results {
+		r := <-result
+		if r.flushed != nil {
+			close(r.flushed)
+			continue
+		}
+		if r.err == nil && g.error() == nil {
+			r.err = writeFull(g.w, r.data)
+		}
+		if r.err != nil {
+			g.setError(r.err)
+		}
+	}
+}
+
+func (g *parallelGzipWriter) Write(data []byte) (int, error) {
+	if err := g.error(); err != nil {
+		return 0, err
+	}
+	n := len(data)
+	for len(data) > 0 {
+		free := gzipBlockSize - len(g.block)
+		if free > len(data) {
+			free = len(data)
+		}
+		g.block = append(g.block, data[:free]...)
+		data = data[free:]
+		if len(g.block) == gzipBlockSize {
+			g.compressBlock()
+		}
+	}
+	return n, nil
+}
+
+// compressBlock compresses the pending block as a member, in the background.
+func (g *parallelGzipWriter) compressBlock() {
+	block := g.block
+	g.block = nil
+	g.members++
+	result := make(chan gzipResult, 1)
+	g.tokens <- struct{}{}
+	g.results <- result
+	go func() {
+		defer func() {
+			<-g.tokens
+		}()
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(&buf)
+		_, err := zw.Write(block)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		gzipWriters.Put(zw)
+		result <- gzipResult{data: buf.Bytes(), err: err}
+	}()
+}
+
+// Flush writes out what has been written so far, as complete members.
+func (g *parallelGzipWriter) Flush() error {
+	if len(g.block) > 0 {
+		g.compressBlock()
+	}
+	result := make(chan gzipResult, 1)
+	flushed := make(chan struct{})
+	result <- gzipResult{flushed: flushed}
+	g.results <- result
+	<-flushed
+	return g.error()
+}
+
+// Close writes out the last block, an empty member if nothing has been written.
+func (g *parallelGzipWriter) Close() error {
+	if len(g.block) > 0 || g.members == 0 {
+		g.compressBlock()
+	}
+	close(g.results)
+	<-g.written
+	return g.error()
+}
+
+func (g *parallelGzipWriter) error() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.err
+}
+
+func (g *parallelGzipWriter) setError(err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err == nil {
+		g.err = err
+	}
+}
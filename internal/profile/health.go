@@ -0,0 +1,45 @@
+package profile
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// unhealthyFailureNum is the number of consecutive failed captures after which the profiler is unhealthy.
+const unhealthyFailureNum = 5
+
+// Healthy reports whether the periodical profiling is working. It returns false if the profiling
+// goroutine has not ticked for 3*Y, or if the last unhealthyFailureNum captures all failed.
+func Healthy() (bool, error) {
+	m := currentManager()
+	if m == nil {
+		return false, ErrNotEnabled
+	}
+	return m.healthy()
+}
+
+func (m *profileManager) healthy() (bool, error) {
+	last := time.Unix(0, atomic.LoadInt64(&m.heartbeat))
+	y, _ := m.interval()
+	if since := time.Since(last); since > 3*y {
+		return false, fmt.Errorf("profiling goroutine has not ticked for %v", since)
+	}
+	if failures := atomic.LoadInt32(&m.failures); failures >= unhealthyFailureNum {
+		return false, fmt.Errorf("last %d captures failed", failures)
+	}
+	return true, nil
+}
+
+func (m *profileManager) beat() {
+	atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+}
+
+func (m *profileManager) recordCapture(succeed bool) {
+	m.counters.capture(succeed)
+	if succeed {
+		atomic.StoreInt32(&m.failures, 0)
+	} else {
+		atomic.AddInt32(&m.failures, 1)
+	}
+}
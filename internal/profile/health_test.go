@@ -0,0 +1,50 @@
+package profile
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthyStalledLoop(t *testing.T) {
+	_, err := Healthy()
+	assert.Error(t, err)
+
+	enableTestProfile(t, &Option{Compress: true}, Heap)
+	defer os.RemoveAll(manager.StoreDir)
+	defer StopProfile()
+
+	healthy, err := Healthy()
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+
+	// pretend the loop has been stuck for a while
+	atomic.StoreInt64(&manager.heartbeat, time.Now().Add(-3*manager.Y-time.Second).UnixNano())
+	healthy, err = Healthy()
+	assert.False(t, healthy)
+	assert.Error(t, err)
+}
+
+func TestHealthyFailedCaptures(t *testing.T) {
+	enableTestProfile(t, &Option{Compress: true}, Heap)
+	dir := manager.StoreDir
+	defer StopProfile()
+
+	assert.NoError(t, os.RemoveAll(dir))
+	for i := 0; i < unhealthyFailureNum; i++ {
+		manager.doInstantProfile(Heap)
+	}
+	healthy, err := Healthy()
+	assert.False(t, healthy)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	manager.doInstantProfile(Heap)
+	healthy, err = Healthy()
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,138 @@
+package profile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// rollingArchive is the archive the profiles are appended to as they are closed, see IncrementalArchive.
+type rollingArchive struct {
+	dir    string
+	path   string
+	file   *os.File
+	writer archiveWriter
+	files  []string
+}
+
+// archiveDirOf returns the archive directory of the profile at filePath.
+func (m *profileManager) archiveDirOf(filePath string) string {
+	storeDir, archiveDir := m.dirs()
+	if isPartitioned(storeDir) {
+		return filepath.Join(filepath.Dir(filePath), "archive")
+	}
+	return archiveDir
+}
+
+// appendRolling appends the profile at filePath to the rolling archive and adds it to the collection.
+// If it can't be appended, it is archived with the leftovers on the next rotation.
+func (m *profileManager) appendRolling(filePath string) {
+	m.rollingLock.Lock()
+	defer m.rollingLock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		m.fileCollection = append(m.fileCollection, filePath)
+		m.lock.Unlock()
+	}()
+	dir := m.archiveDirOf(filePath)
+	if m.rolling != nil && m.rolling.dir != dir {
+		// a new partition starts, so does its archive
+		m.closeRollingLocked()
+	}
+	if m.rolling == nil {
+		rolling, err := m.openRolling(dir)
+		if err != nil {
+			m.errorLog("create rolling archive failed", err)
+			return
+		}
+		m.rolling = rolling
+	}
+	info, err := os.Stat(filePath)
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(filePath); err == nil {
+			err = m.rolling.writer.WriteFile(m.archiveEntryName(filePath), m.archiveEntryInfo(info), data)
+		}
+		if err == nil {
+			err = m.rolling.writer.Flush()
+		}
+	}
+	if err != nil {
+		m.errorLog(fmt.Sprintf("append %q to the rolling archive failed", filePath), err)
+		m.incArchiveFileFailures()
+		return
+	}
+	m.rolling.files = append(m.rolling.files, filePath)
+}
+
+func (m *profileManager) openRolling(dir string) (*rollingArchive, error) {
+	if err := createDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, m.timestamp().Format(defaultTimeFormat)+m.archiveExtension())
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	workers := m.ArchiveWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	writer, err := newArchiveWriter(m.CompressionFormat, file, workers, m.EncryptionKey)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rollingArchive{dir: dir, path: path, file: file, writer: writer}, nil
+}
+
+// closeRollingLocked completes the rolling archive and removes its files. m.rollingLock must be held.
+func (m *profileManager) closeRollingLocked() (string, error) {
+	rolling := m.rolling
+	if rolling == nil {
+		return "", nil
+	}
+	m.rolling = nil
+	err := rolling.writer.Close()
+	if closeErr := rolling.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// the profiles are left in the collection, they are archived with the leftovers
+		m.errorLog(fmt.Sprintf("close rolling archive %q failed", rolling.path), err)
+		return "", err
+	}
+	m.markArchived(rolling.files)
+	m.incArchivesExpvar()
+	m.counters.archive(rolling.path)
+	m.archived(rolling.files)
+	// the profiles are already removed, the rolling archive stays in the archive directory if its sink fails
+	_ = m.putArchive(m.ArchiveSink, rolling.path)
+	return rolling.path, nil
+}
+
+// rotateRolling completes the rolling archive, the next profile starts a new one. The profiles of the
+// collection which didn't make it into the rolling archive are archived at once, by the archiver if running,
+// whose result is then received from pending. m.archiveLock must be held unless stopped.
+func (m *profileManager) rotateRolling() (archives []string, pending <-chan archiveResult, err error) {
+	m.rollingLock.Lock()
+	defer m.rollingLock.Unlock()
+	archive, err := m.closeRollingLocked()
+	if archive != "" {
+		archives = append(archives, archive)
+	}
+	if leftovers := m.getFileCollection(); len(leftovers) > 0 {
+		m.infoLog(fmt.Sprintf("start to archive files:%v", leftovers))
+		if m.archiveQueue != nil {
+			return archives, m.archiveOnArchiver(leftovers), err
+		}
+		created, done, e := m.archiveWithRetries(leftovers)
+		m.archived(done)
+		archives = append(archives, created...)
+		if e != nil {
+			return archives, nil, e
+		}
+	}
+	return archives, nil, err
+}
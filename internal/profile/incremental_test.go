@@ -0,0 +1,66 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementalArchive(t *testing.T) {
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		testIncrementalArchive(t, format)
+	}
+}
+
+func testIncrementalArchive(t *testing.T, format CompressionFormat) {
+	m := newTestManager(t, &Option{
+		Compress:           true,
+		CompressionFormat:  format,
+		IncrementalArchive: true,
+		ArchivePolicy:      &FileNumArchivePolicy{MaxFileNum: 2},
+	})
+	defer os.RemoveAll(m.StoreDir)
+
+	rollingSize := func() int64 {
+		info, err := os.Stat(m.rolling.path)
+		assert.NoError(t, err)
+		return info.Size()
+	}
+	m.doInstantProfile(Heap)
+	assert.NotNil(t, m.rolling)
+	assert.Equal(t, m.getFileCollection(), m.rolling.files)
+	size := rollingSize()
+	assert.True(t, size > 0)
+	m.checkArchive()
+	assert.NotNil(t, m.rolling)
+
+	m.doInstantProfile(Goroutine)
+	assert.Len(t, m.rolling.files, 2)
+	assert.True(t, rollingSize() > size)
+	collection := m.getFileCollection()
+	archive := m.rolling.path
+	m.checkArchive()
+	assert.Nil(t, m.rolling)
+	assert.Empty(t, m.getFileCollection())
+	contents := archiveContents(t, archive)
+	assert.Len(t, contents, 2)
+	for i, f := range collection {
+		assert.Equal(t, filepath.Base(f), contents[i].name)
+		_, err := os.Stat(f)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// the next profile starts a new archive
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	assert.NotNil(t, m.rolling)
+	assert.NotEqual(t, archive, m.rolling.path)
+}
+
+func TestIncrementalArchiveRequiresCompress(t *testing.T) {
+	err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir(), IncrementalArchive: true}, Heap)
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package profile
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin/internal/json"
+)
+
+// indexFileName is the name of the capture index written into StoreDir when Option.WriteIndex is set.
+const indexFileName = "index.jsonl"
+
+// IndexRecord is a line of the capture index.
+type IndexRecord struct {
+	Type      Profile   `json:"type"`
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	Archived  bool      `json:"archived"`
+}
+
+func indexPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), indexFileName)
+}
+
+// appendIndex appends the record of a capture to the index next to it.
+func (m *profileManager) appendIndex(profile Profile, filePath string) {
+	if !m.WriteIndex {
+		return
+	}
+	record := IndexRecord{Type: profile, Path: filePath, Timestamp: m.timestamp()}
+	if info, err := os.Stat(filePath); err == nil {
+		record.Size = info.Size()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		m.errorLog("marshal index record failed", err)
+		return
+	}
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	file, err := os.OpenFile(indexPath(filePath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		m.errorLog("open index failed", err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		m.errorLog("write index failed", err)
+	}
+}
+
+// markArchived flags the records of the archived files, rewriting the index.
+func (m *profileManager) markArchived(archived []string) {
+	if !m.WriteIndex || len(archived) == 0 {
+		return
+	}
+	paths := make(map[string]bool, len(archived))
+	for _, f := range archived {
+		paths[f] = true
+	}
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	index := indexPath(archived[0])
+	data, err := ioutil.ReadFile(index)
+	if err != nil {
+		m.errorLog("read index failed", err)
+		return
+	}
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var record IndexRecord
+		if err = json.Unmarshal(line, &record); err == nil && paths[record.Path] {
+			record.Archived = true
+			if line, err = json.Marshal(record); err != nil {
+				m.errorLog("marshal index record failed", err)
+				return
+			}
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := index + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		m.errorLog("write index failed", err)
+		return
+	}
+	if err = os.Rename(tmp, index); err != nil {
+		m.errorLog("write index failed", err)
+	}
+}
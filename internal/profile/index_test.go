@@ -0,0 +1,52 @@
+package profile
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin/internal/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func readIndex(t *testing.T, dir string) []IndexRecord {
+	file, err := os.Open(filepath.Join(dir, indexFileName))
+	assert.NoError(t, err)
+	defer file.Close()
+	var records []IndexRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record IndexRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestWriteIndex(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, WriteIndex: true, KeepAfterArchive: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	collection := m.getFileCollection()
+	records := readIndex(t, m.StoreDir)
+	assert.Len(t, records, 2)
+	for i, p := range []Profile{Heap, Goroutine} {
+		info, err := os.Stat(collection[i])
+		assert.NoError(t, err)
+		assert.Equal(t, p, records[i].Type)
+		assert.Equal(t, collection[i], records[i].Path)
+		assert.Equal(t, info.Size(), records[i].Size)
+		assert.False(t, records[i].Timestamp.IsZero())
+		assert.False(t, records[i].Archived)
+	}
+
+	_, _, err := m.doArchive0(collection[:1])
+	assert.NoError(t, err)
+	records = readIndex(t, m.StoreDir)
+	assert.Len(t, records, 2)
+	assert.True(t, records[0].Archived)
+	assert.False(t, records[1].Archived)
+}
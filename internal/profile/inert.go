@@ -0,0 +1,35 @@
+package profile
+
+import (
+	"runtime"
+	"runtime/pprof"
+)
+
+// inertReason tells why profile p would be empty with the current runtime settings, "" if it would not.
+// hint is set when it is only a guess.
+func inertReason(p Profile) (reason string, hint bool) {
+	switch p {
+	case Mutex:
+		if runtime.SetMutexProfileFraction(-1) == 0 {
+			return "runtime.SetMutexProfileFraction is not set", false
+		}
+	case Block:
+		// the rate cannot be read back, an empty profile is the hint, also that of a set rate and no
+		// blocking yet
+		if pprof.Lookup(string(Block)).Count() == 0 {
+			return "no blocking event recorded, runtime.SetBlockProfileRate is likely not set", true
+		}
+	}
+	return "", false
+}
+
+// checkInertProfiles returns an error wrapping ErrInertProfile for the first of profiles which would be empty,
+// or likely would be too if hints is set.
+func checkInertProfiles(profiles []Profile, hints bool) error {
+	for _, p := range profiles {
+		if reason, hint := inertReason(p); reason != "" && (hints || !hint) {
+			return detailError(ErrInertProfile, "%s: %s", p, reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package profile
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInertProfiles(t *testing.T) {
+	defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(0))
+
+	logs := new(bytes.Buffer)
+	opt := &Option{Y: 2 * time.Second, X: time.Second, LogOutput: logs}
+	enableTestProfile(t, opt, Heap, Mutex)
+	defer os.RemoveAll(opt.StoreDir)
+	assert.NoError(t, StopProfile())
+	assert.True(t, strings.HasPrefix(logs.String(), "[GIN][WARNING]"), logs.String())
+	assert.Contains(t, logs.String(), "mutex: runtime.SetMutexProfileFraction is not set")
+
+	err := checkOpt(Option{Y: 2 * time.Second, X: time.Second, StoreDir: opt.StoreDir, FailOnInertProfiles: true},
+		[]Profile{Heap, Mutex})
+	assert.True(t, IsError(err, ErrInertProfile), err)
+
+	runtime.SetMutexProfileFraction(5)
+	assert.NoError(t, checkInertProfiles([]Profile{Heap, Mutex}, true))
+}
+
+func TestInertBlockProfileWarnsOnly(t *testing.T) {
+	if pprof.Lookup(string(Block)).Count() > 0 {
+		t.Skip("blocking events already recorded")
+	}
+	err := checkOpt(Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir(), FailOnInertProfiles: true},
+		[]Profile{Block})
+	assert.NoError(t, err)
+	err = checkInertProfiles([]Profile{Block}, true)
+	assert.True(t, IsError(err, ErrInertProfile), err)
+}
@@ -0,0 +1,47 @@
+package profile
+
+import "sync"
+
+// recentLogNum is the number of log lines kept for RecentLogs.
+const recentLogNum = 100
+
+// RecentLogs returns the latest log lines, info and error, of the profiler started by EnableProfile,
+// the oldest first. It returns nil if profiling is not enabled.
+func RecentLogs() []string {
+	m := currentManager()
+	if m == nil {
+		return nil
+	}
+	return m.recentLogs.lines()
+}
+
+// RecentLogs is RecentLogs for p.
+func (p *Profiler) RecentLogs() []string {
+	return p.m.recentLogs.lines()
+}
+
+// logRing keeps the latest recentLogNum log lines.
+type logRing struct {
+	lock sync.Mutex
+	ring []string
+	next int
+}
+
+func (r *logRing) add(line string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.ring) < recentLogNum {
+		r.ring = append(r.ring, line)
+		return
+	}
+	r.ring[r.next] = line
+	r.next = (r.next + 1) % recentLogNum
+}
+
+func (r *logRing) lines() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lines := make([]string, 0, len(r.ring))
+	lines = append(lines, r.ring[r.next:]...)
+	return append(lines, r.ring[:r.next]...)
+}
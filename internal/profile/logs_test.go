@@ -0,0 +1,62 @@
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentLogs(t *testing.T) {
+	assert.Nil(t, RecentLogs())
+
+	logs := new(bytes.Buffer)
+	m := newTestManager(t, &Option{LogOutput: logs, ErrLogOutput: logs})
+	manager = m
+	defer func() { manager = nil }()
+	m.infoLog("first")
+	m.errorLog("second", errors.New("failed"))
+	lines := RecentLogs()
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "[GIN][INFO]"))
+	assert.True(t, strings.HasSuffix(lines[0], "|first"))
+	assert.True(t, strings.HasPrefix(lines[1], "[GIN][ERROR]"))
+	assert.True(t, strings.HasSuffix(lines[1], "|second|error:failed"))
+	assert.Equal(t, logs.String(), strings.Join(lines, "\n")+"\n")
+
+	for i := 0; i < recentLogNum+10; i++ {
+		m.infoLog(fmt.Sprint(i))
+	}
+	lines = RecentLogs()
+	assert.Len(t, lines, recentLogNum)
+	assert.True(t, strings.HasSuffix(lines[0], "|10"))
+	assert.True(t, strings.HasSuffix(lines[recentLogNum-1], fmt.Sprintf("|%d", recentLogNum+9)))
+	assert.Equal(t, recentLogNum+12, strings.Count(logs.String(), "\n"))
+}
+
+func TestDutyCycleWarning(t *testing.T) {
+	for _, c := range []struct {
+		y, x     time.Duration
+		ratio    float64
+		profiles []Profile
+		warned   bool
+	}{
+		{10 * time.Second, 9 * time.Second, 0, []Profile{Cpu}, true},
+		{10 * time.Second, 5 * time.Second, 0, []Profile{Heap, Trace}, false},
+		{10 * time.Second, 9 * time.Second, 0, []Profile{Heap}, false},
+		{10 * time.Second, 9 * time.Second, 1, []Profile{Cpu}, false},
+		{10 * time.Second, 3 * time.Second, 0.2, []Profile{Cpu}, true},
+	} {
+		logs := new(bytes.Buffer)
+		m := newTestManager(t, &Option{Y: c.y, X: c.x, DutyCycleWarnRatio: c.ratio, LogOutput: logs})
+		m.profiles = c.profiles
+		m.checkDutyCycle(m.Y, m.X)
+		assert.Equal(t, c.warned, strings.HasPrefix(logs.String(), "[GIN][WARNING]"), logs.String())
+		os.RemoveAll(m.StoreDir)
+	}
+}
@@ -0,0 +1,48 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync/atomic"
+)
+
+// LogTriggerWriter returns a writer into inner which captures profile p, out of the schedule of the profiler
+// enabled by EnableProfile, when a log line written matches the regular expression pattern. It is meant as
+// the output of the application logger, which writes the lines whole, as the log package does. The capture
+// runs as those of the ticks do, in the background unless SequentialCaptures is set, and the lines matching
+// while it runs don't start another one, nor do they while no profiler is enabled, it is paused or LeaderCheck
+// returns false. It panics if pattern or p is not valid.
+func LogTriggerWriter(inner io.Writer, pattern string, p Profile) io.Writer {
+	if err := checkProfiles([]Profile{p}); err != nil {
+		panic(err)
+	}
+	return &logTriggerWriter{w: inner, pattern: regexp.MustCompile(pattern), profile: p}
+}
+
+type logTriggerWriter struct {
+	w       io.Writer
+	pattern *regexp.Regexp
+	profile Profile
+	running int32 // 1 while a capture runs, accessed atomically
+}
+
+func (l *logTriggerWriter) Write(data []byte) (int, error) {
+	if l.pattern.Match(data) {
+		l.trigger()
+	}
+	return l.w.Write(data)
+}
+
+// trigger starts a capture unless one runs.
+func (l *logTriggerWriter) trigger() {
+	m := currentManager()
+	if m == nil || atomic.LoadInt32(&m.paused) == 1 || !m.isLeader() ||
+		!atomic.CompareAndSwapInt32(&l.running, 0, 1) {
+		return
+	}
+	m.infoLog(fmt.Sprintf("%s profile triggered by a log line matching %q", string(l.profile), l.pattern))
+	m.startCapture(l.profile, func() {
+		atomic.StoreInt32(&l.running, 0)
+	})
+}
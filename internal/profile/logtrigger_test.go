@@ -0,0 +1,75 @@
+package profile
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogTriggerWriter(t *testing.T) {
+	enableTestProfile(t, &Option{Y: time.Hour, X: time.Second}, Heap)
+	defer resetForTest()
+	m := manager
+	defer os.RemoveAll(m.StoreDir)
+
+	out := new(bytes.Buffer)
+	logger := log.New(LogTriggerWriter(out, `request \d+ timed out`, Goroutine), "", 0)
+	captured := func() int {
+		n := 0
+		for _, path := range m.getFileCollection() {
+			if strings.Contains(path, string(Goroutine)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	logger.Printf("request %d served", 1)
+	assert.True(t, m.waitCaptures(time.Second))
+	assert.Equal(t, 0, captured())
+
+	logger.Printf("request %d timed out", 2)
+	assert.True(t, m.waitCaptures(time.Second))
+	assert.Equal(t, 1, captured())
+	assert.Equal(t, "request 1 served\nrequest 2 timed out\n", out.String())
+
+	assert.Panics(t, func() {
+		LogTriggerWriter(out, "(", Goroutine)
+	})
+	assert.Panics(t, func() {
+		LogTriggerWriter(out, "timed out", "unknown")
+	})
+}
+
+func TestLogTriggerWriterLeaderCheck(t *testing.T) {
+	var leader int32
+	enableTestProfile(t, &Option{Y: time.Hour, X: time.Second, SequentialCaptures: true, LeaderCheck: func() bool {
+		return atomic.LoadInt32(&leader) == 1
+	}}, Heap)
+	defer resetForTest()
+	m := manager
+	defer os.RemoveAll(m.StoreDir)
+	logger := log.New(LogTriggerWriter(new(bytes.Buffer), "timed out", Goroutine), "", 0)
+	captured := func() int {
+		n := 0
+		for _, path := range m.getFileCollection() {
+			if strings.Contains(path, string(Goroutine)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	logger.Print("request timed out")
+	assert.Equal(t, 0, captured())
+	atomic.StoreInt32(&leader, 1)
+	// SequentialCaptures captures before the line is written
+	logger.Print("request timed out")
+	assert.Equal(t, 1, captured())
+}
@@ -0,0 +1,122 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// MergeHeapOverWindow takes n heap profiles, interval apart, and writes their merge into w.
+// The merged profile smooths out the noise of single snapshots.
+func MergeHeapOverWindow(n int, interval time.Duration, w io.Writer) error {
+	if n <= 0 {
+		return errors.New("n should not <= 0")
+	}
+	snapshots := make([]*profile.Profile, 0, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		p, err := lookupProfile(Heap)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, p)
+	}
+	merged, err := profile.Merge(snapshots)
+	if err != nil {
+		return err
+	}
+	return merged.Write(w)
+}
+
+// lookupProfile captures the instant profile p and parses it.
+func lookupProfile(p Profile) (*profile.Profile, error) {
+	var buf bytes.Buffer
+	if err := p.lookup().WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	return profile.Parse(&buf)
+}
+
+// CaptureHeapDelta writes the heap profile minus baseline into w, i.e. what changed since the baseline,
+// e.g. the allocations since a button was pressed. A nil baseline writes the whole heap profile.
+// The current heap profile is returned as the baseline of the next call.
+func CaptureHeapDelta(baseline *profile.Profile, w io.Writer) (*profile.Profile, error) {
+	current, err := lookupProfile(Heap)
+	if err != nil {
+		return nil, err
+	}
+	if baseline == nil {
+		return current, current.Write(w)
+	}
+	negated := baseline.Copy()
+	negated.Scale(-1)
+	delta, err := profile.Merge([]*profile.Profile{current.Copy(), negated})
+	if err != nil {
+		return nil, err
+	}
+	// drop the stacks which didn't change
+	samples := delta.Sample[:0]
+	for _, s := range delta.Sample {
+		for _, v := range s.Value {
+			if v != 0 {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	delta.Sample = samples
+	return current, delta.Write(w)
+}
+
+// CPUAccumulator accumulates the cpu profiles of the runs of a function, e.g. of the invocations of a
+// handler. The runtime allows a single cpu profile at a time, so the runs are serialized.
+type CPUAccumulator struct {
+	lock    sync.Mutex
+	runs    int
+	profile *profile.Profile
+}
+
+// Run runs f under a cpu profile, labelled with labels, and adds the profile to the accumulated one.
+// f runs even if the profile cannot be started, ErrCPUProfilingActive is returned then.
+func (a *CPUAccumulator) Run(ctx context.Context, labels pprof.LabelSet, f func(context.Context)) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		f(ctx)
+		return ErrCPUProfilingActive
+	}
+	pprof.Do(ctx, labels, f)
+	pprof.StopCPUProfile()
+	p, err := profile.Parse(&buf)
+	if err != nil {
+		return err
+	}
+	if a.profile != nil {
+		if p, err = profile.Merge([]*profile.Profile{a.profile, p}); err != nil {
+			return err
+		}
+	}
+	a.profile = p
+	a.runs++
+	return nil
+}
+
+// Dump writes the accumulated profile into w and returns the number of runs it accumulates,
+// 0 without writing anything if none did.
+func (a *CPUAccumulator) Dump(w io.Writer) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.profile == nil {
+		return 0, nil
+	}
+	return a.runs, a.profile.Write(w)
+}
@@ -0,0 +1,122 @@
+package profile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+var sink [][]byte
+
+func allocSpace(p *profile.Profile) int64 {
+	idx := -1
+	for i, st := range p.SampleType {
+		if st.Type == "alloc_space" {
+			idx = i
+		}
+	}
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[idx]
+	}
+	return total
+}
+
+func TestMergeHeapOverWindow(t *testing.T) {
+	allocate := func() {
+		for i := 0; i < 16; i++ {
+			sink = append(sink, make([]byte, 1<<20))
+		}
+		sink = nil
+		runtime.GC()
+	}
+	allocate()
+	before, err := lookupProfile(Heap)
+	assert.NoError(t, err)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				allocate()
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	err = MergeHeapOverWindow(3, 100*time.Millisecond, &buf)
+	close(stop)
+	<-done
+	assert.NoError(t, err)
+
+	merged, err := profile.Parse(&buf)
+	assert.NoError(t, err)
+	// every snapshot holds at least what was allocated before, and the later ones more
+	assert.True(t, allocSpace(merged) > 3*allocSpace(before))
+
+	assert.Error(t, MergeHeapOverWindow(0, time.Millisecond, &buf))
+}
+
+//go:noinline
+func allocateForDelta() {
+	// 16MB in chunks big enough to be always sampled by the heap profile
+	for i := 0; i < 2; i++ {
+		sink = append(sink, make([]byte, 8<<20))
+	}
+	sink = nil
+}
+
+// allocSpaceOf sums the alloc_space of the samples whose stack goes through function fn.
+func allocSpaceOf(p *profile.Profile, fn string) int64 {
+	filtered := p.Copy()
+	filtered.Sample = nil
+samples:
+	for _, s := range p.Sample {
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				if strings.HasSuffix(line.Function.Name, fn) {
+					filtered.Sample = append(filtered.Sample, s)
+					continue samples
+				}
+			}
+		}
+	}
+	return allocSpace(filtered)
+}
+
+func TestCaptureHeapDelta(t *testing.T) {
+	allocateForDelta()
+	runtime.GC()
+	baseline, err := CaptureHeapDelta(nil, ioutil.Discard)
+	assert.NoError(t, err)
+
+	allocateForDelta()
+	runtime.GC()
+	var buf bytes.Buffer
+	baseline, err = CaptureHeapDelta(baseline, &buf)
+	assert.NoError(t, err)
+	delta, err := profile.Parse(&buf)
+	assert.NoError(t, err)
+	// only the second round of allocations is in the delta
+	assert.InDelta(t, 16<<20, allocSpaceOf(delta, "allocateForDelta"), 2<<20)
+	assert.True(t, allocSpaceOf(baseline, "allocateForDelta") >= 30<<20)
+
+	runtime.GC()
+	buf.Reset()
+	_, err = CaptureHeapDelta(baseline, &buf)
+	assert.NoError(t, err)
+	delta, err = profile.Parse(&buf)
+	assert.NoError(t, err)
+	assert.Zero(t, allocSpaceOf(delta, "allocateForDelta"))
+}
@@ -0,0 +1,25 @@
+package profile
+
+import "time"
+
+// Metrics receives measurements of the profiler, so that they can be exported to e.g. Prometheus as
+// archive_duration_seconds (histogram) and archive_file_failures_total (counter).
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveArchiveDuration is called with the time spent by every archive run.
+	ObserveArchiveDuration(d time.Duration)
+	// IncArchiveFileFailures is called for every profile which could not be added to an archive.
+	IncArchiveFileFailures()
+}
+
+func (m *profileManager) observeArchiveDuration(start time.Time) {
+	if m.Metrics != nil {
+		m.Metrics.ObserveArchiveDuration(time.Since(start))
+	}
+}
+
+func (m *profileManager) incArchiveFileFailures() {
+	if m.Metrics != nil {
+		m.Metrics.IncArchiveFileFailures()
+	}
+}
@@ -0,0 +1,55 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetrics struct {
+	lock                sync.Mutex
+	archiveDurations    []time.Duration
+	archiveFileFailures int
+}
+
+func (f *fakeMetrics) ObserveArchiveDuration(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.archiveDurations = append(f.archiveDurations, d)
+}
+
+func (f *fakeMetrics) IncArchiveFileFailures() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.archiveFileFailures++
+}
+
+func TestArchiveMetrics(t *testing.T) {
+	metrics := &fakeMetrics{}
+	m := newTestManager(t, &Option{Compress: true, Metrics: metrics})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	collection := m.getFileCollection()
+	_, _, err := m.doArchive0(append(collection, filepath.Join(m.StoreDir, "missing.profile")))
+	assert.NoError(t, err)
+
+	assert.Len(t, metrics.archiveDurations, 1)
+	assert.True(t, metrics.archiveDurations[0] > 0)
+	assert.Equal(t, 1, metrics.archiveFileFailures)
+}
+
+type slowMetrics struct {
+	fakeMetrics
+	delay time.Duration
+}
+
+func (s *slowMetrics) ObserveArchiveDuration(d time.Duration) {
+	time.Sleep(s.delay)
+	s.fakeMetrics.ObserveArchiveDuration(d)
+}
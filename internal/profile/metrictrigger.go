@@ -0,0 +1,122 @@
+package profile
+
+import (
+	"fmt"
+	"math"
+)
+
+// MetricTrigger captures Profile, out of the schedule, when the runtime/metrics Metric crosses Threshold in
+// the direction of Comparator, see Option.MetricTriggers. The metrics are read on every tick.
+type MetricTrigger struct {
+	// Metric is the name of a runtime/metrics metric, e.g. "/sched/latencies:seconds".
+	Metric string
+	// Comparator is one of ">", ">=", "<" and "<=", the metric value being on its left hand side.
+	Comparator string
+	Threshold  float64
+	// Quantile is the quantile of the histogram metrics compared, of the values since the previous tick,
+	// 0.99 if not set.
+	Quantile float64
+	Profile  Profile
+}
+
+const defaultMetricQuantile = 0.99
+
+// metricReader reads the value of a metric, the quantile of the values since its previous read for a
+// histogram one.
+type metricReader interface {
+	read(name string, quantile float64) (float64, error)
+}
+
+// newMetricReader returns the reader of the runtime/metrics, tests replace it.
+var newMetricReader = newRuntimeMetricReader
+
+func (t MetricTrigger) check() error {
+	switch t.Comparator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("MetricTrigger comparator %q of %q not valid", t.Comparator, t.Metric)
+	}
+	if t.Quantile < 0 || t.Quantile > 1 {
+		return fmt.Errorf("MetricTrigger quantile %v of %q not in [0, 1]", t.Quantile, t.Metric)
+	}
+	if err := checkProfiles([]Profile{t.Profile}); err != nil {
+		return err
+	}
+	return checkRuntimeMetric(t.Metric)
+}
+
+func (t MetricTrigger) quantile() float64 {
+	if t.Quantile == 0 {
+		return defaultMetricQuantile
+	}
+	return t.Quantile
+}
+
+func (t MetricTrigger) crossed(value float64) bool {
+	switch t.Comparator {
+	case ">":
+		return value > t.Threshold
+	case ">=":
+		return value >= t.Threshold
+	case "<":
+		return value < t.Threshold
+	default:
+		return value <= t.Threshold
+	}
+}
+
+// checkMetricTriggers reads the metrics of MetricTriggers and captures the profiles of those crossing their
+// threshold. A trigger fires once as its metric crosses, and again only after it went back. doProfile runs
+// it on every tick.
+func (m *profileManager) checkMetricTriggers() {
+	if len(m.MetricTriggers) == 0 {
+		return
+	}
+	if m.metricReader == nil {
+		m.metricReader = newMetricReader()
+		m.metricFiring = make([]bool, len(m.MetricTriggers))
+	}
+	for i, trigger := range m.MetricTriggers {
+		value, err := m.metricReader.read(trigger.Metric, trigger.quantile())
+		if err != nil {
+			m.errorLogOnce("metric "+trigger.Metric, fmt.Sprintf("read metric %q failed", trigger.Metric), err)
+			continue
+		}
+		crossed := trigger.crossed(value)
+		firing := m.metricFiring[i]
+		m.metricFiring[i] = crossed
+		if !crossed || firing {
+			continue
+		}
+		m.infoLog(fmt.Sprintf("%s profile triggered by %s=%v %s %v", string(trigger.Profile), trigger.Metric,
+			value, trigger.Comparator, trigger.Threshold))
+		m.startCapture(trigger.Profile, nil)
+	}
+}
+
+// histogramQuantile returns the quantile q of the histogram of counts in buckets, whose boundaries are
+// those of the runtime/metrics histograms, the upper boundary of the bucket it falls in, 0 if empty.
+func histogramQuantile(buckets []float64, counts []uint64, q float64) float64 {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		if cumulative >= rank {
+			if math.IsInf(buckets[i+1], 1) {
+				return buckets[i]
+			}
+			return buckets[i+1]
+		}
+	}
+	return buckets[len(buckets)-1]
+}
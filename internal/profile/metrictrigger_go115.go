@@ -0,0 +1,24 @@
+//go:build !go1.16
+// +build !go1.16
+
+package profile
+
+import (
+	"errors"
+	"fmt"
+)
+
+type runtimeMetricReader struct{}
+
+func newRuntimeMetricReader() metricReader {
+	return runtimeMetricReader{}
+}
+
+func (runtimeMetricReader) read(name string, _ float64) (float64, error) {
+	return 0, fmt.Errorf("metric %q not supported", name)
+}
+
+// checkRuntimeMetric fails, the runtime/metrics require go1.16.
+func checkRuntimeMetric(string) error {
+	return errors.New("MetricTriggers require go1.16")
+}
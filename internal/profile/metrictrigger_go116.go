@@ -0,0 +1,58 @@
+//go:build go1.16
+// +build go1.16
+
+package profile
+
+import (
+	"fmt"
+	"runtime/metrics"
+)
+
+// runtimeMetricReader reads the runtime/metrics, it keeps the counts of the histograms read to return the
+// quantiles of their values since.
+type runtimeMetricReader struct {
+	counts map[string][]uint64
+}
+
+func newRuntimeMetricReader() metricReader {
+	return &runtimeMetricReader{counts: map[string][]uint64{}}
+}
+
+func (r *runtimeMetricReader) read(name string, quantile float64) (float64, error) {
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+	value := sample[0].Value
+	switch value.Kind() {
+	case metrics.KindUint64:
+		return float64(value.Uint64()), nil
+	case metrics.KindFloat64:
+		return value.Float64(), nil
+	case metrics.KindFloat64Histogram:
+		histogram := value.Float64Histogram()
+		counts := append([]uint64(nil), histogram.Counts...)
+		delta := append([]uint64(nil), counts...)
+		if previous := r.counts[name]; len(previous) == len(counts) {
+			for i := range delta {
+				delta[i] -= previous[i]
+			}
+		}
+		r.counts[name] = counts
+		return histogramQuantile(histogram.Buckets, delta, quantile), nil
+	default:
+		return 0, fmt.Errorf("metric %q not supported", name)
+	}
+}
+
+// checkRuntimeMetric tells whether name is a runtime/metrics metric of a supported kind.
+func checkRuntimeMetric(name string) error {
+	for _, description := range metrics.All() {
+		if description.Name != name {
+			continue
+		}
+		if description.Kind == metrics.KindBad {
+			break
+		}
+		return nil
+	}
+	return fmt.Errorf("MetricTrigger metric %q not supported", name)
+}
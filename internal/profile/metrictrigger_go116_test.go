@@ -0,0 +1,28 @@
+//go:build go1.16
+// +build go1.16
+
+package profile
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeMetricTriggers(t *testing.T) {
+	opt := Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir()}
+	opt.MetricTriggers = []MetricTrigger{
+		{Metric: "/sched/goroutines:goroutines", Comparator: ">", Threshold: 1, Profile: Goroutine},
+		{Metric: "/gc/pauses:seconds", Comparator: ">=", Threshold: 0.1, Profile: Trace},
+	}
+	assert.NoError(t, checkOpt(opt, []Profile{Heap}))
+
+	reader := newRuntimeMetricReader()
+	goroutines, err := reader.read("/sched/goroutines:goroutines", 0)
+	assert.NoError(t, err)
+	assert.True(t, goroutines > 0)
+	_, err = reader.read("/gc/pauses:seconds", defaultMetricQuantile)
+	assert.NoError(t, err)
+}
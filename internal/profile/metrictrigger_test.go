@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubMetricReader map[string]float64
+
+func (s stubMetricReader) read(name string, _ float64) (float64, error) {
+	value, ok := s[name]
+	if !ok {
+		return 0, errors.New("no such metric")
+	}
+	return value, nil
+}
+
+func TestMetricTriggers(t *testing.T) {
+	values := stubMetricReader{}
+	defer func(f func() metricReader) {
+		newMetricReader = f
+	}(newMetricReader)
+	newMetricReader = func() metricReader {
+		return values
+	}
+	m := newTestManager(t, &Option{MetricTriggers: []MetricTrigger{
+		{Metric: "/sched/latencies:seconds", Comparator: ">", Threshold: 0.01, Profile: Goroutine},
+	}})
+	defer os.RemoveAll(m.StoreDir)
+	captured := func() int {
+		n := 0
+		for _, path := range m.getFileCollection() {
+			if strings.Contains(path, string(Goroutine)) {
+				n++
+			}
+		}
+		return n
+	}
+	tick := func(value float64) {
+		values["/sched/latencies:seconds"] = value
+		m.checkMetricTriggers()
+		assert.True(t, m.waitCaptures(time.Second))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tick(0.001)
+	assert.Equal(t, 0, captured())
+	tick(0.05)
+	assert.Equal(t, 1, captured())
+	// captured once per crossing
+	tick(0.08)
+	assert.Equal(t, 1, captured())
+	tick(0.002)
+	tick(0.02)
+	assert.Equal(t, 2, captured())
+
+	// SequentialCaptures captures on the profiling goroutine, as the ticks do
+	m.SequentialCaptures = true
+	values["/sched/latencies:seconds"] = 0.001
+	m.checkMetricTriggers()
+	values["/sched/latencies:seconds"] = 0.05
+	m.checkMetricTriggers()
+	assert.Equal(t, 3, captured())
+}
+
+func TestMetricTriggerCheck(t *testing.T) {
+	opt := Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir()}
+	for _, trigger := range []MetricTrigger{
+		{Metric: "/sched/goroutines:goroutines", Comparator: "=>", Threshold: 1, Profile: Goroutine},
+		{Metric: "/sched/goroutines:goroutines", Comparator: ">", Threshold: 1, Profile: "nope"},
+		{Metric: "/sched/goroutines:goroutines", Comparator: ">", Quantile: 2, Profile: Goroutine},
+		{Metric: "/no/such:metric", Comparator: ">", Threshold: 1, Profile: Goroutine},
+	} {
+		opt.MetricTriggers = []MetricTrigger{trigger}
+		assert.Error(t, checkOpt(opt, []Profile{Heap}), "%+v", trigger)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	buckets := []float64{0, 1, 2, 4, 8}
+	assert.Equal(t, 0.0, histogramQuantile(buckets, []uint64{0, 0, 0, 0}, 0.99))
+	assert.Equal(t, 1.0, histogramQuantile(buckets, []uint64{90, 9, 1, 0}, 0.5))
+	assert.Equal(t, 2.0, histogramQuantile(buckets, []uint64{90, 9, 1, 0}, 0.99))
+	assert.Equal(t, 4.0, histogramQuantile(buckets, []uint64{90, 9, 1, 0}, 1))
+}
@@ -0,0 +1,275 @@
+package profile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin/internal/json"
+	"github.com/google/pprof/profile"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// otelScopeName is the instrumentation scope of the profiles exported by OTelSink.
+const otelScopeName = "github.com/gin-gonic/gin/internal/profile"
+
+// OTelSink is an ArchiveSink exporting the pprof profiles of the archives to an OpenTelemetry collector over
+// OTLP/HTTP, in its JSON encoding. Every profile keeps its pprof encoding as the original payload, its
+// default sample type, e.g. cpu/nanoseconds or inuse_space/bytes, and its period are the OTLP ones.
+// The other entries, e.g. traces, are not exported. Encrypted archives can't be exported.
+type OTelSink struct {
+	// Endpoint is the URL of the OTLP profiles endpoint, e.g. http://localhost:4318/v1development/profiles.
+	Endpoint string
+	// ServiceName is the service.name resource attribute, the name of the executable if empty.
+	ServiceName string
+	// Attributes are further resource attributes, e.g. deployment.environment.
+	Attributes map[string]string
+	// Headers are set on the export requests, e.g. for the authentication.
+	Headers map[string]string
+	// Client does the exports, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Put exports the profiles of the archive named name in one request.
+func (s *OTelSink) Put(name string, r io.Reader) error {
+	entries, err := readArchiveEntries(name, r)
+	if err != nil {
+		return err
+	}
+	request := s.exportRequest(entries)
+	if len(request.ResourceProfiles[0].ScopeProfiles[0].Profiles) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("export of %q failed with status %s", name, resp.Status)
+	}
+	return nil
+}
+
+// exportRequest returns the OTLP export request of the pprof profiles among entries.
+func (s *OTelSink) exportRequest(entries map[string][]byte) *otlpExportRequest {
+	table := &otlpStringTable{index: make(map[string]int)}
+	table.add("")
+	var profiles []otlpProfile
+	for _, data := range entries {
+		prof, err := profile.ParseData(data)
+		if err != nil || len(prof.SampleType) == 0 {
+			continue
+		}
+		sampleType := prof.SampleType[len(prof.SampleType)-1]
+		for _, t := range prof.SampleType {
+			if t.Type == prof.DefaultSampleType {
+				sampleType = t
+			}
+		}
+		exported := otlpProfile{
+			SampleType:            table.valueType(sampleType),
+			Period:                prof.Period,
+			TimeUnixNano:          prof.TimeNanos,
+			DurationNano:          prof.DurationNanos,
+			OriginalPayloadFormat: "pprof",
+			OriginalPayload:       data,
+		}
+		if prof.PeriodType != nil {
+			exported.PeriodType = table.valueType(prof.PeriodType)
+		}
+		profiles = append(profiles, exported)
+	}
+	return &otlpExportRequest{
+		ResourceProfiles: []otlpResourceProfiles{{
+			Resource: otlpResource{Attributes: s.resourceAttributes()},
+			ScopeProfiles: []otlpScopeProfiles{{
+				Scope:    otlpScope{Name: otelScopeName},
+				Profiles: profiles,
+			}},
+		}},
+		Dictionary: otlpDictionary{StringTable: table.table},
+	}
+}
+
+// resourceAttributes returns service.name, host.name and the Attributes.
+func (s *OTelSink) resourceAttributes() []otlpKeyValue {
+	serviceName := s.ServiceName
+	if serviceName == "" {
+		serviceName = filepath.Base(os.Args[0])
+	}
+	attributes := []otlpKeyValue{stringAttribute("service.name", serviceName)}
+	if host, err := os.Hostname(); err == nil {
+		attributes = append(attributes, stringAttribute("host.name", host))
+	}
+	for key, value := range s.Attributes {
+		attributes = append(attributes, stringAttribute(key, value))
+	}
+	return attributes
+}
+
+// readArchiveEntries returns the content of the entries of the zip, tar.zst or tar.gz archive named name by
+// name.
+func readArchiveEntries(name string, r io.Reader) (map[string][]byte, error) {
+	switch {
+	case strings.HasSuffix(name, Zip.extension()):
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string][]byte)
+		for _, f := range zr.File {
+			entry, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			entries[f.Name], err = ioutil.ReadAll(entry)
+			entry.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	case strings.HasSuffix(name, Zstd.extension()):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return readTarEntries(decoder)
+	case strings.HasSuffix(name, Gzip.extension()):
+		decoder, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return readTarEntries(decoder)
+	default:
+		return nil, fmt.Errorf("cannot read the profiles of the archive %q", name)
+	}
+}
+
+// readTarEntries returns the content of the entries of the tarball r by name.
+func readTarEntries(r io.Reader) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entries[header.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The subset of the OTLP profiles signal OTelSink exports, see opentelemetry-proto's
+// opentelemetry/proto/collector/profiles/v1development/profiles_service.proto.
+type otlpExportRequest struct {
+	ResourceProfiles []otlpResourceProfiles `json:"resourceProfiles"`
+	Dictionary       otlpDictionary         `json:"dictionary"`
+}
+
+type otlpResourceProfiles struct {
+	Resource      otlpResource        `json:"resource"`
+	ScopeProfiles []otlpScopeProfiles `json:"scopeProfiles"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+type otlpScopeProfiles struct {
+	Scope    otlpScope     `json:"scope"`
+	Profiles []otlpProfile `json:"profiles"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// otlpProfile is a profile, the 64 bit integers are strings as in the OTLP JSON encoding.
+type otlpProfile struct {
+	SampleType            otlpValueType `json:"sampleType"`
+	PeriodType            otlpValueType `json:"periodType"`
+	Period                int64         `json:"period,string"`
+	TimeUnixNano          int64         `json:"timeUnixNano,string"`
+	DurationNano          int64         `json:"durationNano,string"`
+	OriginalPayloadFormat string        `json:"originalPayloadFormat"`
+	OriginalPayload       []byte        `json:"originalPayload"`
+}
+
+// otlpValueType is a type and unit, indices into the string table of the dictionary.
+type otlpValueType struct {
+	TypeStrindex int `json:"typeStrindex"`
+	UnitStrindex int `json:"unitStrindex"`
+}
+
+type otlpDictionary struct {
+	StringTable []string `json:"stringTable"`
+}
+
+// otlpStringTable builds the string table of the dictionary, whose first string is the empty one.
+type otlpStringTable struct {
+	table []string
+	index map[string]int
+}
+
+func (t *otlpStringTable) add(s string) int {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	t.index[s] = len(t.table)
+	t.table = append(t.table, s)
+	return t.index[s]
+}
+
+func (t *otlpStringTable) valueType(v *profile.ValueType) otlpValueType {
+	return otlpValueType{TypeStrindex: t.add(v.Type), UnitStrindex: t.add(v.Unit)}
+}
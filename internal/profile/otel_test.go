@@ -0,0 +1,92 @@
+package profile
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin/internal/json"
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+// otlpReceiver is a mock OTLP/HTTP receiver keeping the export requests it got.
+func otlpReceiver(t *testing.T, requests *[]otlpExportRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1development/profiles", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var request otlpExportRequest
+		assert.NoError(t, json.Unmarshal(body, &request))
+		*requests = append(*requests, request)
+	}))
+}
+
+func TestOTelSink(t *testing.T) {
+	var requests []otlpExportRequest
+	receiver := otlpReceiver(t, &requests)
+	defer receiver.Close()
+	for _, format := range []CompressionFormat{Zip, Zstd, Gzip} {
+		requests = nil
+		sink := &OTelSink{
+			Endpoint:    receiver.URL + "/v1development/profiles",
+			ServiceName: "checkout",
+			Attributes:  map[string]string{"deployment.environment": "test"},
+			Headers:     map[string]string{"Authorization": "secret"},
+		}
+		m := newTestManager(t, &Option{Compress: true, CompressionFormat: format, ArchiveSink: sink})
+		m.doInstantProfile(Heap)
+		m.doInstantProfile(Goroutine)
+		_, err := m.forceArchive()
+		assert.NoError(t, err)
+		os.RemoveAll(m.StoreDir)
+
+		assert.Len(t, requests, 1)
+		request := requests[0]
+		assert.Len(t, request.ResourceProfiles, 1)
+		attributes := make(map[string]string)
+		for _, attribute := range request.ResourceProfiles[0].Resource.Attributes {
+			attributes[attribute.Key] = attribute.Value.StringValue
+		}
+		host, _ := os.Hostname()
+		assert.Equal(t, map[string]string{
+			"service.name":           "checkout",
+			"host.name":              host,
+			"deployment.environment": "test",
+		}, attributes)
+
+		scope := request.ResourceProfiles[0].ScopeProfiles[0]
+		assert.Equal(t, otelScopeName, scope.Scope.Name)
+		var sampleTypes []string
+		for _, p := range scope.Profiles {
+			table := request.Dictionary.StringTable
+			sampleTypes = append(sampleTypes, table[p.SampleType.TypeStrindex]+"/"+table[p.SampleType.UnitStrindex])
+			assert.Equal(t, "pprof", p.OriginalPayloadFormat)
+			assert.NotZero(t, p.TimeUnixNano)
+			prof, err := profile.ParseData(p.OriginalPayload)
+			assert.NoError(t, err)
+			assert.Equal(t, prof.TimeNanos, p.TimeUnixNano)
+		}
+		sort.Strings(sampleTypes)
+		assert.Equal(t, []string{"goroutine/count", "inuse_space/bytes"}, sampleTypes)
+	}
+}
+
+func TestOTelSinkFailure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	m := newTestManager(t, &Option{Compress: true, ArchiveSink: &OTelSink{Endpoint: receiver.URL}})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	_, err := m.forceArchive()
+	assert.Error(t, err)
+	assert.Len(t, m.getFileCollection(), 1)
+}
@@ -0,0 +1,85 @@
+package profile
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overheadCycleNum is the number of latest profiling cycles EstimateOverhead is computed over.
+const overheadCycleNum = 10
+
+// Overhead is the estimated cost of the periodical profiling over its latest cycles.
+type Overhead struct {
+	// Cycles is the number of cycles measured, up to 10.
+	Cycles int
+	// Wall is the wall-clock time covered by the cycles.
+	Wall time.Duration
+	// Busy is the time spent capturing and archiving during the cycles. The recording time of the cpu
+	// profile and the trace is left out, only starting, stopping and writing them is counted.
+	Busy time.Duration
+	// Percent is Busy in percent of Wall, 0 until a cycle is over.
+	Percent float64
+}
+
+// EstimateOverhead reports the estimated overhead of the periodical profiling over its latest cycles.
+// It is an approximation: the captures run in their own goroutines and the sampling cost of a running
+// cpu profile or trace is not measured.
+func EstimateOverhead() (Overhead, error) {
+	m := currentManager()
+	if m == nil {
+		return Overhead{}, ErrNotEnabled
+	}
+	return m.overhead.estimate(), nil
+}
+
+// overheadCycles keeps the cost of the latest profiling cycles.
+type overheadCycles struct {
+	busy   int64 // nanoseconds spent in the current cycle, accessed atomically
+	lock   sync.Mutex
+	start  time.Time // of the current cycle
+	walls  []time.Duration
+	busies []time.Duration
+	next   int
+}
+
+// spent adds the time spent since start, less the recording time, to the current cycle.
+func (o *overheadCycles) spent(start time.Time, recording time.Duration) {
+	if d := time.Since(start) - recording; d > 0 {
+		atomic.AddInt64(&o.busy, int64(d))
+	}
+}
+
+// tick ends the current cycle at now and starts the next one. The cycles ending paused are not kept.
+func (o *overheadCycles) tick(now time.Time, paused bool) {
+	busy := time.Duration(atomic.SwapInt64(&o.busy, 0))
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	start := o.start
+	o.start = now
+	if paused || start.IsZero() {
+		return
+	}
+	if len(o.walls) < overheadCycleNum {
+		o.walls = append(o.walls, now.Sub(start))
+		o.busies = append(o.busies, busy)
+		return
+	}
+	o.walls[o.next] = now.Sub(start)
+	o.busies[o.next] = busy
+	o.next = (o.next + 1) % overheadCycleNum
+}
+
+func (o *overheadCycles) estimate() Overhead {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	overhead := Overhead{Cycles: len(o.walls)}
+	for i := range o.walls {
+		overhead.Wall += o.walls[i]
+		overhead.Busy += o.busies[i]
+	}
+	if overhead.Wall > 0 {
+		overhead.Percent = float64(overhead.Busy) / float64(overhead.Wall) * 100
+	}
+	return overhead
+}
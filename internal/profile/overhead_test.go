@@ -0,0 +1,48 @@
+package profile
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateOverhead(t *testing.T) {
+	_, err := EstimateOverhead()
+	assert.Equal(t, ErrNotEnabled, err)
+	_, err = GetStatus()
+	assert.Equal(t, ErrNotEnabled, err)
+
+	m := newTestManager(t, &Option{Y: 50 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+	startTestLoop(m, Heap, Goroutine)
+	time.Sleep(300 * time.Millisecond)
+	stopTestLoop(m)
+	m.waitCaptures(time.Second)
+
+	overhead := m.overhead.estimate()
+	assert.True(t, overhead.Cycles > 0)
+	assert.True(t, overhead.Wall > 0)
+	assert.True(t, overhead.Busy > 0)
+	assert.True(t, overhead.Percent >= 0 && overhead.Percent <= 100)
+
+	status := m.status()
+	assert.Equal(t, []Profile{Heap, Goroutine}, status.Profiles)
+	assert.Equal(t, overhead, status.Overhead)
+}
+
+func TestOverheadCyclesPaused(t *testing.T) {
+	var o overheadCycles
+	start := time.Now()
+	o.tick(start, false)
+	o.busy = int64(10 * time.Millisecond)
+	o.tick(start.Add(100*time.Millisecond), false)
+	o.busy = int64(50 * time.Millisecond)
+	o.tick(start.Add(200*time.Millisecond), true)
+
+	overhead := o.estimate()
+	assert.Equal(t, 1, overhead.Cycles)
+	assert.Equal(t, 100*time.Millisecond, overhead.Wall)
+	assert.InDelta(t, 10, overhead.Percent, 0.001)
+}
@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"strings"
+	"time"
+)
+
+// now is the clock used to name and partition profiles, tests replace it.
+var now = time.Now
+
+// timestamp is the time used to name and partition profiles, in UTC unless opt.UTC is false.
+func (opt *Option) timestamp() time.Time {
+	if opt.UTC != nil && !*opt.UTC {
+		return now()
+	}
+	return now().UTC()
+}
+
+// dateTokens are the StoreDir placeholders and their time layouts,
+// e.g. "/var/profiles/{yyyy}/{mm}/{dd}" partitions the profiles by day.
+var dateTokens = [][2]string{{"{yyyy}", "2006"}, {"{mm}", "01"}, {"{dd}", "02"}}
+
+func isPartitioned(dir string) bool {
+	for _, token := range dateTokens {
+		if strings.Contains(dir, token[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandStoreDir replaces the date tokens of dir by the date of t.
+func expandStoreDir(dir string, t time.Time) string {
+	for _, token := range dateTokens {
+		dir = strings.Replace(dir, token[0], t.Format(token[1]), -1)
+	}
+	return dir
+}
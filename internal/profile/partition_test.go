@@ -0,0 +1,79 @@
+package profile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionedStoreDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	m := newTestManager(t, &Option{StoreDir: filepath.Join(root, "{yyyy}", "{mm}", "{dd}")})
+
+	defer func(f func() time.Time) {
+		now = f
+	}(now)
+	clock := time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC)
+	now = func() time.Time {
+		return clock
+	}
+	m.doInstantProfile(Heap)
+	clock = clock.Add(2 * time.Second)
+	m.doInstantProfile(Heap)
+
+	day1 := filepath.Join(root, "2019", "12", "31")
+	day2 := filepath.Join(root, "2020", "01", "01")
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 2)
+	assert.Equal(t, day1, filepath.Dir(collection[0]))
+	assert.Equal(t, day2, filepath.Dir(collection[1]))
+
+	created, _, err := m.doArchive0(collection)
+	assert.NoError(t, err)
+	assert.Len(t, created, 2)
+	for i, dir := range []string{day1, day2} {
+		archives, err := filepath.Glob(filepath.Join(dir, "archive", "*.zip"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{created[i]}, archives)
+	}
+}
+
+func TestExpandStoreDir(t *testing.T) {
+	date := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	assert.Equal(t, "/var/profiles/2020/02/03", expandStoreDir("/var/profiles/{yyyy}/{mm}/{dd}", date))
+	assert.Equal(t, "/var/profiles", expandStoreDir("/var/profiles", date))
+	assert.True(t, isPartitioned("/var/profiles/{yyyy}"))
+	assert.False(t, isPartitioned("/var/profiles"))
+}
+
+func TestUTCTimestamps(t *testing.T) {
+	defer func(f func() time.Time) {
+		now = f
+	}(now)
+	clock := time.Date(2020, 1, 1, 7, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	now = func() time.Time {
+		return clock
+	}
+	local := false
+	for _, tc := range []struct {
+		utc    *bool
+		suffix string
+	}{
+		{nil, "2019-12-31T23:00:00.000Z.profile"},
+		{&local, "2020-01-01T07:00:00.000+08:00.profile"},
+	} {
+		m := newTestManager(t, &Option{UTC: tc.utc})
+		m.doInstantProfile(Heap)
+		collection := m.getFileCollection()
+		assert.Len(t, collection, 1)
+		assert.True(t, strings.HasSuffix(collection[0], tc.suffix), collection[0])
+		os.RemoveAll(m.StoreDir)
+	}
+}
@@ -0,0 +1,69 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// PresignedURLSink is an ArchiveSink uploading the archives with an HTTP PUT to pre-signed URLs, e.g. of
+// S3 or GCS, so that the application holds no cloud credentials.
+type PresignedURLSink struct {
+	// URL returns a fresh pre-signed PUT URL for the archive named name.
+	URL func(name string) (string, error)
+	// Client does the uploads, http.DefaultClient if nil.
+	Client *http.Client
+	// Retries is the number of times a failed upload is retried, with a fresh URL and a backoff
+	// doubling from 1s.
+	Retries int
+}
+
+// presignedRetryBackoff is the wait before the first upload retry, it doubles for every retry.
+var presignedRetryBackoff = time.Second
+
+// Put uploads the archive, its Content-Type is set after its extension.
+func (s *PresignedURLSink) Put(name string, r io.Reader) error {
+	// read once, every attempt sends it again
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	backoff := presignedRetryBackoff
+	for retry := 0; ; retry++ {
+		err = s.put(name, data)
+		if err == nil || retry >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *PresignedURLSink) put(name string, data []byte) error {
+	url, err := s.URL(name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ArchiveContentType(name))
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload of %q failed with status %s", name, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package profile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresignedURLSink(t *testing.T) {
+	defer func(backoff time.Duration) {
+		presignedRetryBackoff = backoff
+	}(presignedRetryBackoff)
+	presignedRetryBackoff = 10 * time.Millisecond
+
+	var lock sync.Mutex
+	var attempts int
+	received := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			// the first attempt fails, the retry succeeds
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "application/zip", r.Header.Get("Content-Type"))
+		assert.Equal(t, "fresh", r.URL.Query().Get("signature"))
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		received[r.URL.Path] = data
+	}))
+	defer server.Close()
+
+	sink := &PresignedURLSink{
+		URL: func(name string) (string, error) {
+			return server.URL + "/bucket/" + name + "?signature=fresh", nil
+		},
+		Retries: 1,
+	}
+	archive := bytes.Repeat([]byte("archive"), 1000)
+	assert.NoError(t, sink.Put("2020-01-02.zip", bytes.NewReader(archive)))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, archive, received["/bucket/2020-01-02.zip"])
+
+	// no retry left
+	attempts = 0
+	sink.Retries = 0
+	assert.Error(t, sink.Put("2020-01-03.zip", bytes.NewReader(archive)))
+}
@@ -1,15 +1,20 @@
 package profile
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime/pprof"
-	"runtime/trace"
+	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,10 +26,29 @@ const (
 	Block        Profile = "block"
 	Mutex        Profile = "mutex"
 	Trace        Profile = "trace"
+	// FullGoroutineDump is the text traceback of every goroutine, as served by goroutine?debug=2,
+	// which is the most useful to diagnose a hang.
+	FullGoroutineDump Profile = "goroutine_full"
+	// WallClock is the wall-clock profile of CaptureWallClock, which unlike Cpu also shows the off-cpu time.
+	WallClock Profile = "wallclock"
 )
 
+// maxCPUProfileRate bounds Option.CPUProfileRate, higher rates cost a lot and are not reliably
+// delivered by the OS timer anyway.
+const maxCPUProfileRate = 10000
+
+// defaultWriteBufferSize is the size of the buffer profiles are written through, see Option.WriteBufferSize.
+const defaultWriteBufferSize = 32 * 1024
+
+// pprofExtension is the extension of the gzipped protobuf profiles, see Option.PprofExtension.
+const pprofExtension = ".pb.gz"
+
+// repeatedErrorLogInterval is how often an error which is expected to repeat every tick is logged.
+const repeatedErrorLogInterval = time.Minute
+
 var profileCollection = map[Profile]struct{}{Cpu: {}, Heap: {}, ThreadCreate: {}, Goroutine: {},
-	Block: {}, Mutex: {}, Trace: {}}
+	Block: {}, Mutex: {}, Trace: {}, FullGoroutineDump: {},
+	WallClock: {}}
 var profileOnceLock sync.Once
 var defaultFormat = &Format{
 	FileNameFormat: "{type}_{timestamp}.profile",
@@ -32,197 +56,926 @@ var defaultFormat = &Format{
 }
 var manager *profileManager
 
+// managerLock makes the check and set of manager by EnableProfile atomic, along with its reset once stopped.
+var managerLock sync.Mutex
+
+// currentManager returns the package level profiler, nil if not enabled.
+func currentManager() *profileManager {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+	return manager
+}
+
 type Format struct {
 	TimeFormat     string
-	FileNameFormat string // et :"{type}_{timestamp}.profile"
-	formatFunc     func(string, Profile) string
-	lock           sync.Mutex
+	FileNameFormat string // et :"{type}_{timestamp}.profile", {seq} is replaced by a sequence number
+	// Replacement replaces the characters of the file name which are illegal on the OS, e.g. the path
+	// separators, or the ':' of the time format on windows, "_" by default.
+	Replacement string
 }
 
+// illegalFileNameChars are the characters not allowed in a file name on the OS, the control characters aside.
+var illegalFileNameChars = func() string {
+	if runtime.GOOS == "windows" {
+		return `<>:"/\|?*`
+	}
+	return "/"
+}()
+
+// fileSeq numbers the profiles for the {seq} placeholder, it goes on increasing as long as the process runs.
+var fileSeq uint64
+
 func (f *Format) format(time1 time.Time, type1 Profile) string {
-	f.lock.Lock()
-	defer f.lock.Unlock()
-	if f.formatFunc == nil {
-		tmp := strings.Replace(f.FileNameFormat, "{type}", "%s", 1)
-		tmp = strings.Replace(tmp, "{timestamp}", "%s", 1)
-		typeIdx := strings.Index(f.FileNameFormat, "{type}")
-		timestampIdx := strings.Index(f.FileNameFormat, "{timestamp}")
-		if typeIdx < timestampIdx {
-			f.formatFunc = func(time2 string, type2 Profile) string {
-				return fmt.Sprintf(tmp, type2, time2)
-			}
+	name := strings.Replace(f.FileNameFormat, "{type}", string(type1), 1)
+	name = strings.Replace(name, "{timestamp}", time1.Format(f.TimeFormat), 1)
+	if strings.Contains(name, "{seq}") {
+		// a restarted process starts over, O_EXCL makes it fail rather than overwrite older profiles
+		name = strings.Replace(name, "{seq}", fmt.Sprintf("%06d", atomic.AddUint64(&fileSeq, 1)), 1)
+	}
+	return f.sanitize(name)
+}
+
+// sanitize replaces the illegal characters and the control characters of name by f.Replacement.
+func (f *Format) sanitize(name string) string {
+	replacement := f.Replacement
+	if replacement == "" {
+		replacement = "_"
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(illegalFileNameChars, r) {
+			b.WriteString(replacement)
 		} else {
-			f.formatFunc = func(time2 string, type2 Profile) string {
-				return fmt.Sprintf(tmp, time2, type2)
-			}
+			b.WriteRune(r)
 		}
 	}
-	return f.formatFunc(time1.Format(f.TimeFormat), type1)
+	return b.String()
 }
 
 type profileManager struct {
 	*Option
 	ticker         *time.Ticker
+	heartbeat      int64 // unix nano of the last tick, accessed atomically
+	failures       int32 // number of consecutive failed captures, accessed atomically
+	paused         int32 // 1 while paused, accessed atomically
+	stopped        int32 // 1 once stopping, accessed atomically
+	archiveDrops   int64 // archives not received from the channel of ArchiveChannel, accessed atomically
+	rolling        *rollingArchive
+	rollingLock    sync.Mutex // guards rolling, held while appending to the collection with IncrementalArchive
+	onStopped      func()
+	fifo           bool // StoreDir is a named pipe
+	fifoLock       sync.Mutex
+	profiles       []Profile
+	scheduleLock   sync.Mutex // guards profiles, Y, X, storeDir, archiveDir and ticker which can be changed at runtime
+	lastDigests    map[Profile][sha256.Size]byte
+	errorLogTimes  map[string]time.Time
+	recentLogs     logRing
+	counters       statusCounters
+	overhead       overheadCycles
+	stop           chan struct{}
+	done           chan struct{}
+	tickerReset    chan struct{}
+	captures       *sync.WaitGroup // of the running captures, replaced by waitCaptures
+	captureLock    sync.Mutex      // guards captures
 	fileCollection []string
+	archives       chan ArchiveReady      // of ArchiveChannel, nil without
+	openFiles      map[string]struct{}    // profiles being written, skipped by the scans until closed
+	scanned        map[string]struct{}    // files of StoreDir the scan doesn't add, see ScanInterval
+	lastScan       time.Time              // accessed by the profiling loop only
+	metricReader   metricReader           // of MetricTriggers, accessed by the profiling loop only
+	metricFiring   []bool                 // whether the MetricTriggers crossed on the previous tick
+	fileInfos      map[string]profileFile // of the profiles of the collection
+	storeDir       string                 // StoreDir, or the directory of SetStoreDir
 	archiveDir     string
+	archiveQueue   chan archiveJob
+	archiverDone   chan struct{}
+	archiveLock    sync.Mutex // serializes checkArchive and ForceArchive
+	lastArchive    time.Time  // guarded by archiveLock
 	err            error
 	lock           sync.Mutex
+	indexLock      sync.Mutex
+	pruneLock      sync.Mutex // serializes pruneRaw
 }
 
 type Option struct {
 	Y             time.Duration // do profiling for X for every Y,
 	X             time.Duration
-	StoreDir      string  // place to store the profiles
-	Compress      bool    // whether to compress the profiles.By default the profiles are compressed daily by gzip.
+	StoreDir      string  // place to store the profiles, {yyyy}, {mm} and {dd} partition it by day, a FIFO gets them in turn
+	Compress      bool    // whether to compress the profiles.By default the profiles are archived by zip, see CompressionFormat
 	FileFormat    *Format // profile file name format, if not set, defaultFormat will be used
 	LogOutput     io.Writer
 	ErrLogOutput  io.Writer
 	ArchivePolicy ArchivePolicy
+	// WriteLatestSymlink keeps StoreDir/latest_<type> pointing at the newest profile of each type.
+	// A copy is written instead where symlinks are not supported.
+	WriteLatestSymlink bool
+	// CPUProfileRate is the sampling rate of the cpu profile in Hz, 0 keeps the runtime default of 100Hz.
+	CPUProfileRate int
+	// SkipDuplicates drops an instant profile if it is identical to the previous capture of the same type,
+	// which is common for mostly idle services.
+	SkipDuplicates bool
+	// KeepAfterArchive keeps the raw profiles in StoreDir once they are archived.
+	KeepAfterArchive bool
+	// Metrics receives the measurements of the profiler if set.
+	Metrics Metrics
+	// WarmupDelay holds the first profiling back by this delay on top of Y, so that the noise of the
+	// startup (cold caches, lazy initialization) is left out of the profiles.
+	WarmupDelay time.Duration
+	// ReconfigureGrace is how long SetInterval and Reconfigure wait for running captures to finish
+	// before applying the new settings, so that they aren't truncated.
+	ReconfigureGrace time.Duration
+	// ArchiveQueueSize is the number of batches waiting for the background archiver, 1 by default.
+	ArchiveQueueSize int
+	// BlockOnFullArchiveQueue makes the profiling loop wait for room in a full archive queue.
+	// By default the archive is skipped and its files are archived with the next batch.
+	BlockOnFullArchiveQueue bool
+	// ArchiveExclude holds glob patterns, matched against the file name and the full path, of profiles
+	// which are never archived nor removed.
+	ArchiveExclude []string
+	// CompressionFormat is the format of the archives, Zip by default.
+	CompressionFormat CompressionFormat
+	// WriteIndex keeps an index of the captures in StoreDir/index.jsonl, one IndexRecord per line.
+	WriteIndex bool
+	// UTC formats the timestamps of the profiles, the archives and the index in UTC, so that the files
+	// of hosts in different time zones sort and compare consistently. Nil means true.
+	UTC *bool
+	// ArchiveWorkers is the number of goroutines reading and compressing the profiles of an archive, 1 by
+	// default. The archives are the same whatever the number of workers.
+	ArchiveWorkers int
+	// MaxRounds stops the profiling, as StopProfile does, after this many ticks when > 0,
+	// e.g. for one-shot profiling in CI.
+	MaxRounds int
+	// ThreadCreateText writes the threadcreate profile in the human readable text format (debug=1).
+	// The profile has little in it: the stacks which created the threads of the process.
+	ThreadCreateText bool
+	// OnArchiveDecision is called on every tick with the decision of the ArchivePolicy and the number of
+	// profiles pending, which helps tuning the policy.
+	OnArchiveDecision func(shouldArchive bool, pendingFiles int)
+	// OnProfileWritten is called with the result of every capture written to StoreDir.
+	OnProfileWritten func(result CaptureResult)
+	// MinArchiveInterval is the minimum time between two archives whatever the ArchivePolicy says,
+	// which prevents archiving on nearly every tick with a low MaxFileNum.
+	MinArchiveInterval time.Duration
+	// PublishExpvar publishes the profiles_total (by type), archives_total and errors_total counters
+	// under the "gin_profile" expvar.
+	PublishExpvar bool
+	// SyncOnClose flushes every profile to the disk before closing it, so that a crash right after
+	// a capture doesn't lose it.
+	SyncOnClose bool
+	// IncrementalArchive appends every profile to a rolling archive as soon as it is closed, rather than
+	// archiving a batch at once, which smooths the I/O. The ArchivePolicy rotates the rolling archive.
+	// It requires Compress, the profiles are removed once their archive is rotated.
+	IncrementalArchive bool
+	// HeapForceGC runs a garbage collection before capturing the heap profile, as WriteHeapProfile does,
+	// so that the in-use numbers are up to date rather than as of the last collection.
+	HeapForceGC bool
+	// ArchiveRetries is the number of times a failed archive is retried, with a backoff doubling from 1s, on
+	// the archiving goroutine and until the profiling stops. The profiles are removed only once archived, a
+	// batch failing every retry is archived with the next one.
+	ArchiveRetries int
+	// ExcludeSelfInGoroutineProfile drops the goroutines of the profiler, those whose stack is entirely
+	// within this package, from the goroutine profile.
+	ExcludeSelfInGoroutineProfile bool
+	// GoroutineTopStacks trims the goroutine profile to the stacks shared by the most goroutines if > 0,
+	// which keeps the profiles of tens of thousands of goroutines small.
+	GoroutineTopStacks int
+	// BlockTopSites trims the block profile to the sites of the longest cumulative blocked time if > 0, which
+	// keeps the profiles of a heavy contention small.
+	BlockTopSites int
+	// SummaryTopFunctions writes a JSON Summary of the cpu and heap profiles next to them if > 0, with their
+	// top functions by flat value, e.g. for a cheap continuous shipping of the numbers.
+	SummaryTopFunctions int
+	// SummaryOnly keeps the summaries of SummaryTopFunctions only, the profiles are removed once summarized.
+	SummaryOnly bool
+	// MaxCPUForCapture skips the cpu profile while the utilization of the host cpus, in (0, 1], is above it,
+	// so that the profiling doesn't add to a saturated system. It is read from /proc/stat on linux.
+	MaxCPUForCapture float64
+	// ScanInterval is how often StoreDir is scanned for the profiles written by others, e.g. a core dump hook,
+	// which are then archived with the captured ones. It requires Compress. The files should be moved into
+	// StoreDir once complete.
+	ScanInterval time.Duration
+	// MinProfileBytes discards the profiles smaller than it, e.g. the goroutine profile of an idle process,
+	// rather than storing and archiving them.
+	MinProfileBytes int64
+	// ProfileAfterGC captures a heap profile after a garbage collection completes, besides the scheduled ones,
+	// at most one per ProfileAfterGCInterval.
+	ProfileAfterGC bool
+	// ProfileAfterGCInterval is the minimum time between the heap profiles of ProfileAfterGC, 10s if not set.
+	ProfileAfterGCInterval time.Duration
+	// MetricTriggers capture their profile, besides the scheduled ones, when their runtime/metrics metric
+	// crosses their threshold, e.g. a trace as the p99 of /sched/latencies:seconds goes above 10ms. They are
+	// checked on every tick.
+	MetricTriggers []MetricTrigger
+	// SequentialCaptures runs the captures of a tick one after the other on the profiling goroutine rather
+	// than each on its own, which bounds the memory they hold to one profile at a time. The duration profiles
+	// then add up, the ticks due meanwhile are skipped.
+	SequentialCaptures bool
+	// ArchiveEntryName names the profile at path in the archives, e.g. relative to the StoreDir root to keep
+	// the partition directories. The name is made relative, it is the base name of path if not set.
+	ArchiveEntryName func(path string) string
+	// ArchiveSink receives the archives if set, e.g. to upload them.
+	ArchiveSink ArchiveSink
+	// ArchiveSinks overrides ArchiveSink for some profile types, whose profiles are archived on their own,
+	// e.g. cpu profiles uploaded while the goroutine ones are kept local with a nil sink.
+	// The rolling archive of IncrementalArchive goes to ArchiveSink.
+	ArchiveSinks map[Profile]ArchiveSink
+	// ArchiveChannel sends the archives to the channel returned by Archives, besides their sink. The archiving
+	// waits for the receiver up to ArchiveChannelTimeout, 1m if not set, or not at all with ArchiveChannelDrop,
+	// and drops the archive if not received, see Status.ArchivesDropped. The final archive of StopProfile is not
+	// sent. It requires Compress.
+	ArchiveChannel        bool
+	ArchiveChannelTimeout time.Duration
+	ArchiveChannelDrop    bool
+	// WriteBufferSize is the size of the buffer the profiles are written to their file through, 32KB by default.
+	WriteBufferSize int
+	// ReproducibleArchives sorts the profiles of an archive by path and writes them with a fixed modification
+	// time, so that archives of the same profiles are byte-identical.
+	ReproducibleArchives bool
+	// EncryptionKey encrypts the archives with AES-GCM if set, it is an AES key of 16, 24 or 32 bytes. The
+	// archives are named with an .enc suffix, e.g. 2020-01-02.zip.enc, and are read with DecryptArchive. The
+	// key is never logged.
+	EncryptionKey []byte
+	// PprofExtension names the profiles in the pprof format, which are gzipped protobuf, with the .pb.gz
+	// extension go tool pprof expects instead of .profile. Trace and the text profiles keep theirs.
+	PprofExtension bool
+	// LeaderCheck is called on every tick if set, the profiles are captured only when it returns true, e.g.
+	// on the leader of a leader election so that a single replica of a cluster is profiled.
+	LeaderCheck func() bool
+	// TraceDuration is how long the trace is recorded for instead of X, traces are much bigger than cpu
+	// profiles. It must be < Y.
+	TraceDuration time.Duration
+	// DutyCycleWarnRatio is the X/Y ratio above which a warning is logged, 0.5 by default, as recording
+	// the cpu profile most of the time amounts to an always-on profiling. 1 never warns.
+	DutyCycleWarnRatio float64
+	// FailOnInertProfiles makes enabling the profiling fail with ErrInertProfile if a profile would be empty
+	// with the current runtime settings, e.g. Mutex without runtime.SetMutexProfileFraction. By default a
+	// warning is logged, as it always is for Block whose rate can't be checked.
+	FailOnInertProfiles bool
+	// RawRetention prunes the oldest profiles of StoreDir when Compress is false, where nothing else removes them.
+	RawRetention RawRetention
 }
 
 type Profile string
 
+// EnableProfile starts the package level profiler, see NewProfiler for independent ones.
 func EnableProfile(opt *Option, profiles ...Profile) error {
+	managerLock.Lock()
+	defer managerLock.Unlock()
 	if manager != nil {
-		return errors.New("cannot call EnableProfile repeatedly")
+		return ErrAlreadyEnabled
 	}
 	err := checkOpt(*opt, profiles)
 	if err != nil {
 		return err
 	}
 	profileOnceLock.Do(func() {
-		manager = &profileManager{
-			Option: opt,
-		}
-		manager.ticker = time.NewTicker(opt.Y)
-		if manager.Compress {
-			manager.archiveDir = filepath.Join(manager.StoreDir, "archive")
-			manager.err = createDirIfNotExists(manager.archiveDir)
-			if manager.FileFormat == nil {
-				manager.FileFormat = defaultFormat
-			}
-			if manager.ArchivePolicy == nil {
-				manager.ArchivePolicy = &FileNumArchivePolicy{}
-			}
-		}
+		manager = newProfileManager(opt)
 	})
 	if manager.err != nil {
+		err = manager.err
+		manager.ticker.Stop()
+		manager = nil
+		profileOnceLock = sync.Once{}
 		return err
 	}
-	go manager.doProfile(profiles...)
+	manager.onStopped = func() {
+		managerLock.Lock()
+		defer managerLock.Unlock()
+		manager = nil
+		profileOnceLock = sync.Once{}
+	}
+	manager.start(profiles)
 	return nil
 }
 
+// newProfileManager sets up a profiler for opt, m.err tells whether it failed.
+func newProfileManager(opt *Option) *profileManager {
+	// the manager changes its own copy, e.g. on SetInterval, not the caller's Option
+	copied := *opt
+	m := &profileManager{
+		Option:      &copied,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		tickerReset: make(chan struct{}, 1),
+		storeDir:    opt.StoreDir,
+		fifo:        isFIFO(opt.StoreDir),
+	}
+	m.ticker = time.NewTicker(opt.Y)
+	if m.Compress {
+		// partitioned StoreDirs get an archive directory per partition, created when archiving
+		if !isPartitioned(m.storeDir) {
+			m.archiveDir = filepath.Join(m.storeDir, "archive")
+			m.err = createDirIfNotExists(m.archiveDir)
+		}
+		if m.ArchivePolicy == nil {
+			m.ArchivePolicy = &FileNumArchivePolicy{}
+		}
+		if m.ArchiveChannel {
+			m.archives = make(chan ArchiveReady)
+		}
+	}
+	if m.FileFormat == nil {
+		m.FileFormat = defaultFormat
+	}
+	return m
+}
+
+// start runs the profiling of profiles.
+func (m *profileManager) start(profiles []Profile) {
+	m.profiles = profiles
+	m.checkDutyCycle(m.Y, m.X)
+	if err := checkInertProfiles(profiles, true); err != nil {
+		m.warnLog(err.Error())
+	}
+	if m.PublishExpvar {
+		publishExpvar()
+	}
+	if m.Compress {
+		m.startArchiver()
+	}
+	m.beat()
+	go m.doProfile()
+	if m.ProfileAfterGC {
+		go m.watchGC()
+	}
+}
+
+// StopProfile stops the periodical profiling started by EnableProfile and archives the pending profiles
+// if Compress is set. The package is always reset afterwards so that EnableProfile can be called again,
+// even if the final archive fails; that error is returned.
+func StopProfile() error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	return m.shutdown()
+}
+
+// shutdown stops the profiling and archives the pending profiles, it returns ErrNotEnabled if already
+// stopped. onStopped is called afterwards whatever happens.
+func (m *profileManager) shutdown() error {
+	if !atomic.CompareAndSwapInt32(&m.stopped, 0, 1) {
+		return ErrNotEnabled
+	}
+	if m.onStopped != nil {
+		defer m.onStopped()
+	}
+	defer m.closeArchives()
+	m.scheduleLock.Lock()
+	m.ticker.Stop()
+	m.scheduleLock.Unlock()
+	close(m.stop)
+	<-m.done
+	// the captures of the last tick end up in the final archive
+	_, x := m.interval()
+	if !m.waitCaptures(x + time.Second) {
+		m.warnLog("stop profile: captures still running, they are left out of the final archive")
+	}
+	if !m.Compress {
+		return nil
+	}
+	m.stopArchiver()
+	if m.IncrementalArchive {
+		_, _, err := m.rotateRolling()
+		return err
+	}
+	collection := m.getFileCollection()
+	if len(collection) == 0 {
+		return nil
+	}
+	_, done, err := m.archiveWithRetries(collection)
+	m.archived(done)
+	return err
+}
+
+// EnableOrReplace is EnableProfile replacing the running profiler, if any, which is stopped as StopProfile
+// does. opt is checked first, so an invalid one leaves the running profiler untouched. The new profiler
+// is running even if the error of the final archive of the previous one is returned.
+func EnableOrReplace(opt *Option, profiles ...Profile) error {
+	if err := checkOpt(*opt, profiles); err != nil {
+		return err
+	}
+	stopErr := StopProfile()
+	if stopErr == ErrNotEnabled {
+		stopErr = nil
+	}
+	if err := EnableProfile(opt, profiles...); err != nil {
+		return err
+	}
+	return stopErr
+}
+
 func checkOpt(opt Option, profiles []Profile) error {
-	if opt.Y <= 0 || opt.X <= 0 {
-		return errors.New("Y or X should not <= 0")
+	if err := checkInterval(opt.Y, opt.X); err != nil {
+		return err
 	}
-	if opt.Y <= opt.X {
-		return errors.New("Y should not <= X")
+
+	if err := checkCPUProfileRate(opt.CPUProfileRate); err != nil {
+		return err
 	}
-	if opt.Y <= 1*time.Second {
-		return errors.New("too frequent profile may impact the performance, Y is suggested to be > 1s")
+
+	if err := checkTraceDuration(opt.TraceDuration, opt.Y); err != nil {
+		return err
 	}
 
-	for _, p := range profiles {
-		if _, ok := profileCollection[p]; !ok {
-			return errors.New(fmt.Sprintf("profile %q not valid", p))
+	if err := checkProfiles(profiles); err != nil {
+		return err
+	}
+
+	if opt.FailOnInertProfiles {
+		// the Block hint is only warned about
+		if err := checkInertProfiles(profiles, false); err != nil {
+			return err
 		}
 	}
-	if len(profiles) == 0 {
-		return errors.New("no profile set")
+
+	if opt.IncrementalArchive && !opt.Compress {
+		return errors.New("IncrementalArchive requires Compress")
+	}
+	if opt.ScanInterval > 0 && !opt.Compress {
+		return errors.New("ScanInterval requires Compress")
+	}
+	if opt.ArchiveChannel && !opt.Compress {
+		return errors.New("ArchiveChannel requires Compress")
+	}
+	if len(opt.EncryptionKey) > 0 {
+		if !opt.Compress {
+			return errors.New("EncryptionKey requires Compress")
+		}
+		if _, err := newArchiveCipher(opt.EncryptionKey); err != nil {
+			return err
+		}
 	}
 
-	return createDirIfNotExists(opt.StoreDir)
+	for _, trigger := range opt.MetricTriggers {
+		if err := trigger.check(); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range opt.ArchiveExclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ArchiveExclude pattern %q not valid: %v", pattern, err)
+		}
+	}
+
+	if isFIFO(opt.StoreDir) {
+		if opt.Compress {
+			return errors.New("profiles written into a FIFO cannot be archived, Compress should not be set")
+		}
+		return nil
+	}
+	return opt.checkStoreDir(opt.StoreDir)
+}
+
+// checkStoreDir creates the directory dir, partitioned or not, and makes sure the profiles can be written in.
+func (opt *Option) checkStoreDir(dir string) error {
+	dir = expandStoreDir(dir, opt.timestamp())
+	if err := createDirIfNotExists(dir); err != nil {
+		return err
+	}
+	return checkWritable(dir)
+}
+
+func checkInterval(y, x time.Duration) error {
+	if y <= 0 || x <= 0 {
+		return invalidInterval("Y or X should not <= 0")
+	}
+	if y <= x {
+		return invalidInterval("Y should not <= X")
+	}
+	if y <= 1*time.Second {
+		return invalidInterval("too frequent profile may impact the performance, Y is suggested to be > 1s")
+	}
+	return nil
+}
+
+func checkTraceDuration(d, y time.Duration) error {
+	if d < 0 {
+		return invalidInterval("TraceDuration should not < 0")
+	}
+	if d >= y {
+		return invalidInterval("Y should not <= TraceDuration")
+	}
+	return nil
 }
 
-func (m *profileManager) doProfile(profiles ...Profile) {
+func checkCPUProfileRate(rate int) error {
+	if rate < 0 || rate > maxCPUProfileRate {
+		return fmt.Errorf("CPUProfileRate should be within [0, %d]", maxCPUProfileRate)
+	}
+	return nil
+}
+
+func (m *profileManager) doProfile() {
+	defer close(m.done)
+	if !m.warmup() {
+		return
+	}
+	rounds := 0
 	for {
-		<-m.ticker.C
-		for _, p := range profiles {
-			switch p {
-			case Cpu, Trace:
-				go m.doDurationProfile(p)
-			case Heap, ThreadCreate, Goroutine, Block, Mutex:
-				go m.doInstantProfile(p)
-			}
+		select {
+		case <-m.tick():
+		case <-m.tickerReset:
+			continue
+		case <-m.stop:
+			return
+		}
+		m.beat()
+		paused := atomic.LoadInt32(&m.paused) == 1 || !m.isLeader()
+		m.overhead.tick(time.Now(), paused)
+		if paused {
+			continue
+		}
+		for _, p := range m.getProfiles() {
+			m.startCapture(p, nil)
 		}
+		m.checkMetricTriggers()
+		m.scanStoreDirIfDue()
 		m.checkArchive()
+		rounds++
+		if m.MaxRounds > 0 && rounds >= m.MaxRounds {
+			go m.autoStop()
+			return
+		}
+	}
+}
+
+// isLeader tells whether this replica captures on this tick, see LeaderCheck.
+func (m *profileManager) isLeader() bool {
+	return m.LeaderCheck == nil || m.LeaderCheck()
+}
+
+// autoStop stops the profiling once the captures of the last round are done, see MaxRounds.
+func (m *profileManager) autoStop() {
+	switch err := m.shutdown(); err {
+	case nil:
+		m.infoLog(fmt.Sprintf("profiling stopped after %d rounds", m.MaxRounds))
+	case ErrNotEnabled:
+		// stopped meanwhile
+	default:
+		m.errorLog("stop profile failed", err)
+	}
+}
+
+// startCapture runs capture(p) as the captures of a tick run, in place with SequentialCaptures and on its
+// own goroutine otherwise, counted by waitCaptures from now on. after is called once it is done, if set.
+func (m *profileManager) startCapture(p Profile, after func()) {
+	done := m.addCapture()
+	run := func() {
+		defer done()
+		if after != nil {
+			defer after()
+		}
+		m.capture(p)
+	}
+	if m.SequentialCaptures {
+		run()
+	} else {
+		go run()
+	}
+}
+
+// syncCapture runs capture(p) in place, counted by waitCaptures.
+func (m *profileManager) syncCapture(p Profile) {
+	defer m.addCapture()()
+	m.capture(p)
+}
+
+// capture does one capture of profile p, doProfile runs it on every tick.
+func (m *profileManager) capture(p Profile) {
+	defer m.recoverCapture(p)
+	switch p {
+	case Cpu, Trace, WallClock:
+		if p == Cpu && m.cpuSaturated() {
+			return
+		}
+		defer m.overhead.spent(time.Now(), m.duration(p))
+		m.doDurationProfile(p)
+	case Heap, ThreadCreate, Goroutine, Block, Mutex, FullGoroutineDump:
+		defer m.overhead.spent(time.Now(), 0)
+		m.doInstantProfile(p)
+	default:
+		if c, ok := customProfile(p); ok {
+			defer m.overhead.spent(time.Now(), 0)
+			m.doCustomProfile(p, c)
+		}
+	}
+}
+
+// recoverCapture logs the panic of a capture, e.g. in a faulty hook, rather than letting it crash the
+// process. It must be deferred by the capture goroutine.
+func (m *profileManager) recoverCapture(p Profile) {
+	if r := recover(); r != nil {
+		m.errorLog(fmt.Sprintf("%s profile panicked", string(p)), fmt.Errorf("%v\n%s", r, debug.Stack()))
+	}
+}
+
+// warmup holds the first profiling tick back by WarmupDelay, it returns false if stopped meanwhile.
+func (m *profileManager) warmup() bool {
+	if m.WarmupDelay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(m.WarmupDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.tick():
+			// still alive, just not profiling yet
+			m.beat()
+		case <-m.tickerReset:
+		case <-timer.C:
+			m.scheduleLock.Lock()
+			m.resetTickerLocked(m.Y)
+			m.scheduleLock.Unlock()
+			return true
+		case <-m.stop:
+			return false
+		}
 	}
 }
 
 func (m *profileManager) doDurationProfile(profile Profile) {
-	filePath := getFilePath(profile, m.StoreDir, m.FileFormat)
+	start := startCapture()
+	x := m.duration(profile)
+	filePath := m.newFilePath(profile)
 	file, err := m.openFile(filePath)
+	if m.skipCapture(err) {
+		return
+	}
 	if err != nil {
 		m.errorLog(fmt.Sprintf("create profile %q failed", filePath), err)
+		m.recordCapture(false)
 		return
 	}
-	defer m.closeFile(file, filePath)
+	succeed := false
+	defer func() {
+		m.finishCapture(profile, file, filePath, start, succeed)
+	}()
+	w := m.bufferFile(file)
 	switch profile {
 	case Cpu:
-		err = pprof.StartCPUProfile(file)
-		if err != nil {
-			m.errorLog("StartCPUProfile failed", err)
-			return
-		}
-		m.infoLog("StartCPUProfile succeed")
-		defer pprof.StopCPUProfile()
+		err = captureCPU(x, w, m.CPUProfileRate)
 	case Trace:
-		err = trace.Start(m.ErrLogOutput)
-		if err != nil {
-			m.errorLog("trace start failed", err)
-			return
-		}
-		m.infoLog("trace.Start succeed")
-		defer trace.Stop()
+		err = CaptureTrace(x, w)
+	case WallClock:
+		err = CaptureWallClock(x, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == ErrTraceActive {
+		// someone else (e.g. go test -trace) owns the trace, it won't go away on the next tick
+		m.errorLogOnce("trace already active", "trace profile failed, retrying quietly", err)
+		return
 	}
-	time.Sleep(m.X)
+	if err != nil {
+		m.errorLog(fmt.Sprintf("%s profile failed", string(profile)), err)
+		return
+	}
+	succeed = true
+	m.infoLog(fmt.Sprintf("%s profile finished", string(profile)))
 }
 
 func (m *profileManager) doInstantProfile(profile Profile) {
-	filePath := getFilePath(profile, m.StoreDir, m.FileFormat)
+	start := startCapture()
+	m.beforeCapture(profile)
+	p := profile.lookup()
+	var data []byte
+	top, value := m.topStacks(profile)
+	if m.SkipDuplicates || m.excludesSelf(profile) || top > 0 {
+		var buf bytes.Buffer
+		if err := p.WriteTo(&buf, m.debug(profile)); err != nil {
+			m.errorLog("write profile failed", err)
+			m.recordCapture(false)
+			return
+		}
+		data = buf.Bytes()
+		if m.excludesSelf(profile) {
+			var err error
+			if data, err = excludeSelf(data); err != nil {
+				m.errorLog("exclude the profiler from the goroutine profile failed", err)
+				m.recordCapture(false)
+				return
+			}
+		}
+		if top > 0 {
+			var err error
+			if data, err = trimStacks(data, top, value); err != nil {
+				m.errorLog(fmt.Sprintf("trim the %s profile failed", string(profile)), err)
+				m.recordCapture(false)
+				return
+			}
+		}
+	}
+	if m.SkipDuplicates && m.isDuplicate(profile, data) {
+		m.infoLog(fmt.Sprintf("%s profile is identical to the previous one, skipped", string(profile)))
+		m.recordCapture(true)
+		return
+	}
+	filePath := m.newFilePath(profile)
 	file, err := m.openFile(filePath)
+	if m.skipCapture(err) {
+		return
+	}
 	if err != nil {
 		m.errorLog("open file failed", err)
+		m.recordCapture(false)
 		return
 	}
-	defer m.closeFile(file, filePath)
-	p := pprof.Lookup(string(profile))
-	err = p.WriteTo(file, 0)
+	succeed := false
+	defer func() {
+		m.finishCapture(profile, file, filePath, start, succeed)
+	}()
+	w := m.bufferFile(file)
+	if data != nil {
+		_, err = w.Write(data)
+	} else {
+		err = p.WriteTo(w, m.debug(profile))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
 	if err != nil {
 		m.errorLog("write profile failed", err)
 		return
 	}
+	succeed = true
 	m.infoLog(fmt.Sprintf("%s profile finished", string(profile)))
 }
 
+// tooSmall tells whether the profile written into file is smaller than MinProfileBytes, and is discarded.
+func (m *profileManager) tooSmall(profile Profile, file *os.File) bool {
+	if m.MinProfileBytes <= 0 || m.fifo {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() >= m.MinProfileBytes {
+		return false
+	}
+	m.infoLog(fmt.Sprintf("%s profile of %d bytes is smaller than %d, discarded", string(profile), info.Size(),
+		m.MinProfileBytes))
+	return true
+}
+
+// finishCapture closes the profile file and records the outcome of the capture.
+func (m *profileManager) finishCapture(profile Profile, file *os.File, filePath string, start captureStart,
+	succeed bool) {
+	result := m.captureResult(profile, file, filePath, start)
+	discarded := succeed && m.tooSmall(profile, file)
+	succeed = m.closeFile(profile, file, filePath, succeed && !discarded)
+	m.checkCaptureTime(profile, start.time)
+	if discarded {
+		m.recordCapture(true)
+		return
+	}
+	written := []string{filePath}
+	if succeed && m.summarizes(profile) {
+		summary, err := m.writeSummary(profile, filePath)
+		switch {
+		case err != nil:
+			m.errorLog(fmt.Sprintf("summarize %s profile failed", string(profile)), err)
+		case m.SummaryOnly:
+			m.dropProfile(filePath)
+			written = []string{summary}
+			result.Path, result.Size = summary, 0
+			if info, err := os.Stat(summary); err == nil {
+				result.Size = info.Size()
+			}
+		default:
+			written = append(written, summary)
+		}
+	}
+	for _, f := range written {
+		if succeed && m.IncrementalArchive && !m.excludedFromArchive(f) {
+			m.appendRolling(f)
+		}
+	}
+	if succeed {
+		m.updateLatest(profile, written[0])
+		m.incProfilesExpvar(profile)
+		if m.OnProfileWritten != nil {
+			m.OnProfileWritten(result)
+		}
+		m.pruneRaw()
+	}
+	m.recordCapture(succeed)
+}
+
 func (m *profileManager) getFileCollection() []string {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.fileCollection
+	// removeCollection shifts the elements, hand out a copy
+	return append([]string(nil), m.fileCollection...)
 }
-func (m *profileManager) closeFile(file *os.File, filePath string) {
+
+// syncFile flushes file to the disk, tests replace it.
+var syncFile = (*os.File).Sync
+
+// closeFile closes the profile file and adds it to the collection, it reports whether it did. The file of a
+// failed capture, possibly truncated, is removed instead so that the previous profile stays the latest.
+func (m *profileManager) closeFile(profile Profile, file *os.File, filePath string, succeed bool) bool {
+	if m.fifo {
+		return m.closeFIFO(file) && succeed
+	}
+	if m.SyncOnClose {
+		if err := syncFile(file); err != nil {
+			m.errorLog(fmt.Sprintf("sync profile %q failed", filePath), err)
+		}
+	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	delete(m.openFiles, filePath)
+	m.markScanned(filePath)
 	if err := file.Close(); err != nil {
 		m.errorLog(fmt.Sprintf("close profile %q failed", filePath), err)
+		succeed = false
+	}
+	if !succeed {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			m.errorLog(fmt.Sprintf("remove failed profile %q failed", filePath), err)
+		}
+		return false
+	}
+	// with IncrementalArchive the file joins the collection once appended to the rolling archive
+	if !m.excludedFromArchive(filePath) && !m.IncrementalArchive {
+		m.fileCollection = append(m.fileCollection, filePath)
+		if m.fileInfos == nil {
+			m.fileInfos = make(map[string]profileFile)
+		}
+		m.fileInfos[filePath] = profileFile{profile: profile, captured: now()}
+	}
+	m.appendIndex(profile, filePath)
+	return true
+}
+
+// updateLatest points StoreDir/latest_<type> at filePath. The link is created under a temporary
+// name and renamed over the old one so readers never see a missing link.
+func (m *profileManager) updateLatest(profile Profile, filePath string) {
+	if !m.WriteLatestSymlink || m.fifo {
 		return
 	}
-	m.fileCollection = append(m.fileCollection, filePath)
+	storeDir, _ := m.dirs()
+	latest := filepath.Join(storeDir, "latest_"+string(profile))
+	tmp := latest + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(filePath), tmp); err != nil {
+		// symlinks are not available everywhere (e.g. windows without privilege), fall back to a copy
+		if err = copyFile(filePath, tmp); err != nil {
+			m.errorLog(fmt.Sprintf("write latest profile of %q failed", profile), err)
+			return
+		}
+	}
+	if err := os.Rename(tmp, latest); err != nil {
+		m.errorLog(fmt.Sprintf("write latest profile of %q failed", profile), err)
+		_ = os.Remove(tmp)
+	}
+}
+
+// profileFile is what is known of a profile of the collection.
+type profileFile struct {
+	profile  Profile
+	captured time.Time
+}
+
+// fileInfo returns what is known of the profile at path, the zero value if nothing.
+func (m *profileManager) fileInfo(path string) profileFile {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.fileInfos[path]
+}
+
+// forgetFiles drops what is known of files, once archived or removed.
+func (m *profileManager) forgetFiles(files []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, f := range files {
+		delete(m.fileInfos, f)
+	}
 }
 
+// restoreCollection puts back files removed from the collection ahead of the others.
+func (m *profileManager) restoreCollection(files []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fileCollection = append(append([]string(nil), files...), m.fileCollection...)
+}
+
+// removeCollection removes the files of oldColl from the collection, the others keep their order.
 func (m *profileManager) removeCollection(oldColl []string) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	currLen := len(m.fileCollection)
-	oldLen := len(oldColl)
-	if currLen == oldLen {
-		m.fileCollection = m.fileCollection[:0]
-	} else if currLen > oldLen {
-		copy(m.fileCollection, m.fileCollection[oldLen:])
-		m.fileCollection = m.fileCollection[:currLen-oldLen]
+	removed := make(map[string]struct{}, len(oldColl))
+	for _, f := range oldColl {
+		removed[f] = struct{}{}
+	}
+	kept := m.fileCollection[:0]
+	for _, f := range m.fileCollection {
+		if _, ok := removed[f]; !ok {
+			kept = append(kept, f)
+		}
 	}
+	m.fileCollection = kept
 }
 func (m *profileManager) removeFiles(c []string) {
 	for _, f := range c {
@@ -238,48 +991,246 @@ func (m *profileManager) removeFiles(c []string) {
 		}
 	}
 }
+
+// bufferFile buffers the writes into the profile file, which saves many small writes to the text and
+// gzipped profiles. The buffer must be flushed before the file is closed.
+func (m *profileManager) bufferFile(file io.Writer) *bufio.Writer {
+	size := m.WriteBufferSize
+	if size <= 0 {
+		size = defaultWriteBufferSize
+	}
+	return bufio.NewWriterSize(file, size)
+}
+
 func (m *profileManager) openFile(filePath string) (*os.File, error) {
-	return os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if m.fifo {
+		return m.openFIFO()
+	}
+	if storeDir, _ := m.dirs(); isPartitioned(storeDir) {
+		if err := createDirIfNotExists(filepath.Dir(filePath)); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	if m.openFiles == nil {
+		m.openFiles = make(map[string]struct{})
+	}
+	m.openFiles[filePath] = struct{}{}
+	m.lock.Unlock()
+	return file, nil
 }
 
-func getFilePath(profile Profile, dir string, f *Format) string {
-	fileName := f.format(time.Now(), profile)
-	return filepath.Join(dir, fileName)
+func getFilePath(profile Profile, dir string, f *Format, t time.Time) string {
+	fileName := f.format(t, profile)
+	return filepath.Join(expandStoreDir(dir, t), fileName)
+}
+
+// pprofPath replaces the .profile extension of path by .pb.gz under PprofExtension if profile is written in
+// the pprof format, which runtime/pprof already gzips. The format of the custom profiles is unknown.
+func (opt *Option) pprofPath(profile Profile, path string) string {
+	if !opt.PprofExtension || profile == Trace || opt.debug(profile) != 0 || strings.HasSuffix(path, pprofExtension) {
+		return path
+	}
+	if _, ok := customProfile(profile); ok {
+		return path
+	}
+	return strings.TrimSuffix(path, ".profile") + pprofExtension
 }
 
 func (m *profileManager) errorLog(msg string, err error) {
-	_, _ = fmt.Fprintf(m.ErrLogOutput, "[GIN][ERROR] %v |%s|error:%s\n",
+	m.incErrorsExpvar()
+	m.counters.error(msg, err)
+	line := fmt.Sprintf("[GIN][ERROR] %v |%s|error:%s",
 		time.Now().Format("2006/01/02 - 15:04:05"), msg, err.Error())
+	m.recentLogs.add(line)
+	_, _ = fmt.Fprintln(m.ErrLogOutput, line)
+}
+
+// errorLogOnce logs a recurring error identified by key at most once per repeatedErrorLogInterval.
+func (m *profileManager) errorLogOnce(key, msg string, err error) {
+	m.lock.Lock()
+	last, ok := m.errorLogTimes[key]
+	now := time.Now()
+	if ok && now.Sub(last) < repeatedErrorLogInterval {
+		m.lock.Unlock()
+		return
+	}
+	if m.errorLogTimes == nil {
+		m.errorLogTimes = make(map[string]time.Time)
+	}
+	m.errorLogTimes[key] = now
+	m.lock.Unlock()
+	m.errorLog(msg, err)
 }
 
 func (m *profileManager) infoLog(msg string) {
-	_, _ = fmt.Fprintf(m.LogOutput, "[GIN][INFO] %v |%s\n",
-		time.Now().Format("2006/01/02 - 15:04:05"), msg)
+	line := fmt.Sprintf("[GIN][INFO] %v |%s", time.Now().Format("2006/01/02 - 15:04:05"), msg)
+	m.recentLogs.add(line)
+	_, _ = fmt.Fprintln(m.LogOutput, line)
 }
 
-func createDirIfNotExists(dir string) error {
-	info, err := os.Stat(dir)
+func (m *profileManager) warnLog(msg string) {
+	line := fmt.Sprintf("[GIN][WARNING] %v |%s", time.Now().Format("2006/01/02 - 15:04:05"), msg)
+	m.recentLogs.add(line)
+	_, _ = fmt.Fprintln(m.LogOutput, line)
+}
+
+// defaultDutyCycleWarnRatio is the default of Option.DutyCycleWarnRatio.
+const defaultDutyCycleWarnRatio = 0.5
+
+// checkDutyCycle warns if the duration profiles are recorded most of the time, see DutyCycleWarnRatio.
+func (m *profileManager) checkDutyCycle(y, x time.Duration) {
+	ratio := m.DutyCycleWarnRatio
+	if ratio <= 0 {
+		ratio = defaultDutyCycleWarnRatio
+	}
+	if float64(x)/float64(y) <= ratio {
+		return
+	}
+	for _, p := range m.getProfiles() {
+		if isDurationProfile(p) {
+			m.warnLog(fmt.Sprintf("X=%v is recorded every Y=%v, the duration profiles run %.0f%% of the time",
+				x, y, float64(x)/float64(y)*100))
+			return
+		}
+	}
+}
+
+// checkCaptureTime warns if the duration profile started at start took longer than Y, e.g. stretched by a
+// slow disk, so that it overlapped the capture of the next tick, which then fails or is delayed in turn.
+func (m *profileManager) checkCaptureTime(profile Profile, start time.Time) {
+	if !isDurationProfile(profile) {
+		return
+	}
+	elapsed := time.Since(start)
+	y, _ := m.interval()
+	if elapsed <= y {
+		return
+	}
+	m.warnLog(fmt.Sprintf("%s profile recorded for %v took %v to capture, longer than Y=%v so it overlapped "+
+		"the next tick, a larger Y is recommended", string(profile), m.duration(profile),
+		elapsed.Round(time.Millisecond), y))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err := os.MkdirAll(dir, 0755)
-			if err != nil {
-				return err
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func createDirIfNotExists(dir string) error {
+	if err := checkDirPath(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// checkDirPath makes sure that the deepest existing one of dir and the components of its path is a directory,
+// the error of one which isn't wraps ErrNotDirectory. The other errors are left to the creation of dir.
+func checkDirPath(dir string) error {
+	dir = filepath.Clean(dir)
+	for path := dir; ; path = filepath.Dir(path) {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			if filepath.Dir(path) == path {
+				return nil
 			}
-		} else {
-			return err
+			continue
+		case info.IsDir():
+			return nil
+		case path == dir:
+			return detailError(ErrNotDirectory, "%q", dir)
+		default:
+			return detailError(ErrNotDirectory, "%q, on the path of %q", path, dir)
 		}
-	} else if !info.IsDir() {
-		return errors.New(fmt.Sprintf("%q is not directory", dir))
 	}
-	return nil
+}
+
+// checkWritable probes dir with a temporary file, so that e.g. a read-only mount is reported upfront
+// rather than by every capture.
+func checkWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return &wrappedError{msg: fmt.Sprintf("%q is not writable: %v", dir, err), err: err}
+	}
+	file.Close()
+	return os.Remove(file.Name())
 }
 
 func (m *profileManager) checkArchive() {
+	if !m.Compress {
+		return
+	}
+	m.archiveLock.Lock()
+	defer m.archiveLock.Unlock()
 	collection := m.getFileCollection()
-	if m.ArchivePolicy.needArchive(collection) {
+	shouldArchive := m.ArchivePolicy.needArchive(collection)
+	if m.OnArchiveDecision != nil {
+		m.OnArchiveDecision(shouldArchive, len(collection))
+	}
+	if !shouldArchive || time.Since(m.lastArchive) < m.MinArchiveInterval {
+		return
+	}
+	m.lastArchive = time.Now()
+	m.ArchivePolicy.archiveRan()
+	if daily, ok := m.ArchivePolicy.(*DailyArchivePolicy); ok && !m.IncrementalArchive {
+		if collection = m.beforeToday(daily, collection); len(collection) == 0 {
+			return
+		}
+	}
+	if m.IncrementalArchive {
+		_, _, _ = m.rotateRolling()
+		return
+	}
+	if m.archiveQueue == nil {
+		// no archiver, e.g. in the tests, the retries wait here
 		m.infoLog(fmt.Sprintf("start to archive files:%v", collection))
-		m.doArchive0(collection)
-		m.removeCollection(collection)
+		// the files left by a failure stay in the collection and are archived with the next batch
+		_, done, _ := m.archiveWithRetries(collection)
+		m.archived(done)
+		return
+	}
+	// out of the collection before the archiver may put them back
+	m.removeCollection(collection)
+	job := archiveJob{collection: collection}
+	if m.BlockOnFullArchiveQueue {
+		m.archiveQueue <- job
+		return
+	}
+	select {
+	case m.archiveQueue <- job:
+	default:
+		// the files stay in the collection and are archived with the next batch
+		m.restoreCollection(collection)
+		m.infoLog("archive queue is full, archive skipped")
+	}
+}
+
+// archived forgets the archived files and removes them unless KeepAfterArchive is set.
+func (m *profileManager) archived(collection []string) {
+	m.removeCollection(collection)
+	m.removeArchivedFiles(collection)
+}
+
+func (m *profileManager) removeArchivedFiles(collection []string) {
+	m.forgetFiles(collection)
+	if !m.KeepAfterArchive {
 		m.removeFiles(collection)
 	}
 }
@@ -0,0 +1,836 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestManager(t *testing.T, opt *Option) *profileManager {
+	if opt.StoreDir == "" {
+		dir, err := ioutil.TempDir("", "profiles")
+		assert.NoError(t, err)
+		opt.StoreDir = dir
+	}
+	if opt.FileFormat == nil {
+		opt.FileFormat = &Format{
+			FileNameFormat: defaultFormat.FileNameFormat,
+			TimeFormat:     defaultFormat.TimeFormat,
+		}
+	}
+	if opt.LogOutput == nil {
+		opt.LogOutput = ioutil.Discard
+	}
+	if opt.ErrLogOutput == nil {
+		opt.ErrLogOutput = ioutil.Discard
+	}
+	m := &profileManager{Option: opt, storeDir: opt.StoreDir}
+	if opt.Compress {
+		m.archiveDir = filepath.Join(opt.StoreDir, "archive")
+		assert.NoError(t, createDirIfNotExists(m.archiveDir))
+		if opt.ArchivePolicy == nil {
+			opt.ArchivePolicy = &FileNumArchivePolicy{}
+		}
+	}
+	return m
+}
+
+// startTestLoop runs the profiling loop of m without the constraints checkOpt puts on Y.
+func startTestLoop(m *profileManager, profiles ...Profile) {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	m.tickerReset = make(chan struct{}, 1)
+	m.ticker = time.NewTicker(m.Y)
+	m.profiles = profiles
+	go m.doProfile()
+}
+
+func stopTestLoop(m *profileManager) {
+	m.scheduleLock.Lock()
+	m.ticker.Stop()
+	m.scheduleLock.Unlock()
+	close(m.stop)
+	<-m.done
+}
+
+// resetForTest stops the profiler a previous test may have left running and resets the package, so that
+// the tests don't depend on each other through the package level profiler.
+func resetForTest() {
+	if m := currentManager(); m != nil {
+		_ = m.shutdown()
+	}
+	managerLock.Lock()
+	defer managerLock.Unlock()
+	manager = nil
+	profileOnceLock = sync.Once{}
+}
+
+func enableTestProfile(t *testing.T, opt *Option, profiles ...Profile) {
+	resetForTest()
+	if opt.StoreDir == "" {
+		dir, err := ioutil.TempDir("", "profiles")
+		assert.NoError(t, err)
+		opt.StoreDir = dir
+	}
+	if opt.Y == 0 {
+		opt.Y = 2 * time.Second
+		opt.X = time.Second
+	}
+	if opt.LogOutput == nil {
+		opt.LogOutput = ioutil.Discard
+	}
+	if opt.ErrLogOutput == nil {
+		opt.ErrLogOutput = ioutil.Discard
+	}
+	assert.NoError(t, EnableProfile(opt, profiles...))
+}
+
+func TestWriteLatestSymlink(t *testing.T) {
+	m := newTestManager(t, &Option{WriteLatestSymlink: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+
+	files := m.getFileCollection()
+	assert.Len(t, files, 2)
+	latest := filepath.Join(m.StoreDir, "latest_heap")
+	target, err := os.Readlink(latest)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Base(files[1]), target)
+
+	want, err := ioutil.ReadFile(files[1])
+	assert.NoError(t, err)
+	got, err := ioutil.ReadFile(latest)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestWriteLatestSymlinkDisabled(t *testing.T) {
+	m := newTestManager(t, &Option{})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	_, err := os.Lstat(filepath.Join(m.StoreDir, "latest_heap"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFailedCaptureRemoved(t *testing.T) {
+	m := newTestManager(t, &Option{X: 50 * time.Millisecond, Compress: true, WriteLatestSymlink: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doDurationProfile(Cpu)
+	files := m.getFileCollection()
+	assert.Len(t, files, 1)
+
+	// the runtime allows a single cpu profile, the next capture fails to start
+	assert.NoError(t, pprof.StartCPUProfile(ioutil.Discard))
+	time.Sleep(5 * time.Millisecond)
+	m.doDurationProfile(Cpu)
+	pprof.StopCPUProfile()
+
+	assert.Equal(t, files, m.getFileCollection())
+	profiles, err := filepath.Glob(filepath.Join(m.StoreDir, "cpu*"))
+	assert.NoError(t, err)
+	assert.Equal(t, files, profiles)
+	target, err := os.Readlink(filepath.Join(m.StoreDir, "latest_cpu"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Base(files[0]), target)
+
+	_, err = m.forceArchive()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Base(files[0])}, zipEntries(t, m.archiveDir))
+}
+
+func TestStopProfileResetsAfterArchiveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := func() *Option {
+		return &Option{
+			Y:            2 * time.Second,
+			X:            time.Second,
+			StoreDir:     dir,
+			Compress:     true,
+			LogOutput:    ioutil.Discard,
+			ErrLogOutput: ioutil.Discard,
+		}
+	}
+
+	assert.NoError(t, EnableProfile(opt(), Heap))
+	manager.doInstantProfile(Heap)
+	// replace the archive directory with a file so that the final archive can't be created
+	assert.NoError(t, os.RemoveAll(manager.archiveDir))
+	assert.NoError(t, ioutil.WriteFile(manager.archiveDir, nil, 0644))
+	assert.Error(t, StopProfile())
+	assert.Nil(t, manager)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "archive")))
+	assert.NoError(t, EnableProfile(opt(), Heap))
+	assert.NoError(t, StopProfile())
+	assert.Error(t, StopProfile())
+}
+
+func TestStopProfileWaitsForCaptures(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		m := newTestManager(t, &Option{Y: time.Hour, X: 300 * time.Millisecond, Compress: true,
+			IncrementalArchive: incremental})
+		startTestLoop(m, Cpu)
+		// the cpu capture of the last tick is still running when the profiling stops
+		m.startCapture(Cpu, nil)
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, m.shutdown())
+
+		profiles, err := filepath.Glob(filepath.Join(m.StoreDir, "cpu_*"))
+		assert.NoError(t, err)
+		assert.Empty(t, profiles)
+		entries := zipEntries(t, m.archiveDir)
+		assert.Len(t, entries, 1)
+		assert.True(t, strings.HasPrefix(entries[0], "cpu_"), entries[0])
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestTraceAlreadyActiveLoggedOnce(t *testing.T) {
+	errLog := new(bytes.Buffer)
+	m := newTestManager(t, &Option{X: 10 * time.Millisecond, ErrLogOutput: errLog})
+	defer os.RemoveAll(m.StoreDir)
+
+	assert.NoError(t, trace.Start(ioutil.Discard))
+	defer trace.Stop()
+	for i := 0; i < 3; i++ {
+		m.doDurationProfile(Trace)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, strings.Count(errLog.String(), "[GIN][ERROR]"))
+	assert.Contains(t, errLog.String(), ErrTraceActive.Error())
+
+	// a minute later it is reported again
+	m.errorLogTimes["trace already active"] = time.Now().Add(-repeatedErrorLogInterval)
+	m.doDurationProfile(Trace)
+	assert.Equal(t, 2, strings.Count(errLog.String(), "[GIN][ERROR]"))
+}
+
+func TestCapturePanicRecovered(t *testing.T) {
+	errLog := new(bytes.Buffer)
+	hookPanicked := false
+	m := newTestManager(t, &Option{
+		Compress:           true,
+		IncrementalArchive: true,
+		ErrLogOutput:       errLog,
+		ArchiveEntryName: func(path string) string {
+			if !hookPanicked {
+				hookPanicked = true
+				panic("faulty hook")
+			}
+			return filepath.Base(path)
+		},
+	})
+	defer os.RemoveAll(m.StoreDir)
+	defer m.closeRollingLocked()
+
+	for i := 0; i < 2; i++ {
+		m.startCapture(Heap, nil)
+		assert.True(t, m.waitCaptures(time.Second))
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Contains(t, errLog.String(), "heap profile panicked|error:faulty hook")
+	assert.Equal(t, 1, strings.Count(errLog.String(), "[GIN][ERROR]"))
+	// the profiler goes on after the panic
+	assert.Len(t, m.getFileCollection(), 2)
+}
+
+func TestKeepAfterArchive(t *testing.T) {
+	for _, keep := range []bool{true, false} {
+		m := newTestManager(t, &Option{
+			Compress:         true,
+			KeepAfterArchive: keep,
+			ArchivePolicy:    &FileNumArchivePolicy{MaxFileNum: 2},
+		})
+		m.doInstantProfile(Heap)
+		m.doInstantProfile(Goroutine)
+		collection := m.getFileCollection()
+		m.checkArchive()
+
+		archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.zip"))
+		assert.NoError(t, err)
+		assert.Len(t, archives, 1)
+		assert.Empty(t, m.getFileCollection())
+		for _, f := range collection {
+			_, err = os.Stat(f)
+			assert.Equal(t, keep, err == nil)
+		}
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestWriteBufferFlushed(t *testing.T) {
+	// the buffer is larger than the profiles, nothing reaches the file until flushed
+	m := newTestManager(t, &Option{WriteBufferSize: 16 << 20})
+	defer os.RemoveAll(m.StoreDir)
+
+	for _, p := range []Profile{Heap, Goroutine} {
+		m.doInstantProfile(p)
+	}
+	files := m.getFileCollection()
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		file, err := os.Open(f)
+		assert.NoError(t, err)
+		_, err = profile.Parse(file)
+		assert.NoError(t, err)
+		file.Close()
+	}
+}
+
+// writeCounter counts the writes into the file, which are a syscall each.
+type writeCounter struct {
+	*os.File
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.File.Write(p)
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	file, err := ioutil.TempFile("", "profile")
+	assert.NoError(b, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	m := &profileManager{Option: &Option{}}
+	p := pprof.Lookup(string(Goroutine))
+
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%v", buffered), func(b *testing.B) {
+			counter := &writeCounter{File: file}
+			for i := 0; i < b.N; i++ {
+				if buffered {
+					w := m.bufferFile(counter)
+					assert.NoError(b, p.WriteTo(w, 1))
+					assert.NoError(b, w.Flush())
+				} else {
+					assert.NoError(b, p.WriteTo(counter, 1))
+				}
+			}
+			// testing.B.ReportMetric needs go1.13
+			b.Logf("%.2f writes/op", float64(counter.writes)/float64(b.N))
+		})
+	}
+}
+
+func TestWarmupDelay(t *testing.T) {
+	m := newTestManager(t, &Option{Y: 200 * time.Millisecond, WarmupDelay: 500 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+	startTestLoop(m, Heap)
+	defer stopTestLoop(m)
+
+	// the first tick comes at WarmupDelay + Y
+	time.Sleep(600 * time.Millisecond)
+	assert.Empty(t, m.getFileCollection())
+	time.Sleep(500 * time.Millisecond)
+	assert.NotEmpty(t, m.getFileCollection())
+}
+
+func TestBackgroundArchiver(t *testing.T) {
+	metrics := &slowMetrics{delay: time.Second}
+	m := newTestManager(t, &Option{
+		Y:             100 * time.Millisecond,
+		Compress:      true,
+		ArchivePolicy: &FileNumArchivePolicy{MaxFileNum: 1},
+		Metrics:       metrics,
+	})
+	defer os.RemoveAll(m.StoreDir)
+	m.startArchiver()
+	startTestLoop(m, Heap)
+
+	// the first archive blocks the archiver for a second, the ticks must go on meanwhile
+	time.Sleep(650 * time.Millisecond)
+	stopTestLoop(m)
+	metrics.lock.Lock()
+	assert.Empty(t, metrics.archiveDurations)
+	metrics.lock.Unlock()
+	assert.True(t, len(m.getFileCollection()) >= 3)
+
+	m.stopArchiver()
+	archives, err := filepath.Glob(filepath.Join(m.archiveDir, "*.zip"))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+}
+
+func TestStoreDirNotWritable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write into read-only directories")
+	}
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Chmod(dir, 0555))
+	defer os.Chmod(dir, 0755)
+
+	err = EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir}, Heap)
+	wrapped, ok := err.(*wrappedError)
+	if assert.True(t, ok, err) {
+		assert.True(t, os.IsPermission(wrapped.Unwrap()), err)
+	}
+	assert.Contains(t, err.Error(), "is not writable")
+	assert.Nil(t, manager)
+}
+
+func TestStoreDirNotDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	storeDir := filepath.Join(dir, "store")
+	assert.NoError(t, os.Mkdir(storeDir, 0755))
+	archive := filepath.Join(storeDir, "archive")
+	assert.NoError(t, ioutil.WriteFile(archive, nil, 0644))
+
+	for _, c := range []struct {
+		opt Option
+		msg string
+	}{
+		{Option{StoreDir: file}, fmt.Sprintf("not a directory: %q", file)},
+		{Option{StoreDir: filepath.Join(file, "sub")},
+			fmt.Sprintf("not a directory: %q, on the path of %q", file, filepath.Join(file, "sub"))},
+		{Option{StoreDir: storeDir, Compress: true}, fmt.Sprintf("not a directory: %q", archive)},
+	} {
+		c.opt.Y, c.opt.X = 2*time.Second, time.Second
+		err := EnableProfile(&c.opt, Heap)
+		assert.True(t, IsError(err, ErrNotDirectory), "%v", err)
+		assert.EqualError(t, err, c.msg)
+		assert.Nil(t, manager)
+	}
+}
+
+func TestMaxRounds(t *testing.T) {
+	m := newTestManager(t, &Option{Y: 100 * time.Millisecond, MaxRounds: 3})
+	defer os.RemoveAll(m.StoreDir)
+	managerLock.Lock()
+	manager = m
+	managerLock.Unlock()
+	stopped := make(chan struct{})
+	m.onStopped = func() {
+		managerLock.Lock()
+		defer managerLock.Unlock()
+		manager = nil
+		close(stopped)
+	}
+	startTestLoop(m, Heap)
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("profiling goroutine didn't stop")
+	}
+	assert.Nil(t, currentManager())
+	files, err := filepath.Glob(filepath.Join(m.StoreDir, "heap_*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Equal(t, ErrNotEnabled, StopProfile())
+}
+
+func TestLeaderCheck(t *testing.T) {
+	var leader int32
+	m := newTestManager(t, &Option{Y: 50 * time.Millisecond, LeaderCheck: func() bool {
+		return atomic.LoadInt32(&leader) == 1
+	}})
+	defer os.RemoveAll(m.StoreDir)
+	startTestLoop(m, Heap)
+	defer stopTestLoop(m)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, m.getFileCollection())
+
+	atomic.StoreInt32(&leader, 1)
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&leader, 0)
+	m.waitCaptures(time.Second)
+	captured := len(m.getFileCollection())
+	assert.True(t, captured > 0)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, m.getFileCollection(), captured)
+}
+
+func TestTraceDuration(t *testing.T) {
+	m := newTestManager(t, &Option{Y: 2 * time.Second, X: 300 * time.Millisecond,
+		TraceDuration: 100 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+
+	elapsed := make(map[Profile]time.Duration)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range []Profile{Cpu, Trace} {
+		wg.Add(1)
+		go func(p Profile) {
+			defer wg.Done()
+			start := time.Now()
+			m.doDurationProfile(p)
+			lock.Lock()
+			elapsed[p] = time.Since(start)
+			lock.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	assert.Len(t, m.getFileCollection(), 2)
+	assert.True(t, elapsed[Cpu] >= 300*time.Millisecond, elapsed[Cpu])
+	assert.True(t, elapsed[Trace] >= 100*time.Millisecond && elapsed[Trace] < 250*time.Millisecond,
+		elapsed[Trace])
+
+	err := checkOpt(Option{Y: 2 * time.Second, X: time.Second, TraceDuration: 2 * time.Second}, []Profile{Trace})
+	assert.True(t, IsError(err, ErrInvalidInterval))
+	err = checkOpt(Option{Y: 2 * time.Second, X: time.Second, TraceDuration: -time.Second}, []Profile{Trace})
+	assert.True(t, IsError(err, ErrInvalidInterval))
+}
+
+func TestEnableProfileCycles(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		opt := &Option{Compress: true}
+		enableTestProfile(t, opt, Heap)
+		manager.doInstantProfile(Heap)
+		assert.Len(t, manager.getFileCollection(), 1, "cycle %d", i)
+		assert.NoError(t, StopProfile(), "cycle %d", i)
+		assert.Nil(t, manager)
+		zips, err := filepath.Glob(filepath.Join(opt.StoreDir, "archive", "*.zip"))
+		assert.NoError(t, err)
+		assert.Len(t, zips, 1, "cycle %d", i)
+		os.RemoveAll(opt.StoreDir)
+	}
+
+	// a profiler left running is stopped by the next test
+	opt := &Option{}
+	enableTestProfile(t, opt, Heap)
+	defer os.RemoveAll(opt.StoreDir)
+	resetForTest()
+	assert.Nil(t, manager)
+	assert.Equal(t, ErrNotEnabled, StopProfile())
+}
+
+func TestConcurrentEnableProfile(t *testing.T) {
+	resetForTest()
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var enabled, alreadyEnabled int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir,
+				LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}, Heap)
+			switch err {
+			case nil:
+				atomic.AddInt32(&enabled, 1)
+			case ErrAlreadyEnabled:
+				atomic.AddInt32(&alreadyEnabled, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), enabled)
+	assert.Equal(t, int32(19), alreadyEnabled)
+	assert.NoError(t, StopProfile())
+
+	// StopProfile and the other package level functions racing EnableProfile see it enabled or not, never
+	// half way
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir,
+				LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}, Heap)
+			if err != nil && err != ErrAlreadyEnabled {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := StopProfile(); err != nil && err != ErrNotEnabled {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := GetStatus(); err != nil && err != ErrNotEnabled {
+				t.Error(err)
+			}
+			if err := SetInterval(3*time.Second, time.Second); err != nil && err != ErrNotEnabled {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := StopProfile(); err != nil && err != ErrNotEnabled {
+		t.Error(err)
+	}
+	assert.Nil(t, currentManager())
+}
+
+func TestEnableOrReplace(t *testing.T) {
+	first := &Option{Y: 2 * time.Second, X: time.Second}
+	enableTestProfile(t, first, Heap)
+	defer os.RemoveAll(first.StoreDir)
+	assert.Equal(t, ErrAlreadyEnabled, EnableProfile(first, Heap))
+
+	second := &Option{Y: 3 * time.Second, X: time.Second, LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}
+	second.StoreDir = filepath.Join(first.StoreDir, "second")
+	assert.Error(t, EnableOrReplace(second))
+	assert.Equal(t, first.StoreDir, manager.StoreDir)
+
+	assert.NoError(t, EnableOrReplace(second, Goroutine))
+	assert.Equal(t, second.StoreDir, manager.StoreDir)
+	assert.Equal(t, []Profile{Goroutine}, manager.getProfiles())
+	y, _ := manager.interval()
+	assert.Equal(t, 3*time.Second, y)
+	assert.NoError(t, StopProfile())
+}
+
+func TestSeqFileName(t *testing.T) {
+	m := newTestManager(t, &Option{FileFormat: &Format{FileNameFormat: "{type}_{seq}.pb.gz"}})
+	defer os.RemoveAll(m.StoreDir)
+
+	// no need to wait between the captures, the names don't depend on the time
+	for i := 0; i < 3; i++ {
+		m.doInstantProfile(Heap)
+		m.doInstantProfile(Goroutine)
+	}
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 6)
+	last := 0
+	for i, f := range collection {
+		var seq int
+		name := filepath.Base(f)
+		profile := []Profile{Heap, Goroutine}[i%2]
+		_, err := fmt.Sscanf(strings.TrimPrefix(name, string(profile)+"_"), "%06d.pb.gz", &seq)
+		assert.NoError(t, err, name)
+		assert.True(t, seq > last, name)
+		last = seq
+	}
+}
+
+func TestPprofExtension(t *testing.T) {
+	m := newTestManager(t, &Option{PprofExtension: true, ThreadCreateText: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(ThreadCreate)
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 2)
+	assert.True(t, strings.HasSuffix(collection[0], ".pb.gz"), collection[0])
+	assert.True(t, strings.HasSuffix(collection[1], ".profile"), collection[1])
+
+	// a .pb.gz is a gzip stream of the protobuf profile
+	file, err := os.Open(collection[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	p, err := profile.ParseData(data)
+	assert.NoError(t, err)
+	assert.NoError(t, p.CheckValid())
+	assert.Equal(t, "inuse_space", p.SampleType[len(p.SampleType)-1].Type)
+}
+
+func TestMinProfileBytes(t *testing.T) {
+	var idle bytes.Buffer
+	assert.NoError(t, pprof.Lookup(string(Goroutine)).WriteTo(&idle, 0))
+	log := new(bytes.Buffer)
+	m := newTestManager(t, &Option{MinProfileBytes: int64(idle.Len() * 2), LogOutput: log})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Goroutine)
+	assert.Empty(t, m.getFileCollection())
+	assert.Contains(t, log.String(), "goroutine profile of")
+	files, err := filepath.Glob(filepath.Join(m.StoreDir, "*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&m.failures))
+
+	// goroutines of distinct labels are distinct samples, which make a busy process' profile much bigger
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 500; i++ {
+		labels := pprof.Labels("request", fmt.Sprintf("%x", rand.Int63()))
+		go pprof.Do(context.Background(), labels, func(context.Context) { <-release })
+	}
+	time.Sleep(10 * time.Millisecond)
+	m.doInstantProfile(Goroutine)
+	assert.Len(t, m.getFileCollection(), 1)
+}
+
+func TestFileNameSanitized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, f := range []*Format{
+		{FileNameFormat: "{type}_{timestamp}.profile", TimeFormat: "20060102"},
+		{FileNameFormat: "{type}_{timestamp}.profile", TimeFormat: "20060102", Replacement: "-"},
+	} {
+		name := f.format(ts, "cpu/../tenant\n")
+		assert.NotContains(t, name, "/")
+		assert.NotContains(t, name, "\n")
+		path := getFilePath("cpu/../tenant\n", dir, f, ts)
+		assert.Equal(t, dir, filepath.Dir(path))
+		file, err := os.Create(path)
+		assert.NoError(t, err)
+		file.Close()
+	}
+	assert.Equal(t, "cpu-..-tenant", (&Format{FileNameFormat: "{type}", Replacement: "-"}).format(ts, "cpu/../tenant"))
+}
+
+func TestIndependentProfilers(t *testing.T) {
+	newProfiler := func(y time.Duration, profiles ...Profile) *Profiler {
+		dir, err := ioutil.TempDir("", "profiles")
+		assert.NoError(t, err)
+		opt := &Option{Y: y, X: time.Second, StoreDir: dir, LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}
+		p, err := NewProfiler(opt, profiles...)
+		assert.NoError(t, err)
+		return p
+	}
+	fast := newProfiler(1100*time.Millisecond, Goroutine)
+	defer os.RemoveAll(fast.m.StoreDir)
+	slow := newProfiler(time.Hour, Heap)
+	defer os.RemoveAll(slow.m.StoreDir)
+	assert.Nil(t, manager)
+
+	time.Sleep(1200 * time.Millisecond)
+	goroutines, err := filepath.Glob(filepath.Join(fast.m.StoreDir, "goroutine_*"))
+	assert.NoError(t, err)
+	assert.Len(t, goroutines, 1)
+	others, err := ioutil.ReadDir(slow.m.StoreDir)
+	assert.NoError(t, err)
+	assert.Empty(t, others)
+
+	assert.NoError(t, fast.Stop())
+	assert.Equal(t, ErrNotEnabled, fast.Stop())
+	healthy, err := slow.Healthy()
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+	assert.NoError(t, slow.Stop())
+}
+
+func TestSyncOnClose(t *testing.T) {
+	defer func(f func(*os.File) error) {
+		syncFile = f
+	}(syncFile)
+	var synced []string
+	syncFile = func(file *os.File) error {
+		synced = append(synced, file.Name())
+		return file.Sync()
+	}
+
+	for _, sync := range []bool{false, true} {
+		synced = nil
+		m := newTestManager(t, &Option{SyncOnClose: sync})
+		m.doInstantProfile(Heap)
+		if sync {
+			assert.Equal(t, m.getFileCollection(), synced)
+		} else {
+			assert.Empty(t, synced)
+		}
+		os.RemoveAll(m.StoreDir)
+	}
+}
+
+func TestCaptureLongerThanY(t *testing.T) {
+	defer func(f func(*os.File) error) {
+		syncFile = f
+	}(syncFile)
+	syncFile = func(file *os.File) error {
+		// a slow disk
+		time.Sleep(150 * time.Millisecond)
+		return file.Sync()
+	}
+	log := new(bytes.Buffer)
+	m := newTestManager(t, &Option{Y: 100 * time.Millisecond, X: 50 * time.Millisecond, SyncOnClose: true,
+		LogOutput: log})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	assert.NotContains(t, log.String(), "longer than Y")
+	m.doDurationProfile(Cpu)
+	assert.Contains(t, log.String(), "cpu profile recorded for 50ms took")
+	assert.Contains(t, log.String(), "longer than Y=100ms so it overlapped the next tick, a larger Y is recommended")
+}
+
+// loopProfile records whether it is written on the profiling goroutine.
+type loopProfile struct {
+	lock   *sync.Mutex
+	onLoop *[]bool
+}
+
+func (loopProfile) Name() string {
+	return "loop"
+}
+
+func (l loopProfile) WriteProfile(w io.Writer) error {
+	buf := make([]byte, 64<<10)
+	stack := string(buf[:runtime.Stack(buf, false)])
+	if i := strings.Index(stack, "\ncreated by "); i >= 0 {
+		stack = stack[:i]
+	}
+	l.lock.Lock()
+	*l.onLoop = append(*l.onLoop, strings.Contains(stack, ".doProfile("))
+	l.lock.Unlock()
+	_, err := io.WriteString(w, "loop\n")
+	return err
+}
+
+func TestSequentialCaptures(t *testing.T) {
+	var lock sync.Mutex
+	var onLoop []bool
+	assert.NoError(t, RegisterProfile(loopProfile{&lock, &onLoop}))
+	defer func() {
+		customProfileLock.Lock()
+		delete(customProfiles, "loop")
+		customProfileLock.Unlock()
+	}()
+
+	for _, sequential := range []bool{false, true} {
+		onLoop = nil
+		m := newTestManager(t, &Option{Y: 20 * time.Millisecond, SequentialCaptures: sequential})
+		startTestLoop(m, "loop", Heap)
+		time.Sleep(70 * time.Millisecond)
+		stopTestLoop(m)
+		assert.True(t, m.waitCaptures(time.Second))
+
+		lock.Lock()
+		assert.True(t, len(onLoop) >= 2, onLoop)
+		for _, loop := range onLoop {
+			assert.Equal(t, sequential, loop)
+		}
+		lock.Unlock()
+		assert.Len(t, m.getFileCollection(), 2*len(onLoop))
+		os.RemoveAll(m.StoreDir)
+	}
+}
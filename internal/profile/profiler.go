@@ -0,0 +1,79 @@
+package profile
+
+import "time"
+
+// Profiler is a periodical profiler with its own Option, ticker and profiles, independent of the package
+// level one started by EnableProfile, e.g. a fast goroutine only profiler next to a slow cpu one.
+// The runtime allows a single cpu profile and trace at a time though, whatever the number of profilers.
+type Profiler struct {
+	m *profileManager
+}
+
+// NewProfiler starts a Profiler of profiles as EnableProfile does.
+func NewProfiler(opt *Option, profiles ...Profile) (*Profiler, error) {
+	if err := checkOpt(*opt, profiles); err != nil {
+		return nil, err
+	}
+	m := newProfileManager(opt)
+	if m.err != nil {
+		m.ticker.Stop()
+		return nil, m.err
+	}
+	m.start(profiles)
+	return &Profiler{m: m}, nil
+}
+
+// Stop is StopProfile for p, it returns ErrNotEnabled if p is already stopped.
+func (p *Profiler) Stop() error {
+	return p.m.shutdown()
+}
+
+// SetInterval is SetInterval for p.
+func (p *Profiler) SetInterval(y, x time.Duration) error {
+	return p.m.reconfigureInterval(y, x)
+}
+
+// Reconfigure is Reconfigure for p.
+func (p *Profiler) Reconfigure(profiles ...Profile) error {
+	return p.m.reconfigure(profiles)
+}
+
+// SetStoreDir is SetStoreDir for p.
+func (p *Profiler) SetStoreDir(dir string) error {
+	return p.m.setStoreDir(dir)
+}
+
+// Pause is Pause for p.
+func (p *Profiler) Pause() {
+	p.m.pause(true)
+}
+
+// Resume is Resume for p.
+func (p *Profiler) Resume() {
+	p.m.pause(false)
+}
+
+// ForceArchive is ForceArchive for p.
+func (p *Profiler) ForceArchive() ([]string, error) {
+	return p.m.forceArchive()
+}
+
+// Healthy is Healthy for p.
+func (p *Profiler) Healthy() (bool, error) {
+	return p.m.healthy()
+}
+
+// EstimateOverhead is EstimateOverhead for p.
+func (p *Profiler) EstimateOverhead() Overhead {
+	return p.m.overhead.estimate()
+}
+
+// Status is GetStatus for p.
+func (p *Profiler) Status() Status {
+	return p.m.status()
+}
+
+// Info returns the configuration of p, with the defaults resolved.
+func (p *Profiler) Info() ProfileInfo {
+	return p.m.info()
+}
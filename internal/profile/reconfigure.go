@@ -0,0 +1,248 @@
+package profile
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetInterval changes Y and X of the running profiler, the next tick happens y from now.
+// Running captures are given Option.ReconfigureGrace to finish first.
+func SetInterval(y, x time.Duration) error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	return m.reconfigureInterval(y, x)
+}
+
+func (m *profileManager) reconfigureInterval(y, x time.Duration) error {
+	if err := checkInterval(y, x); err != nil {
+		return err
+	}
+	if err := checkTraceDuration(m.TraceDuration, y); err != nil {
+		return err
+	}
+	m.checkDutyCycle(y, x)
+	m.setInterval(y, x)
+	return nil
+}
+
+// Reconfigure replaces the profiles captured by the running profiler from the next tick on.
+// Running captures are given Option.ReconfigureGrace to finish first.
+func Reconfigure(profiles ...Profile) error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	return m.reconfigure(profiles)
+}
+
+func (m *profileManager) reconfigure(profiles []Profile) error {
+	if err := checkProfiles(profiles); err != nil {
+		return err
+	}
+	m.setProfiles(profiles)
+	return nil
+}
+
+// SetConfig replaces the profiles and Y and X of the running profiler at once, nothing is changed if any
+// of them is invalid. Nil profiles and zero y or x keep the current ones.
+func SetConfig(profiles []Profile, y, x time.Duration) error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	return m.setConfig(profiles, y, x)
+}
+
+func (m *profileManager) setConfig(profiles []Profile, y, x time.Duration) error {
+	if profiles != nil {
+		if err := checkProfiles(profiles); err != nil {
+			return err
+		}
+	}
+	currentY, currentX := m.interval()
+	if y == 0 {
+		y = currentY
+	}
+	if x == 0 {
+		x = currentX
+	}
+	if y != currentY || x != currentX {
+		if err := m.reconfigureInterval(y, x); err != nil {
+			return err
+		}
+	}
+	if profiles != nil {
+		m.setProfiles(profiles)
+	}
+	return nil
+}
+
+// SetStoreDir switches the running profiler to the directory dir, e.g. a freshly mounted volume, which is
+// created if needed. The next captures are written into dir, and the next archives go to its archive
+// directory, the pending profiles of the previous one included. A FIFO StoreDir can't be switched.
+func SetStoreDir(dir string) error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	return m.setStoreDir(dir)
+}
+
+func (m *profileManager) setStoreDir(dir string) error {
+	if dir == "" {
+		return errors.New("StoreDir should not be empty")
+	}
+	if m.fifo || isFIFO(dir) {
+		return errors.New("a FIFO StoreDir cannot be switched")
+	}
+	if err := m.checkStoreDir(dir); err != nil {
+		return err
+	}
+	var archiveDir string
+	if m.Compress && !isPartitioned(dir) {
+		archiveDir = filepath.Join(dir, "archive")
+		if err := createDirIfNotExists(archiveDir); err != nil {
+			return err
+		}
+	}
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	m.storeDir, m.archiveDir = dir, archiveDir
+	return nil
+}
+
+// dirs returns StoreDir and the archive directory, which SetStoreDir changes.
+func (m *profileManager) dirs() (storeDir, archiveDir string) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	return m.storeDir, m.archiveDir
+}
+
+// Pause makes the running profiler skip its ticks until Resume, e.g. during a known noisy batch job.
+// The ticker keeps running, so that the captures resume on the same schedule.
+func Pause() error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	m.pause(true)
+	return nil
+}
+
+// Resume undoes Pause, the next tick captures again.
+func Resume() error {
+	m := currentManager()
+	if m == nil {
+		return ErrNotEnabled
+	}
+	m.pause(false)
+	return nil
+}
+
+func (m *profileManager) pause(paused bool) {
+	if paused {
+		atomic.StoreInt32(&m.paused, 1)
+	} else {
+		atomic.StoreInt32(&m.paused, 0)
+	}
+}
+
+func (m *profileManager) setInterval(y, x time.Duration) {
+	m.waitCaptures(m.ReconfigureGrace)
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	m.Y, m.X = y, x
+	m.resetTickerLocked(y)
+}
+
+func (m *profileManager) setProfiles(profiles []Profile) {
+	m.waitCaptures(m.ReconfigureGrace)
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	m.profiles = profiles
+}
+
+// resetTickerLocked replaces the ticker with one ticking every y from now, time.Ticker.Reset needs go1.15.
+// m.scheduleLock must be held.
+func (m *profileManager) resetTickerLocked(y time.Duration) {
+	m.ticker.Stop()
+	m.ticker = time.NewTicker(y)
+	select {
+	case m.tickerReset <- struct{}{}:
+	default:
+	}
+}
+
+// tick returns the channel of the current ticker.
+func (m *profileManager) tick() <-chan time.Time {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	return m.ticker.C
+}
+
+func (m *profileManager) interval() (y, x time.Duration) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	return m.Y, m.X
+}
+
+// duration is how long the duration profile p is recorded for.
+func (m *profileManager) duration(p Profile) time.Duration {
+	if p == Trace && m.TraceDuration > 0 {
+		return m.TraceDuration
+	}
+	_, x := m.interval()
+	return x
+}
+
+func (m *profileManager) getProfiles() []Profile {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	return m.profiles
+}
+
+// addCapture counts a running capture for waitCaptures, done must be called once it is finished.
+func (m *profileManager) addCapture() (done func()) {
+	m.captureLock.Lock()
+	defer m.captureLock.Unlock()
+	if m.captures == nil {
+		m.captures = new(sync.WaitGroup)
+	}
+	captures := m.captures
+	captures.Add(1)
+	return captures.Done
+}
+
+// waitCaptures waits up to grace for the running captures to finish and reports whether they did.
+func (m *profileManager) waitCaptures(grace time.Duration) bool {
+	// the captures started from now on are counted by a new WaitGroup, which also waits for the running
+	// ones so that concurrent waitCaptures don't miss them
+	m.captureLock.Lock()
+	running := m.captures
+	next := new(sync.WaitGroup)
+	next.Add(1)
+	m.captures = next
+	m.captureLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer next.Done()
+		if running != nil {
+			running.Wait()
+		}
+		close(done)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
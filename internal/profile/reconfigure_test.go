@@ -0,0 +1,150 @@
+package profile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconfigureGrace(t *testing.T) {
+	m := newTestManager(t, &Option{
+		Y:                100 * time.Millisecond,
+		X:                50 * time.Millisecond,
+		ReconfigureGrace: 5 * time.Second,
+	})
+	defer os.RemoveAll(m.StoreDir)
+	startTestLoop(m, Cpu)
+	defer stopTestLoop(m)
+	m.setInterval(2*time.Second, 500*time.Millisecond)
+
+	// the next cpu capture runs from 2s to 2.5s from now, reconfigure in the middle of it
+	time.Sleep(2200 * time.Millisecond)
+	start := time.Now()
+	m.setProfiles([]Profile{Heap})
+	assert.True(t, time.Since(start) > 100*time.Millisecond)
+	assert.True(t, m.waitCaptures(10*time.Millisecond))
+	assert.Equal(t, []Profile{Heap}, m.getProfiles())
+
+	collection := m.getFileCollection()
+	assert.NotEmpty(t, collection)
+	file, err := os.Open(collection[len(collection)-1])
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+	assert.True(t, p.DurationNanos >= int64(500*time.Millisecond))
+}
+
+func TestReconfigureNotEnabled(t *testing.T) {
+	assert.Equal(t, ErrNotEnabled, Reconfigure(Heap))
+	assert.Equal(t, ErrNotEnabled, SetInterval(2*time.Second, time.Second))
+}
+
+func TestReconfigure(t *testing.T) {
+	enableTestProfile(t, &Option{}, Heap)
+	defer os.RemoveAll(manager.StoreDir)
+	defer StopProfile()
+
+	assert.Error(t, Reconfigure())
+	assert.NoError(t, Reconfigure(Goroutine, Mutex))
+	assert.Equal(t, []Profile{Goroutine, Mutex}, manager.getProfiles())
+	assert.Error(t, SetInterval(time.Second, 2*time.Second))
+	assert.NoError(t, SetInterval(3*time.Second, time.Second))
+	y, x := manager.interval()
+	assert.Equal(t, 3*time.Second, y)
+	assert.Equal(t, time.Second, x)
+}
+
+func TestSetConfig(t *testing.T) {
+	assert.Equal(t, ErrNotEnabled, SetConfig([]Profile{Heap}, 0, 0))
+	enableTestProfile(t, &Option{}, Heap)
+	defer os.RemoveAll(manager.StoreDir)
+	defer StopProfile()
+	y, x := manager.interval()
+
+	// nothing is applied unless everything is valid
+	assert.Error(t, SetConfig([]Profile{Goroutine}, time.Second, 2*time.Second))
+	assert.Error(t, SetConfig([]Profile{"nope"}, 3*time.Second, time.Second))
+	assert.Equal(t, []Profile{Heap}, manager.getProfiles())
+	newY, newX := manager.interval()
+	assert.Equal(t, y, newY)
+	assert.Equal(t, x, newX)
+
+	assert.NoError(t, SetConfig([]Profile{Goroutine}, 3*time.Second, 0))
+	assert.Equal(t, []Profile{Goroutine}, manager.getProfiles())
+	newY, newX = manager.interval()
+	assert.Equal(t, 3*time.Second, newY)
+	assert.Equal(t, x, newX)
+}
+
+func TestSetStoreDir(t *testing.T) {
+	assert.Equal(t, ErrNotEnabled, SetStoreDir(os.TempDir()))
+	m := newTestManager(t, &Option{Y: 20 * time.Millisecond, Compress: true})
+	defer os.RemoveAll(m.StoreDir)
+	manager = m
+	defer func() { manager = nil }()
+	startTestLoop(m, Heap)
+	time.Sleep(30 * time.Millisecond)
+
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	newDir := filepath.Join(dir, "incident")
+	assert.Error(t, SetStoreDir(""))
+	// no capture runs across the switch
+	m.pause(true)
+	m.waitCaptures(time.Second)
+	storeDir := m.StoreDir
+	assert.NoError(t, SetStoreDir(newDir))
+	// the Option is left as is
+	assert.Equal(t, storeDir, m.StoreDir)
+	current, _ := m.dirs()
+	assert.Equal(t, newDir, current)
+	pending := len(m.getFileCollection())
+	m.pause(false)
+	time.Sleep(50 * time.Millisecond)
+	stopTestLoop(m)
+	m.waitCaptures(time.Second)
+
+	collection := m.getFileCollection()
+	assert.True(t, pending > 0)
+	assert.True(t, len(collection) > pending)
+	for _, f := range collection[pending:] {
+		assert.Equal(t, newDir, filepath.Dir(f))
+	}
+	// the pending profiles of the previous directory are archived into the new one
+	_, err = m.forceArchive()
+	assert.NoError(t, err)
+	archives, err := filepath.Glob(filepath.Join(newDir, "archive", "*.zip"))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	assert.Len(t, entryNames(archiveContents(t, archives[0])), len(collection))
+}
+
+func TestPauseResume(t *testing.T) {
+	assert.Equal(t, ErrNotEnabled, Pause())
+	assert.Equal(t, ErrNotEnabled, Resume())
+
+	m := newTestManager(t, &Option{Y: 100 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+	manager = m
+	defer func() { manager = nil }()
+	assert.NoError(t, Pause())
+	startTestLoop(m, Heap)
+	defer stopTestLoop(m)
+
+	time.Sleep(350 * time.Millisecond)
+	assert.Empty(t, m.getFileCollection())
+	healthy, err := Healthy()
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+
+	assert.NoError(t, Resume())
+	time.Sleep(250 * time.Millisecond)
+	assert.NotEmpty(t, m.getFileCollection())
+}
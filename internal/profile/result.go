@@ -0,0 +1,64 @@
+package profile
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// requestCount is the number of requests counted by CountRequest, accessed atomically.
+var requestCount int64
+
+// CountRequest counts a request served, so that the captures record the request rate over their window, see
+// CaptureResult.QPS. The gin middleware ProfileRequestCounter calls it for every request.
+func CountRequest() {
+	atomic.AddInt64(&requestCount, 1)
+}
+
+// captureStart is the state at the start of a capture its CaptureResult is computed against.
+type captureStart struct {
+	time     time.Time
+	requests int64
+}
+
+func startCapture() captureStart {
+	return captureStart{time: time.Now(), requests: atomic.LoadInt64(&requestCount)}
+}
+
+// CaptureResult describes a profile written to StoreDir, see Option.OnProfileWritten.
+type CaptureResult struct {
+	Profile Profile
+	Path    string
+	Size    int64
+	// Start and End are when the capture started and ended, the recording in between for a duration profile.
+	Start time.Time
+	End   time.Time
+	// Duration tells whether the profile was recorded over a duration, e.g. cpu, rather than an instant.
+	Duration bool
+	// Requests is the number of requests counted by CountRequest between Start and End, and QPS their rate.
+	// Both are 0 unless the requests are counted, QPS is 0 for the instant profiles.
+	Requests int64
+	QPS      float64
+}
+
+// captureResult describes the capture of profile started at start, which is being written into file.
+func (m *profileManager) captureResult(profile Profile, file *os.File, filePath string,
+	start captureStart) CaptureResult {
+	result := CaptureResult{
+		Profile:  profile,
+		Path:     filePath,
+		Start:    start.time,
+		End:      time.Now(),
+		Duration: isDurationProfile(profile),
+		Requests: atomic.LoadInt64(&requestCount) - start.requests,
+	}
+	if elapsed := result.End.Sub(result.Start); result.Duration && elapsed > 0 {
+		result.QPS = float64(result.Requests) / elapsed.Seconds()
+	}
+	if m.OnProfileWritten != nil {
+		if info, err := file.Stat(); err == nil {
+			result.Size = info.Size()
+		}
+	}
+	return result
+}
@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnProfileWritten(t *testing.T) {
+	var results []CaptureResult
+	m := newTestManager(t, &Option{X: 100 * time.Millisecond, OnProfileWritten: func(result CaptureResult) {
+		results = append(results, result)
+	}})
+	defer os.RemoveAll(m.StoreDir)
+
+	before := time.Now()
+	m.doDurationProfile(Cpu)
+	m.doInstantProfile(Heap)
+	after := time.Now()
+
+	assert.Len(t, results, 2)
+	cpu, heap := results[0], results[1]
+	assert.Equal(t, Cpu, cpu.Profile)
+	assert.True(t, cpu.Duration)
+	assert.False(t, cpu.Start.Before(before))
+	assert.True(t, cpu.End.Sub(cpu.Start) >= m.X)
+	assert.False(t, heap.Duration)
+	assert.False(t, heap.Start.Before(cpu.End))
+	assert.False(t, heap.End.After(after))
+	assert.Equal(t, m.getFileCollection(), []string{cpu.Path, heap.Path})
+	for _, result := range results {
+		info, err := os.Stat(result.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), result.Size)
+	}
+}
@@ -0,0 +1,54 @@
+package profile
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// RawRetention bounds the raw profiles kept in StoreDir when they are not archived.
+type RawRetention struct {
+	// MaxCount is the number of profiles kept, the oldest are removed beyond it. 0 means no limit.
+	MaxCount int
+	// MaxAge is how long a profile is kept. 0 means no limit.
+	MaxAge time.Duration
+}
+
+func (r RawRetention) enabled() bool {
+	return r.MaxCount > 0 || r.MaxAge > 0
+}
+
+// pruneRaw removes the profiles beyond RawRetention. The archiving removes the profiles with Compress,
+// pruning them meanwhile would lose them, so it only applies without.
+func (m *profileManager) pruneRaw() {
+	if m.Compress || !m.RawRetention.enabled() {
+		return
+	}
+	m.pruneLock.Lock()
+	defer m.pruneLock.Unlock()
+	collection := m.getFileCollection()
+	var pruned []string
+	for i, f := range collection {
+		if m.RawRetention.MaxCount > 0 && len(collection)-i > m.RawRetention.MaxCount {
+			pruned = append(pruned, f)
+			continue
+		}
+		if m.RawRetention.MaxAge <= 0 {
+			break
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			m.errorLog(fmt.Sprintf("read status of file %q failed", f), err)
+			continue
+		}
+		if time.Since(info.ModTime()) > m.RawRetention.MaxAge {
+			pruned = append(pruned, f)
+		}
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	m.removeCollection(pruned)
+	m.forgetFiles(pruned)
+	m.removeFiles(pruned)
+}
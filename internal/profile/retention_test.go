@@ -0,0 +1,54 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawRetentionCount(t *testing.T) {
+	m := newTestManager(t, &Option{RawRetention: RawRetention{MaxCount: 3}})
+	defer os.RemoveAll(m.StoreDir)
+
+	var captured []string
+	for i := 0; i < 5; i++ {
+		m.doInstantProfile(Heap)
+		collection := m.getFileCollection()
+		captured = append(captured, collection[len(collection)-1])
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, captured[2:], m.getFileCollection())
+	files, err := filepath.Glob(filepath.Join(m.StoreDir, "heap_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, captured[2:], files)
+}
+
+func TestRawRetentionAge(t *testing.T) {
+	m := newTestManager(t, &Option{RawRetention: RawRetention{MaxAge: time.Hour}})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	old := m.getFileCollection()[0]
+	assert.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 1)
+	assert.NotEqual(t, old, collection[0])
+	_, err := os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRawRetentionCompress(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, RawRetention: RawRetention{MaxCount: 1}})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	time.Sleep(5 * time.Millisecond)
+	m.doInstantProfile(Heap)
+	assert.Len(t, m.getFileCollection(), 2)
+}
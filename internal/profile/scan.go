@@ -0,0 +1,86 @@
+package profile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// scanStoreDirIfDue scans StoreDir if ScanInterval passed since the last scan.
+func (m *profileManager) scanStoreDirIfDue() {
+	if m.ScanInterval <= 0 || m.fifo {
+		return
+	}
+	t := now()
+	if t.Sub(m.lastScan) < m.ScanInterval {
+		return
+	}
+	m.lastScan = t
+	storeDir, _ := m.dirs()
+	m.scanStoreDir(expandStoreDir(storeDir, t))
+}
+
+// scanStoreDir adds the profiles written into dir by others to the collection, so that they are archived
+// with the captured ones. A file is added once, the files of the profiler are never.
+func (m *profileManager) scanStoreDir(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		m.errorLogOnce("scan store dir", fmt.Sprintf("scan %q failed", dir), err)
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tracked := make(map[string]struct{}, len(m.fileCollection))
+	for _, f := range m.fileCollection {
+		tracked[f] = struct{}{}
+	}
+	// what is no longer in dir is forgotten, so that the set doesn't grow with KeepAfterArchive
+	scanned := make(map[string]struct{}, len(infos))
+	var added []string
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if _, ok := m.scanned[path]; ok {
+			scanned[path] = struct{}{}
+			continue
+		}
+		if !info.Mode().IsRegular() || !isExternalProfile(info.Name()) || m.excludedFromArchive(path) {
+			continue
+		}
+		if _, open := m.openFiles[path]; open {
+			continue
+		}
+		scanned[path] = struct{}{}
+		if _, ok := tracked[path]; ok {
+			continue
+		}
+		m.fileCollection = append(m.fileCollection, path)
+		if m.fileInfos == nil {
+			m.fileInfos = make(map[string]profileFile)
+		}
+		m.fileInfos[path] = profileFile{captured: info.ModTime()}
+		added = append(added, path)
+	}
+	m.scanned = scanned
+	if len(added) > 0 {
+		m.infoLog(fmt.Sprintf("added the profiles found in %q:%v", dir, added))
+	}
+}
+
+// isExternalProfile tells whether name in StoreDir can be a profile written by others, rather than a file
+// of the profiler.
+func isExternalProfile(name string) bool {
+	return name != indexFileName && !strings.HasPrefix(name, "latest_") && !strings.HasSuffix(name, ".tmp")
+}
+
+// markScanned keeps the scan from adding the profile at path, which the profiler wrote. It must be called
+// with m.lock held.
+func (m *profileManager) markScanned(path string) {
+	if m.ScanInterval <= 0 {
+		return
+	}
+	if m.scanned == nil {
+		m.scanned = make(map[string]struct{})
+	}
+	m.scanned[path] = struct{}{}
+}
@@ -0,0 +1,58 @@
+package profile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanStoreDir(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, ScanInterval: time.Minute, WriteIndex: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	external := filepath.Join(m.StoreDir, "core_dump.txt")
+	assert.NoError(t, ioutil.WriteFile(external, []byte("core"), 0644))
+	m.scanStoreDirIfDue()
+	// the next scan is a minute away
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(m.StoreDir, "later.txt"), []byte("later"), 0644))
+	m.scanStoreDirIfDue()
+
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 2)
+	assert.Equal(t, external, collection[1])
+
+	// nothing is added twice, the files already tracked included
+	m.scanStoreDir(m.StoreDir)
+	assert.Len(t, m.getFileCollection(), 3)
+	m.scanStoreDir(m.StoreDir)
+	assert.Len(t, m.getFileCollection(), 3)
+
+	archives, _, err := m.doArchive0(m.getFileCollection())
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	assert.Contains(t, entryNames(archiveContents(t, archives[0])), "core_dump.txt")
+}
+
+func TestScanStoreDirKeepAfterArchive(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true, ScanInterval: time.Minute, KeepAfterArchive: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	// the profiles of the profiler, archived and kept before any scan, are never added
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+	_, _, err := m.doArchive0(collection)
+	assert.NoError(t, err)
+	m.archived(collection)
+	m.scanStoreDir(m.StoreDir)
+	assert.Empty(t, m.getFileCollection())
+}
+
+func TestScanIntervalRequiresCompress(t *testing.T) {
+	err := EnableProfile(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: os.TempDir(), ScanInterval: time.Minute}, Heap)
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package profile
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// selfPrefix prefixes the names of the functions of this package.
+var selfPrefix = reflect.TypeOf(profileManager{}).PkgPath() + "."
+
+// excludesSelf tells whether the profiler's own goroutines are dropped from profile p.
+func (m *profileManager) excludesSelf(p Profile) bool {
+	return p == Goroutine && m.ExcludeSelfInGoroutineProfile
+}
+
+// excludeSelf drops the samples of the goroutine profile data whose stack, runtime and profiling frames
+// aside, is entirely within this package, e.g. the profiling loop or a capture writing a profile.
+func excludeSelf(data []byte) ([]byte, error) {
+	prof, err := profile.ParseData(data)
+	if err != nil {
+		return nil, err
+	}
+	samples := prof.Sample[:0]
+	for _, s := range prof.Sample {
+		if !isSelfSample(s) {
+			samples = append(samples, s)
+		}
+	}
+	prof.Sample = samples
+	var buf bytes.Buffer
+	if err = prof.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// selfFramePrefixes prefix the functions the profiler's own goroutines may run besides this package's: the
+// runtime, and the runtime/pprof and runtime/trace its captures call into.
+var selfFramePrefixes = []string{"runtime.", "runtime/pprof.", "runtime/trace."}
+
+func isSelfSample(s *profile.Sample) bool {
+	self := false
+	for _, loc := range s.Location {
+		for _, line := range loc.Line {
+			name := line.Function.Name
+			if strings.HasPrefix(name, selfPrefix) {
+				self = true
+			} else if !hasAnyPrefix(name, selfFramePrefixes) {
+				return false
+			}
+		}
+	}
+	return self
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package profile
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExcludeSelfInGoroutineProfile(t *testing.T) {
+	hasDoProfile := func(exclude bool) bool {
+		m := newTestManager(t, &Option{Y: time.Hour, ExcludeSelfInGoroutineProfile: exclude})
+		defer os.RemoveAll(m.StoreDir)
+		startTestLoop(m)
+		defer stopTestLoop(m)
+		time.Sleep(10 * time.Millisecond)
+
+		m.doInstantProfile(Goroutine)
+		file, err := os.Open(m.getFileCollection()[0])
+		assert.NoError(t, err)
+		defer file.Close()
+		p, err := profile.Parse(file)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, p.Sample)
+		for _, s := range p.Sample {
+			for _, loc := range s.Location {
+				for _, line := range loc.Line {
+					if strings.HasSuffix(line.Function.Name, "(*profileManager).doProfile") {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	assert.True(t, hasDoProfile(false))
+	assert.False(t, hasDoProfile(true))
+}
+
+func TestIsSelfSample(t *testing.T) {
+	sample := func(names ...string) *profile.Sample {
+		s := &profile.Sample{}
+		for _, name := range names {
+			s.Location = append(s.Location, &profile.Location{Line: []profile.Line{{Function: &profile.Function{
+				Name: name,
+			}}}})
+		}
+		return s
+	}
+	// a capture writing a profile
+	assert.True(t, isSelfSample(sample("runtime/pprof.writeGoroutine", "runtime/pprof.(*Profile).WriteTo",
+		selfPrefix+"(*profileManager).capture", "runtime.goexit")))
+	assert.True(t, isSelfSample(sample("runtime.gopark", "runtime/trace.Start.func1", selfPrefix+"CaptureTrace",
+		"runtime.goexit")))
+	assert.True(t, isSelfSample(sample("runtime.gopark", "runtime.selectgo",
+		selfPrefix+"(*profileManager).doProfile")))
+	assert.False(t, isSelfSample(sample("runtime.gopark", "runtime/pprof.(*Profile).WriteTo", "main.main")))
+	assert.False(t, isSelfSample(sample("runtime.gopark", "runtime/pprof.(*Profile).WriteTo")))
+	assert.False(t, isSelfSample(sample(selfPrefix+"Wrap.func1", "github.com/gin-gonic/gin.(*Context).Next")))
+}
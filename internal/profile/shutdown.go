@@ -0,0 +1,57 @@
+package profile
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// reraise delivers sig again once the shutdown profiles are written, so that the process
+// terminates the way it would have without CaptureOnShutdown.
+var reraise = func(sig os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil || p.Signal(sig) != nil {
+		os.Exit(1)
+	}
+}
+
+// CaptureOnShutdown captures the given profiles into opt.StoreDir exactly once when the process receives
+// SIGINT or SIGTERM, then lets the signal terminate the process. It works independently of EnableProfile.
+// Cpu, Trace and WallClock profiles delay the exit by opt.X.
+func CaptureOnShutdown(opt *Option, profiles ...Profile) error {
+	if err := checkProfiles(profiles); err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if isDurationProfile(p) && opt.X <= 0 {
+			return invalidInterval("X should not <= 0")
+		}
+	}
+	if err := createDirIfNotExists(opt.StoreDir); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, shutdownSignals...)
+	go func() {
+		sig := <-ch
+		signal.Stop(ch)
+		m := &profileManager{Option: opt}
+		for _, p := range profiles {
+			filePath, err := CaptureSync(p, opt)
+			if err != nil {
+				if opt.ErrLogOutput != nil {
+					m.errorLog(fmt.Sprintf("capture %s profile on shutdown failed", string(p)), err)
+				}
+				continue
+			}
+			if opt.LogOutput != nil {
+				m.infoLog(fmt.Sprintf("%s profile captured on shutdown: %s", string(p), filePath))
+			}
+		}
+		reraise(sig)
+	}()
+	return nil
+}
@@ -0,0 +1,55 @@
+package profile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureOnShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't send an interrupt to ourselves on windows")
+	}
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reraised := make(chan os.Signal, 1)
+	defer func(f func(os.Signal)) {
+		reraise = f
+	}(reraise)
+	reraise = func(sig os.Signal) {
+		reraised <- sig
+	}
+
+	assert.NoError(t, CaptureOnShutdown(&Option{StoreDir: dir}, Heap, Goroutine))
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	p, err := os.FindProcess(os.Getpid())
+	assert.NoError(t, err)
+	assert.NoError(t, p.Signal(os.Interrupt))
+	select {
+	case sig := <-reraised:
+		assert.Equal(t, os.Interrupt, sig)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown profiles were not captured")
+	}
+	for _, p := range []Profile{Heap, Goroutine} {
+		files, err = filepath.Glob(filepath.Join(dir, string(p)+"_*"))
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+	}
+}
+
+func TestCaptureOnShutdownInvalid(t *testing.T) {
+	assert.Error(t, CaptureOnShutdown(&Option{StoreDir: os.TempDir()}))
+	assert.Error(t, CaptureOnShutdown(&Option{StoreDir: os.TempDir()}, "unknown"))
+	assert.Error(t, CaptureOnShutdown(&Option{StoreDir: os.TempDir()}, Cpu))
+}
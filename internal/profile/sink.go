@@ -0,0 +1,105 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ArchiveSink receives the archives once written to the archive directory, e.g. to upload them to an
+// object storage. A failed Put fails the archive, which is retried as per ArchiveRetries, and the profiles
+// are kept until Put succeeds. Implementations must be safe for concurrent use.
+type ArchiveSink interface {
+	// Put stores the archive named name, read from r.
+	Put(name string, r io.Reader) error
+}
+
+// sinkOf returns the sink the archives of profile p go to, nil if none.
+func (m *profileManager) sinkOf(p Profile) ArchiveSink {
+	if sink, ok := m.ArchiveSinks[p]; ok {
+		return sink
+	}
+	return m.ArchiveSink
+}
+
+// archiveToSinks archives collection into archiveDir, one archive per group of archiveGroups, and puts
+// the archives into their sink. It returns the files of the groups done too, which a failed group leaves out.
+func (m *profileManager) archiveToSinks(archiveDir string, collection []string) (archives, done []string,
+	err error) {
+	for _, group := range m.archiveGroups(collection) {
+		archive, e := m.archiveTo(archiveDir, group.files, group.name)
+		if e != nil {
+			err = e
+			continue
+		}
+		if e = m.putArchive(m.sinkOf(group.profile), archive); e != nil {
+			// the profiles are archived again, don't keep an archive per attempt
+			_ = os.Remove(archive)
+			err = e
+			continue
+		}
+		archives = append(archives, archive)
+		done = append(done, group.files...)
+	}
+	return archives, done, err
+}
+
+// archiveGroup is a part of the collection archived on its own.
+type archiveGroup struct {
+	name    string  // of the archive, without the extension
+	profile Profile // the type with a sink of its own in ArchiveSinks, "" for the others
+	files   []string
+}
+
+// archiveGroups splits collection into the archives to create: the profiles of the types with a sink in
+// ArchiveSinks get an archive of their own, named after the type, and with DailyArchivePolicy the profiles
+// of every capture day too, named after the day.
+func (m *profileManager) archiveGroups(collection []string) []*archiveGroup {
+	daily, _ := m.ArchivePolicy.(*DailyArchivePolicy)
+	timestamp := m.timestamp().Format(defaultTimeFormat)
+	var groups []*archiveGroup
+	byName := make(map[string]*archiveGroup)
+	for _, f := range collection {
+		info := m.fileInfo(f)
+		if _, ok := m.ArchiveSinks[info.profile]; !ok {
+			info.profile = ""
+		}
+		name := timestamp
+		if daily != nil {
+			name = daily.dayOf(info.captured)
+		}
+		if info.profile != "" {
+			name += "_" + string(info.profile)
+		}
+		group, ok := byName[name]
+		if !ok {
+			group = &archiveGroup{name: name, profile: info.profile}
+			byName[name] = group
+			groups = append(groups, group)
+		}
+		group.files = append(group.files, f)
+	}
+	return groups
+}
+
+// putArchive puts archive into sink, if any, and once done sends it to the channel of ArchiveChannel.
+func (m *profileManager) putArchive(sink ArchiveSink, archive string) error {
+	if sink != nil {
+		if err := putFile(sink, archive); err != nil {
+			m.errorLog(fmt.Sprintf("put archive %q into its sink failed", archive), err)
+			return err
+		}
+	}
+	m.sendArchive(archive)
+	return nil
+}
+
+func putFile(sink ArchiveSink, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sink.Put(filepath.Base(path), file)
+}
@@ -0,0 +1,183 @@
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySink keeps the archives put into it.
+type memorySink struct {
+	lock     sync.Mutex
+	archives map[string][]byte
+}
+
+func (s *memorySink) Put(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.archives == nil {
+		s.archives = make(map[string][]byte)
+	}
+	s.archives[name] = data
+	return nil
+}
+
+// entries returns the names of the files of the zip archives put into s.
+func (s *memorySink) entries(t *testing.T) []string {
+	dir, err := ioutil.TempDir("", "sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, data := range s.archives {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	return zipEntries(t, dir)
+}
+
+func TestArchiveSinks(t *testing.T) {
+	heapStore, goroutineStore := &memorySink{}, &memorySink{}
+	m := newTestManager(t, &Option{Compress: true, ArchiveSinks: map[Profile]ArchiveSink{
+		Heap:      heapStore,
+		Goroutine: goroutineStore,
+	}})
+	defer os.RemoveAll(m.StoreDir)
+
+	for i := 0; i < 2; i++ {
+		m.doInstantProfile(Heap)
+		m.doInstantProfile(Goroutine)
+		m.doInstantProfile(Mutex)
+		time.Sleep(5 * time.Millisecond)
+	}
+	archives, err := m.forceArchive()
+	assert.NoError(t, err)
+	assert.Len(t, archives, 3)
+
+	for sink, p := range map[*memorySink]Profile{heapStore: Heap, goroutineStore: Goroutine} {
+		assert.Len(t, sink.archives, 1)
+		entries := sink.entries(t)
+		assert.Len(t, entries, 2)
+		for _, entry := range entries {
+			assert.True(t, strings.HasPrefix(entry, string(p)+"_"), entry)
+		}
+	}
+	// the mutex profiles have no sink, they are only archived locally
+	var mutexEntries int
+	for _, entry := range zipEntries(t, m.archiveDir) {
+		if strings.HasPrefix(entry, string(Mutex)+"_") {
+			mutexEntries++
+		}
+	}
+	assert.Equal(t, 2, mutexEntries)
+	assert.Empty(t, m.fileInfos)
+}
+
+func TestArchiveSinkDefault(t *testing.T) {
+	sink := &memorySink{}
+	m := newTestManager(t, &Option{Compress: true, ArchiveSink: sink})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	archives, err := m.forceArchive()
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	local, err := ioutil.ReadFile(archives[0])
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(local, sink.archives[filepath.Base(archives[0])]))
+}
+
+// flakySink fails its first failures puts.
+type flakySink struct {
+	memorySink
+	failures int
+	puts     int
+}
+
+func (s *flakySink) Put(name string, r io.Reader) error {
+	s.puts++
+	if s.puts <= s.failures {
+		return errors.New("sink unavailable")
+	}
+	return s.memorySink.Put(name, r)
+}
+
+func TestArchiveSinkRetries(t *testing.T) {
+	defer func(backoff time.Duration) {
+		archiveRetryBackoff = backoff
+	}(archiveRetryBackoff)
+	archiveRetryBackoff = 10 * time.Millisecond
+	sink := &flakySink{failures: 2}
+	m := newTestManager(t, &Option{Compress: true, ArchiveSink: sink, ArchiveRetries: 2})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	collection := m.getFileCollection()
+	archives, err := m.forceArchive()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sink.puts)
+	// a single archive is left, the one put
+	assert.Len(t, archives, 1)
+	assert.Len(t, sink.archives, 1)
+	assert.Equal(t, []string{filepath.Base(collection[0])}, zipEntries(t, m.archiveDir))
+	_, err = os.Stat(collection[0])
+	assert.True(t, os.IsNotExist(err))
+
+	// the profiles are kept while the sink fails
+	sink.puts, sink.failures = 0, 5
+	m.doInstantProfile(Heap)
+	collection = m.getFileCollection()
+	_, err = m.forceArchive()
+	assert.Error(t, err)
+	assert.Equal(t, 3, sink.puts)
+	assert.FileExists(t, collection[0])
+	assert.Equal(t, collection, m.getFileCollection())
+}
+
+func TestArchiveSinkRetriesOnlyFailedGroups(t *testing.T) {
+	defer func(backoff time.Duration) {
+		archiveRetryBackoff = backoff
+	}(archiveRetryBackoff)
+	archiveRetryBackoff = 10 * time.Millisecond
+	heapStore, goroutineStore := &memorySink{}, &flakySink{failures: 1}
+	m := newTestManager(t, &Option{Compress: true, ArchiveRetries: 1, ArchiveSinks: map[Profile]ArchiveSink{
+		Heap:      heapStore,
+		Goroutine: goroutineStore,
+	}})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	archives, err := m.forceArchive()
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+	// the heap archive, put at the first attempt, is neither archived nor put again
+	assert.Len(t, heapStore.archives, 1)
+	assert.Equal(t, 2, goroutineStore.puts)
+	assert.Len(t, zipEntries(t, m.archiveDir), 2)
+	assert.Empty(t, m.getFileCollection())
+
+	// once the retries are exhausted, only the profiles of the failed group are kept
+	heapStore.archives, goroutineStore.puts, goroutineStore.failures = nil, 0, 5
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	collection := m.getFileCollection()
+	_, err = m.forceArchive()
+	assert.Error(t, err)
+	assert.Len(t, heapStore.archives, 1)
+	assert.Equal(t, 2, goroutineStore.puts)
+	assert.Equal(t, collection[1:], m.getFileCollection())
+	_, err = os.Stat(collection[0])
+	assert.True(t, os.IsNotExist(err))
+}
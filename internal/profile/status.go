@@ -0,0 +1,152 @@
+package profile
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of the periodical profiling.
+type Status struct {
+	Y        time.Duration
+	X        time.Duration
+	Profiles []Profile
+	Paused   bool
+	Healthy  bool
+	// PendingFiles is the number of profiles waiting to be archived.
+	PendingFiles int
+	Overhead     Overhead
+	// ArchivesDropped is the number of archives not received from the channel of Option.ArchiveChannel.
+	ArchivesDropped int64
+	// Captures and CaptureFailures count the captures since enabled, Archives the archives written and
+	// Errors the errors logged.
+	Captures        int64
+	CaptureFailures int64
+	Archives        int64
+	Errors          int64
+	// LastArchive is the path of the latest archive, "" if none yet.
+	LastArchive     string
+	LastArchiveTime time.Time
+	// LastError is the latest error logged, "" if none yet.
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// GetStatus reports the status of the periodical profiling started by EnableProfile.
+func GetStatus() (Status, error) {
+	m := currentManager()
+	if m == nil {
+		return Status{}, ErrNotEnabled
+	}
+	return m.status(), nil
+}
+
+func (m *profileManager) status() Status {
+	y, x := m.interval()
+	healthy, _ := m.healthy()
+	status := Status{
+		Y:               y,
+		X:               x,
+		Profiles:        append([]Profile(nil), m.getProfiles()...),
+		Paused:          atomic.LoadInt32(&m.paused) == 1,
+		Healthy:         healthy,
+		PendingFiles:    len(m.getFileCollection()),
+		Overhead:        m.overhead.estimate(),
+		ArchivesDropped: atomic.LoadInt64(&m.archiveDrops),
+	}
+	m.counters.snapshot(&status)
+	return status
+}
+
+// statusCounters keeps the counters and the latest events of Status.
+type statusCounters struct {
+	lock            sync.Mutex
+	captures        int64
+	captureFailures int64
+	archives        int64
+	errors          int64
+	lastArchive     string
+	lastArchiveTime time.Time
+	lastError       string
+	lastErrorTime   time.Time
+}
+
+func (c *statusCounters) capture(succeed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.captures++
+	if !succeed {
+		c.captureFailures++
+	}
+}
+
+func (c *statusCounters) archive(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.archives++
+	c.lastArchive, c.lastArchiveTime = path, time.Now()
+}
+
+func (c *statusCounters) error(msg string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors++
+	c.lastError, c.lastErrorTime = msg+": "+err.Error(), time.Now()
+}
+
+func (c *statusCounters) snapshot(status *Status) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status.Captures, status.CaptureFailures = c.captures, c.captureFailures
+	status.Archives, status.Errors = c.archives, c.errors
+	status.LastArchive, status.LastArchiveTime = c.lastArchive, c.lastArchiveTime
+	status.LastError, status.LastErrorTime = c.lastError, c.lastErrorTime
+}
+
+// ProfileInfo is the configuration of a profiler, with the defaults resolved.
+type ProfileInfo struct {
+	StoreDir string
+	// ArchiveDir is where the archives are written, "" without Compress. A partitioned StoreDir has an
+	// archive directory per partition, StoreDir/{yyyy}/{mm}/{dd}/archive.
+	ArchiveDir string
+	// ArchivePolicy is nil without Compress.
+	ArchivePolicy     ArchivePolicy
+	CompressionFormat CompressionFormat
+	FileFormat        *Format
+	Profiles          []Profile
+	Y                 time.Duration
+	X                 time.Duration
+}
+
+// EnableProfileWithInfo is EnableProfile, returning the resolved configuration of the profiling.
+func EnableProfileWithInfo(opt *Option, profiles ...Profile) (ProfileInfo, error) {
+	if err := EnableProfile(opt, profiles...); err != nil {
+		return ProfileInfo{}, err
+	}
+	m := currentManager()
+	if m == nil {
+		// stopped meanwhile
+		return ProfileInfo{}, ErrNotEnabled
+	}
+	return m.info(), nil
+}
+
+func (m *profileManager) info() ProfileInfo {
+	y, x := m.interval()
+	storeDir, archiveDir := m.dirs()
+	info := ProfileInfo{
+		StoreDir:          storeDir,
+		ArchiveDir:        archiveDir,
+		ArchivePolicy:     m.ArchivePolicy,
+		CompressionFormat: m.CompressionFormat,
+		FileFormat:        m.FileFormat,
+		Profiles:          append([]Profile(nil), m.getProfiles()...),
+		Y:                 y,
+		X:                 x,
+	}
+	if m.Compress && isPartitioned(storeDir) {
+		info.ArchiveDir = filepath.Join(storeDir, "archive")
+	}
+	return info
+}
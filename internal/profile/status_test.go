@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableProfileWithInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := &Option{Y: 2 * time.Second, X: time.Second, StoreDir: dir, Compress: true,
+		LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}
+
+	info, err := EnableProfileWithInfo(opt, Heap, Goroutine)
+	assert.NoError(t, err)
+	defer StopProfile()
+	assert.Equal(t, dir, info.StoreDir)
+	assert.Equal(t, filepath.Join(dir, "archive"), info.ArchiveDir)
+	assert.IsType(t, &FileNumArchivePolicy{}, info.ArchivePolicy)
+	assert.Equal(t, Zip, info.CompressionFormat)
+	assert.Equal(t, defaultFormat, info.FileFormat)
+	assert.Equal(t, []Profile{Heap, Goroutine}, info.Profiles)
+	assert.Equal(t, 2*time.Second, info.Y)
+	assert.Equal(t, time.Second, info.X)
+
+	_, err = EnableProfileWithInfo(opt, Heap)
+	assert.Equal(t, ErrAlreadyEnabled, err)
+}
+
+func TestProfilerInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storeDir := filepath.Join(dir, "{yyyy}", "{mm}")
+	p, err := NewProfiler(&Option{Y: 2 * time.Second, X: time.Second, StoreDir: storeDir,
+		LogOutput: ioutil.Discard, ErrLogOutput: ioutil.Discard}, Heap)
+	assert.NoError(t, err)
+	defer p.Stop()
+
+	info := p.Info()
+	assert.Empty(t, info.ArchiveDir)
+	assert.Nil(t, info.ArchivePolicy)
+	assert.Equal(t, storeDir, info.StoreDir)
+}
+
+func TestStatusCounters(t *testing.T) {
+	m := newTestManager(t, &Option{Compress: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.recordCapture(false)
+	m.errorLog("upload failed", errors.New("timeout"))
+	archive, err := m.archiveTo(m.archiveDir, m.getFileCollection(), "")
+	assert.NoError(t, err)
+
+	status := m.status()
+	assert.Equal(t, int64(2), status.Captures)
+	assert.Equal(t, int64(1), status.CaptureFailures)
+	assert.Equal(t, int64(1), status.Archives)
+	assert.Equal(t, archive, status.LastArchive)
+	assert.False(t, status.LastArchiveTime.IsZero())
+	assert.Equal(t, int64(1), status.Errors)
+	assert.Equal(t, "upload failed: timeout", status.LastError)
+	assert.False(t, status.LastErrorTime.IsZero())
+}
@@ -0,0 +1,139 @@
+package profile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin/internal/json"
+	"github.com/google/pprof/profile"
+)
+
+// summaryExtension is the extension of the summaries, see Option.SummaryTopFunctions.
+const summaryExtension = ".summary.json"
+
+// Summary is the compact JSON summary of a profile, its top functions.
+type Summary struct {
+	Type Profile `json:"type"`
+	// Profile is the file name of the summarized profile.
+	Profile       string `json:"profile"`
+	DurationNanos int64  `json:"duration_nanos,omitempty"`
+	// SampleType is the type/unit of the values, e.g. cpu/nanoseconds or inuse_space/bytes.
+	SampleType string            `json:"sample_type"`
+	Total      int64             `json:"total"`
+	Top        []FunctionSummary `json:"top"`
+}
+
+// FunctionSummary is the value of a function in a profile, by itself (flat) and with its callees (cum).
+type FunctionSummary struct {
+	Function string `json:"function"`
+	Flat     int64  `json:"flat"`
+	Cum      int64  `json:"cum"`
+}
+
+// summarizes tells whether a summary of profile p is written, see SummaryTopFunctions.
+func (m *profileManager) summarizes(p Profile) bool {
+	return m.SummaryTopFunctions > 0 && !m.fifo && (p == Cpu || p == Heap)
+}
+
+// summarize returns the summary of the profile prof of type p written at path, with its top functions by flat
+// value, of its default sample type.
+func summarize(p Profile, path string, prof *profile.Profile, top int) Summary {
+	value := len(prof.SampleType) - 1
+	for i, sampleType := range prof.SampleType {
+		if sampleType.Type == prof.DefaultSampleType {
+			value = i
+		}
+	}
+	summary := Summary{
+		Type:          p,
+		Profile:       filepath.Base(path),
+		DurationNanos: prof.DurationNanos,
+		SampleType:    prof.SampleType[value].Type + "/" + prof.SampleType[value].Unit,
+	}
+	functions := make(map[string]*FunctionSummary)
+	function := func(name string) *FunctionSummary {
+		f, ok := functions[name]
+		if !ok {
+			f = &FunctionSummary{Function: name}
+			functions[name] = f
+		}
+		return f
+	}
+	for _, s := range prof.Sample {
+		v := s.Value[value]
+		summary.Total += v
+		seen := make(map[string]bool)
+		for i, loc := range s.Location {
+			for j, line := range loc.Line {
+				if line.Function == nil {
+					continue
+				}
+				// the first line of the first location is the leaf, inlined functions come first
+				if i == 0 && j == 0 {
+					function(line.Function.Name).Flat += v
+				}
+				if !seen[line.Function.Name] {
+					seen[line.Function.Name] = true
+					function(line.Function.Name).Cum += v
+				}
+			}
+		}
+	}
+	for _, f := range functions {
+		summary.Top = append(summary.Top, *f)
+	}
+	sort.Slice(summary.Top, func(i, j int) bool {
+		a, b := summary.Top[i], summary.Top[j]
+		if a.Flat != b.Flat {
+			return a.Flat > b.Flat
+		}
+		if a.Cum != b.Cum {
+			return a.Cum > b.Cum
+		}
+		return a.Function < b.Function
+	})
+	if len(summary.Top) > top {
+		summary.Top = summary.Top[:top]
+	}
+	return summary
+}
+
+// writeSummary writes the summary of the profile at filePath next to it and returns its path.
+func (m *profileManager) writeSummary(p Profile, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	prof, err := profile.Parse(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(summarize(p, filePath, prof, m.SummaryTopFunctions))
+	if err != nil {
+		return "", err
+	}
+	summaryPath := strings.TrimSuffix(strings.TrimSuffix(filePath, ".profile"), pprofExtension) + summaryExtension
+	summaryFile, err := m.openFile(summaryPath)
+	if err != nil {
+		return "", err
+	}
+	_, err = summaryFile.Write(data)
+	if !m.closeFile(p, summaryFile, summaryPath, err == nil) {
+		if err == nil {
+			err = fmt.Errorf("close summary %q failed", summaryPath)
+		}
+		return "", err
+	}
+	return summaryPath, nil
+}
+
+// dropProfile removes the profile at filePath, which was summarized, see SummaryOnly.
+func (m *profileManager) dropProfile(filePath string) {
+	m.removeCollection([]string{filePath})
+	m.forgetFiles([]string{filePath})
+	m.removeFiles([]string{filePath})
+}
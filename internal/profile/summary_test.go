@@ -0,0 +1,74 @@
+package profile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin/internal/json"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:noinline
+func burnCPU(stop <-chan struct{}) int {
+	n := 0
+	for {
+		select {
+		case <-stop:
+			return n
+		default:
+		}
+		for i := 0; i < 100000; i++ {
+			n += i % 7
+		}
+	}
+}
+
+func readSummary(t *testing.T, path string) Summary {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var summary Summary
+	assert.NoError(t, json.Unmarshal(data, &summary))
+	return summary
+}
+
+func TestCPUSummary(t *testing.T) {
+	m := newTestManager(t, &Option{X: 300 * time.Millisecond, SummaryTopFunctions: 5})
+	defer os.RemoveAll(m.StoreDir)
+
+	stop := make(chan struct{})
+	go burnCPU(stop)
+	m.doDurationProfile(Cpu)
+	close(stop)
+
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 2)
+	assert.True(t, strings.HasSuffix(collection[1], ".summary.json"), collection[1])
+	summary := readSummary(t, collection[1])
+	assert.Equal(t, Cpu, summary.Type)
+	assert.Equal(t, filepath.Base(collection[0]), summary.Profile)
+	assert.Equal(t, "cpu/nanoseconds", summary.SampleType)
+	assert.True(t, len(summary.Top) > 0 && len(summary.Top) <= 5)
+	assert.True(t, strings.HasSuffix(summary.Top[0].Function, ".burnCPU"), summary.Top[0].Function)
+	assert.True(t, summary.Top[0].Flat > 0)
+	assert.True(t, summary.Top[0].Cum >= summary.Top[0].Flat)
+	assert.True(t, summary.Total >= summary.Top[0].Flat)
+}
+
+func TestSummaryOnly(t *testing.T) {
+	m := newTestManager(t, &Option{SummaryTopFunctions: 3, SummaryOnly: true})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doInstantProfile(Heap)
+	m.doInstantProfile(Goroutine)
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 2)
+	assert.True(t, strings.HasSuffix(collection[0], ".summary.json"), collection[0])
+	assert.Equal(t, "inuse_space/bytes", readSummary(t, collection[0]).SampleType)
+	files, err := filepath.Glob(filepath.Join(m.StoreDir, "heap_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, collection[:1], files)
+}
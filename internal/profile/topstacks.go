@@ -0,0 +1,54 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// topStacks returns the number of stacks profile p is trimmed to, 0 if it is not, and the index of the sample
+// value they are ranked by, see GoroutineTopStacks and BlockTopSites.
+func (m *profileManager) topStacks(p Profile) (top, value int) {
+	switch {
+	case p == Goroutine && m.GoroutineTopStacks > 0:
+		// goroutine count
+		return m.GoroutineTopStacks, 0
+	case p == Block && m.BlockTopSites > 0:
+		// delay, the contentions are value 0
+		return m.BlockTopSites, 1
+	}
+	return 0, 0
+}
+
+// trimStacks keeps the top stacks of the profile data with the highest sample value at index value, the
+// total of the dropped ones is left as a comment of the profile.
+func trimStacks(data []byte, top, value int) ([]byte, error) {
+	prof, err := profile.ParseData(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(prof.Sample) <= top {
+		return data, nil
+	}
+	if value >= len(prof.SampleType) {
+		return nil, fmt.Errorf("profile has no sample value %d", value)
+	}
+	sort.SliceStable(prof.Sample, func(i, j int) bool {
+		return prof.Sample[i].Value[value] > prof.Sample[j].Value[value]
+	})
+	var dropped int64
+	for _, s := range prof.Sample[top:] {
+		dropped += s.Value[value]
+	}
+	sampleType := prof.SampleType[value]
+	prof.Comments = append(prof.Comments, fmt.Sprintf("%d stacks beyond the top %d by %s trimmed, %d %s in total",
+		len(prof.Sample)-top, top, sampleType.Type, dropped, sampleType.Unit))
+	prof.Sample = prof.Sample[:top]
+	var buf bytes.Buffer
+	if err = prof.Compact().Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,118 @@
+package profile
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:noinline
+func blockedInA(wg *sync.WaitGroup, release chan struct{}) {
+	wg.Done()
+	<-release
+}
+
+//go:noinline
+func blockedInB(wg *sync.WaitGroup, release chan struct{}) {
+	wg.Done()
+	<-release
+}
+
+//go:noinline
+func blockedInC(wg *sync.WaitGroup, release chan struct{}) {
+	wg.Done()
+	<-release
+}
+
+func TestGoroutineTopStacks(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var wg sync.WaitGroup
+	for _, g := range []struct {
+		f func(*sync.WaitGroup, chan struct{})
+		n int
+	}{{blockedInA, 300}, {blockedInB, 200}, {blockedInC, 100}} {
+		for i := 0; i < g.n; i++ {
+			wg.Add(1)
+			go g.f(&wg, release)
+		}
+	}
+	wg.Wait()
+
+	m := newTestManager(t, &Option{GoroutineTopStacks: 2})
+	defer os.RemoveAll(m.StoreDir)
+	m.doInstantProfile(Goroutine)
+	file, err := os.Open(m.getFileCollection()[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+
+	assert.Len(t, p.Sample, 2)
+	for i, name := range []string{"blockedInA", "blockedInB"} {
+		assert.Equal(t, int64(300-100*i), p.Sample[i].Value[0])
+		assert.True(t, inStack(p.Sample[i], name), name)
+	}
+	assert.Contains(t, strings.Join(p.Comments, "\n"), "stacks beyond the top 2 by goroutine trimmed")
+}
+
+//go:noinline
+func blockFor(d time.Duration) {
+	ch := make(chan struct{})
+	go func() {
+		time.Sleep(d)
+		close(ch)
+	}()
+	<-ch
+}
+
+//go:noinline
+func blockSiteA() { blockFor(150 * time.Millisecond) }
+
+//go:noinline
+func blockSiteB() { blockFor(100 * time.Millisecond) }
+
+//go:noinline
+func blockSiteC() { blockFor(20 * time.Millisecond) }
+
+func TestBlockTopSites(t *testing.T) {
+	runtime.SetBlockProfileRate(1)
+	defer runtime.SetBlockProfileRate(0)
+	blockSiteC()
+	blockSiteA()
+	blockSiteB()
+	blockSiteC()
+
+	m := newTestManager(t, &Option{BlockTopSites: 2})
+	defer os.RemoveAll(m.StoreDir)
+	m.doInstantProfile(Block)
+	file, err := os.Open(m.getFileCollection()[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+
+	assert.Len(t, p.Sample, 2)
+	for i, name := range []string{"blockSiteA", "blockSiteB"} {
+		assert.True(t, inStack(p.Sample[i], name), name)
+	}
+	assert.True(t, p.Sample[0].Value[1] >= int64(100*time.Millisecond))
+	assert.Contains(t, strings.Join(p.Comments, "\n"), "beyond the top 2 by delay trimmed")
+}
+
+func inStack(s *profile.Sample, name string) bool {
+	for _, loc := range s.Location {
+		for _, line := range loc.Line {
+			if strings.HasSuffix(line.Function.Name, "."+name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package profile
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// wallClockHz is the sampling rate of the wall-clock profile.
+const wallClockHz = 99
+
+// CaptureWallClock records a wall-clock profile for d into w: the stacks of every goroutine, on-cpu or
+// not (sleeping, blocked, waiting for I/O), sampled from the goroutine profile at 99Hz as fgprof does.
+// Every sample stops the world for a moment, the more goroutines the longer.
+func CaptureWallClock(d time.Duration, w io.Writer) error {
+	sampler := &wallClockSampler{counts: make(map[string]int64)}
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / wallClockHz)
+	defer ticker.Stop()
+	deadline := time.NewTimer(d)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sampler.sample()
+		case <-deadline.C:
+			return sampler.profile(start, time.Since(start)).Write(w)
+		}
+	}
+}
+
+// wallClockSampler counts the goroutine stacks.
+type wallClockSampler struct {
+	records []runtime.StackRecord
+	counts  map[string]int64 // by stack, encoded by stackKey
+}
+
+func (s *wallClockSampler) sample() {
+	n, ok := runtime.GoroutineProfile(s.records)
+	for !ok {
+		// more goroutines than records, leave some room for the ones started meanwhile
+		s.records = make([]runtime.StackRecord, n+n/10+10)
+		n, ok = runtime.GoroutineProfile(s.records)
+	}
+	for _, record := range s.records[:n] {
+		s.counts[stackKey(record.Stack())]++
+	}
+}
+
+func stackKey(stack []uintptr) string {
+	key := make([]byte, 8*len(stack))
+	for i, pc := range stack {
+		binary.LittleEndian.PutUint64(key[8*i:], uint64(pc))
+	}
+	return string(key)
+}
+
+func stackOf(key string) []uintptr {
+	stack := make([]uintptr, len(key)/8)
+	for i := range stack {
+		stack[i] = uintptr(binary.LittleEndian.Uint64([]byte(key[8*i:])))
+	}
+	return stack
+}
+
+// profile builds the profile of the samples, leaving the sampler goroutine out.
+func (s *wallClockSampler) profile(start time.Time, d time.Duration) *profile.Profile {
+	period := int64(time.Second / wallClockHz)
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "time", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "wallclock", Unit: "nanoseconds"},
+		Period:        period,
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(d),
+	}
+	locations := make(map[runtime.Frame]*profile.Location)
+	functions := make(map[string]*profile.Function)
+	for key, count := range s.counts {
+		var sample []*profile.Location
+		self := false
+		frames := runtime.CallersFrames(stackOf(key))
+		for more := true; more; {
+			var frame runtime.Frame
+			frame, more = frames.Next()
+			if strings.HasPrefix(frame.Function, selfPrefix+"CaptureWallClock") {
+				self = true
+				break
+			}
+			frame.Entry, frame.Func = 0, nil
+			loc, ok := locations[frame]
+			if !ok {
+				fn, ok := functions[frame.Function]
+				if !ok {
+					fn = &profile.Function{ID: uint64(len(p.Function) + 1), Name: frame.Function,
+						SystemName: frame.Function, Filename: frame.File}
+					functions[frame.Function] = fn
+					p.Function = append(p.Function, fn)
+				}
+				loc = &profile.Location{ID: uint64(len(p.Location) + 1), Address: uint64(frame.PC),
+					Line: []profile.Line{{Function: fn, Line: int64(frame.Line)}}}
+				locations[frame] = loc
+				p.Location = append(p.Location, loc)
+			}
+			sample = append(sample, loc)
+		}
+		if self || len(sample) == 0 {
+			continue
+		}
+		p.Sample = append(p.Sample, &profile.Sample{Location: sample, Value: []int64{count, count * period}})
+	}
+	return p
+}
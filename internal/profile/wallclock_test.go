@@ -0,0 +1,59 @@
+package profile
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:noinline
+func sleepingWorkload(d time.Duration) {
+	time.Sleep(d)
+}
+
+func TestCaptureWallClock(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		sleepingWorkload(500 * time.Millisecond)
+		close(done)
+	}()
+	var buf bytes.Buffer
+	assert.NoError(t, CaptureWallClock(300*time.Millisecond, &buf))
+	<-done
+
+	p, err := profile.Parse(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "time", p.SampleType[1].Type)
+	var sleeping time.Duration
+	for _, s := range p.Sample {
+		for _, loc := range s.Location {
+			name := loc.Line[0].Function.Name
+			assert.False(t, strings.HasSuffix(name, "CaptureWallClock"), "the sampler is left out")
+			if strings.HasSuffix(name, ".sleepingWorkload") {
+				sleeping += time.Duration(s.Value[1])
+			}
+		}
+	}
+	// off-cpu time, which the cpu profile misses
+	assert.True(t, sleeping >= 100*time.Millisecond, sleeping)
+}
+
+func TestWallClockProfile(t *testing.T) {
+	m := newTestManager(t, &Option{X: 50 * time.Millisecond})
+	defer os.RemoveAll(m.StoreDir)
+
+	m.doDurationProfile(WallClock)
+	collection := m.getFileCollection()
+	assert.Len(t, collection, 1)
+	file, err := os.Open(collection[0])
+	assert.NoError(t, err)
+	defer file.Close()
+	p, err := profile.Parse(file)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.Sample)
+}
@@ -0,0 +1,602 @@
+package gin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin/internal/profile"
+)
+
+// DefaultPprofBasePath is where RegisterPprofHandlers mounts the pprof endpoints by default.
+const DefaultPprofBasePath = "/debug/pprof"
+
+// RegisterPprofHandlers mounts the net/http/pprof endpoints under basePath of r, DefaultPprofBasePath if
+// empty, e.g. "/internal/profiling/pprof" where /debug is taken. The links of the index page are relative
+// so they resolve under any basePath. The profiles added to runtime/pprof afterwards are not served.
+// The endpoints are served by net/http/pprof unchanged, with its Content-Type and its seconds and debug
+// query parameters, so that scrapers such as Parca work with them as they are.
+func RegisterPprofHandlers(r IRoutes, basePath string) {
+	if basePath == "" {
+		basePath = DefaultPprofBasePath
+	}
+	basePath = strings.TrimSuffix(basePath, "/")
+	r.GET(basePath+"/", WrapF(pprof.Index))
+	r.GET(basePath+"/cmdline", WrapF(pprof.Cmdline))
+	r.GET(basePath+"/profile", WrapF(pprof.Profile))
+	r.GET(basePath+"/symbol", WrapF(pprof.Symbol))
+	r.POST(basePath+"/symbol", WrapF(pprof.Symbol))
+	r.GET(basePath+"/trace", WrapF(pprof.Trace))
+	// pprof.Index serves the named profiles under /debug/pprof/ only
+	for _, p := range runtimepprof.Profiles() {
+		r.GET(basePath+"/"+p.Name(), WrapH(pprof.Handler(p.Name())))
+	}
+}
+
+// ProfileRequestCounter returns a middleware counting the requests, so that the captures of the profiler
+// record the request rate over their window in profile.CaptureResult.QPS. It should be used router-wide.
+func ProfileRequestCounter() HandlerFunc {
+	return func(c *Context) {
+		c.Next()
+		profile.CountRequest()
+	}
+}
+
+// profileIndexTemplate renders the index of ProfileIndexHandler.
+var profileIndexTemplate = template.Must(template.New("index").Parse(`<html>
+<head><title>profiles</title></head>
+<body>
+<p>Profiles of the periodical profiling, every {{.Y}} for {{.X}}:</p>
+<ul>
+{{range .Links}}<li><a href="{{.Href}}">{{.Profile}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type profileIndexLink struct {
+	Profile profile.Profile
+	Href    string
+}
+
+// pprofLink returns the link of p relative to the pprof endpoints of RegisterPprofHandlers, "" if none
+// serves it.
+func pprofLink(p profile.Profile) string {
+	switch p {
+	case profile.Cpu:
+		return "profile"
+	case profile.Trace:
+		return "trace"
+	case profile.FullGoroutineDump:
+		return "goroutine?debug=2"
+	case profile.Heap, profile.ThreadCreate, profile.Goroutine, profile.Block, profile.Mutex:
+		return string(p) + "?debug=1"
+	}
+	return ""
+}
+
+// ProfileIndexHandler returns a HandlerFunc that renders an HTML index of the profiles enabled by
+// EnableProfile, linking to the pprof endpoints of RegisterPprofHandlers. The links are relative, mount it
+// at their basePath, e.g. router.GET("/debug/profiles/", ProfileIndexHandler()) next to
+// RegisterPprofHandlers(router, "/debug/profiles").
+func ProfileIndexHandler() HandlerFunc {
+	return func(c *Context) {
+		status, err := profile.GetStatus()
+		if err != nil {
+			c.String(http.StatusConflict, err.Error())
+			return
+		}
+		var links []profileIndexLink
+		for _, p := range status.Profiles {
+			if href := pprofLink(p); href != "" {
+				links = append(links, profileIndexLink{Profile: p, Href: href})
+			}
+		}
+		var buf bytes.Buffer
+		if err = profileIndexTemplate.Execute(&buf, H{"Y": status.Y, "X": status.X, "Links": links}); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	}
+}
+
+// ForceArchiveHandler returns a HandlerFunc that archives the pending profiles right away and responds with
+// the names of the created archives as JSON, or with the error. It is an admin endpoint, mount it behind an
+// auth middleware, e.g.
+//
+//	admin := router.Group("/admin", BasicAuth(Accounts{"admin": "secret"}))
+//	admin.POST("/profile/archive", ForceArchiveHandler())
+func ForceArchiveHandler() HandlerFunc {
+	return func(c *Context) {
+		archives, err := profile.ForceArchive()
+		if err != nil {
+			status := http.StatusInternalServerError
+			if profile.IsError(err, profile.ErrNotEnabled) || profile.IsError(err, profile.ErrCompressDisabled) ||
+				profile.IsError(err, profile.ErrNothingToArchive) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, H{"error": err.Error()})
+			return
+		}
+		names := make([]string, len(archives))
+		for i, archive := range archives {
+			names[i] = filepath.Base(archive)
+		}
+		c.JSON(http.StatusOK, H{"archives": names})
+	}
+}
+
+// ProfileArchiveHandler returns a HandlerFunc that serves the archive named by the :name parameter of its
+// route from the archive directory of the profiler, with the Content-Type of its compression format, e.g.
+// application/zip. It is an admin endpoint, mount it behind an auth middleware, e.g.
+//
+//	admin := router.Group("/debug", BasicAuth(Accounts{"admin": "secret"}))
+//	admin.GET("/profile/archives/:name", ProfileArchiveHandler())
+func ProfileArchiveHandler() HandlerFunc {
+	return func(c *Context) {
+		name := c.Param("name")
+		file, err := profile.OpenArchive(name)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case profile.IsError(err, profile.ErrArchiveNotFound):
+				status = http.StatusNotFound
+			case profile.IsError(err, profile.ErrNotEnabled) || profile.IsError(err, profile.ErrCompressDisabled):
+				status = http.StatusConflict
+			}
+			c.JSON(status, H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, H{"error": err.Error()})
+			return
+		}
+		c.DataFromReader(http.StatusOK, info.Size(), profile.ArchiveContentType(name), file,
+			map[string]string{"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, name)})
+	}
+}
+
+// profileConfig is the body of ProfileConfigHandler.
+type profileConfig struct {
+	Profiles []profile.Profile `json:"profiles"`
+	Every    string            `json:"every"`
+	Duration string            `json:"duration"`
+}
+
+// ProfileConfigHandler returns a HandlerFunc that applies the configuration of its JSON body to the running
+// profiler, e.g. {"profiles":["cpu","heap"],"every":"30s","duration":"5s"}, where every is Y and duration
+// is X. An omitted field is left as is, nothing is changed if any is invalid. It is an admin endpoint,
+// mount it behind an auth middleware, e.g.
+//
+//	admin := router.Group("/debug", BasicAuth(Accounts{"admin": "secret"}))
+//	admin.POST("/profile/config", ProfileConfigHandler())
+func ProfileConfigHandler() HandlerFunc {
+	return func(c *Context) {
+		var conf profileConfig
+		if err := c.ShouldBindJSON(&conf); err != nil {
+			c.JSON(http.StatusBadRequest, H{"error": err.Error()})
+			return
+		}
+		var y, x time.Duration
+		var err error
+		if conf.Every != "" {
+			if y, err = time.ParseDuration(conf.Every); err != nil {
+				c.JSON(http.StatusBadRequest, H{"error": err.Error()})
+				return
+			}
+		}
+		if conf.Duration != "" {
+			if x, err = time.ParseDuration(conf.Duration); err != nil {
+				c.JSON(http.StatusBadRequest, H{"error": err.Error()})
+				return
+			}
+		}
+		if err = profile.SetConfig(conf.Profiles, y, x); err != nil {
+			status := http.StatusBadRequest
+			if profile.IsError(err, profile.ErrNotEnabled) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, H{"error": err.Error()})
+			return
+		}
+		status, err := profile.GetStatus()
+		if err != nil {
+			c.JSON(http.StatusConflict, H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, H{"profiles": status.Profiles, "every": status.Y.String(),
+			"duration": status.X.String()})
+	}
+}
+
+// profileStatus is the body of ProfileStatusHandler.
+type profileStatus struct {
+	Enabled         bool              `json:"enabled"`
+	Profiles        []profile.Profile `json:"profiles,omitempty"`
+	Every           string            `json:"every,omitempty"`
+	Duration        string            `json:"duration,omitempty"`
+	Paused          bool              `json:"paused"`
+	Healthy         bool              `json:"healthy"`
+	PendingFiles    int               `json:"pending_files"`
+	LastArchive     string            `json:"last_archive,omitempty"`
+	LastArchiveTime *time.Time        `json:"last_archive_time,omitempty"`
+	LastError       string            `json:"last_error,omitempty"`
+	LastErrorTime   *time.Time        `json:"last_error_time,omitempty"`
+	Captures        int64             `json:"captures"`
+	CaptureFailures int64             `json:"capture_failures"`
+	Archives        int64             `json:"archives"`
+	ArchivesDropped int64             `json:"archives_dropped"`
+	Errors          int64             `json:"errors"`
+}
+
+// ProfileStatusHandler returns a HandlerFunc that serves the status of the profiler, profile.GetStatus, as
+// JSON, e.g. {"enabled":true,"profiles":["cpu"],"every":"1m0s","duration":"10s","healthy":true,
+// "captures":12,...}, or {"enabled":false,...} when the profiling is not enabled. It is cheap enough to be
+// polled by a monitoring system, e.g.
+//
+//	router.GET("/debug/profile/status", ProfileStatusHandler())
+func ProfileStatusHandler() HandlerFunc {
+	return func(c *Context) {
+		status, err := profile.GetStatus()
+		if err != nil {
+			c.JSON(http.StatusOK, profileStatus{})
+			return
+		}
+		body := profileStatus{
+			Enabled:         true,
+			Profiles:        status.Profiles,
+			Every:           status.Y.String(),
+			Duration:        status.X.String(),
+			Paused:          status.Paused,
+			Healthy:         status.Healthy,
+			PendingFiles:    status.PendingFiles,
+			LastError:       status.LastError,
+			Captures:        status.Captures,
+			CaptureFailures: status.CaptureFailures,
+			Archives:        status.Archives,
+			ArchivesDropped: status.ArchivesDropped,
+			Errors:          status.Errors,
+		}
+		if status.LastArchive != "" {
+			body.LastArchive = filepath.Base(status.LastArchive)
+			body.LastArchiveTime = &status.LastArchiveTime
+		}
+		if status.LastError != "" {
+			body.LastErrorTime = &status.LastErrorTime
+		}
+		c.JSON(http.StatusOK, body)
+	}
+}
+
+const (
+	defaultSLOWindow   = 1000
+	defaultSLOCooldown = time.Minute
+)
+
+// SLOProfileConfig defines the config for SLOProfile middleware.
+type SLOProfileConfig struct {
+	// Threshold is the p99 latency above which a cpu profile is captured.
+	Threshold time.Duration
+
+	// Window is the number of latest requests the p99 latency is computed over.
+	// Optional. Default value is 1000.
+	Window int
+
+	// Cooldown is the minimum time between two captures.
+	// Optional. Default value is 1 minute.
+	Cooldown time.Duration
+
+	// Option tells where and how the cpu profile is stored, it is recorded for Option.X.
+	Option *profile.Option
+}
+
+// SLOProfile returns a middleware that keeps the p99 latency of the latest requests and captures a cpu
+// profile out of band when it crosses conf.Threshold, at most once per conf.Cooldown. The capture fails
+// if cpu profiling is already running, e.g. in the periodical profiling.
+func SLOProfile(conf SLOProfileConfig) HandlerFunc {
+	assert1(conf.Threshold > 0, "SLO threshold must be > 0")
+	assert1(conf.Option != nil && conf.Option.X > 0, "SLO profile duration Option.X must be > 0")
+	if conf.Window <= 0 {
+		conf.Window = defaultSLOWindow
+	}
+	if conf.Cooldown <= 0 {
+		conf.Cooldown = defaultSLOCooldown
+	}
+	errOut := conf.Option.ErrLogOutput
+	if errOut == nil {
+		errOut = DefaultErrorWriter
+	}
+	window := newLatencyWindow(conf.Window)
+	var lastCapture int64
+
+	return func(c *Context) {
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+		window.add(latency)
+		// the p99 only crosses the threshold upwards with a slow request
+		if latency <= conf.Threshold {
+			return
+		}
+		last := atomic.LoadInt64(&lastCapture)
+		if start.UnixNano()-last < int64(conf.Cooldown) || window.p99() <= conf.Threshold {
+			return
+		}
+		if !atomic.CompareAndSwapInt64(&lastCapture, last, start.UnixNano()) {
+			return
+		}
+		go func() {
+			if _, err := profile.CaptureSync(profile.Cpu, conf.Option); err != nil {
+				fmt.Fprintf(errOut, "[GIN][ERROR] %v |slo profile failed|error:%s\n",
+					time.Now().Format("2006/01/02 - 15:04:05"), err.Error())
+			}
+		}()
+	}
+}
+
+// latencyWindow keeps the latencies of the latest requests.
+type latencyWindow struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, size)}
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+func (w *latencyWindow) p99() time.Duration {
+	w.lock.Lock()
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	w.lock.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*99+99)/100-1]
+}
+
+const (
+	defaultRequestProfileHeader = "X-Debug-Profile"
+	defaultTraceIDHeader        = "X-Trace-Id"
+)
+
+// RequestProfileConfig defines the config for RequestProfile middleware.
+type RequestProfileConfig struct {
+	// Header flags the requests to profile when set to "true".
+	// Optional. Default value is "X-Debug-Profile".
+	Header string
+
+	// TraceIDHeader holds the trace ID of the request, the profile is named after it.
+	// Optional. Default value is "X-Trace-Id".
+	TraceIDHeader string
+
+	// Option tells where and how the cpu profiles are stored, Option.X is not used.
+	Option *profile.Option
+}
+
+// RequestProfile returns a middleware that records a cpu profile of the handlers of the requests flagged by
+// conf.Header, into conf.Option.StoreDir/cpu_<trace ID>.profile. The handlers run labelled with trace_id, so
+// that the samples of other requests can be left out with `go tool pprof -tagfocus trace_id=<trace ID>`.
+// The runtime allows a single cpu profile at a time, a request flagged meanwhile is not profiled. Anyone
+// setting the header can trigger a profile, strip it from untrusted requests at the edge.
+func RequestProfile(conf RequestProfileConfig) HandlerFunc {
+	assert1(conf.Option != nil, "request profile Option must not be nil")
+	if conf.Header == "" {
+		conf.Header = defaultRequestProfileHeader
+	}
+	if conf.TraceIDHeader == "" {
+		conf.TraceIDHeader = defaultTraceIDHeader
+	}
+	errOut := conf.Option.ErrLogOutput
+	if errOut == nil {
+		errOut = DefaultErrorWriter
+	}
+
+	return func(c *Context) {
+		if c.GetHeader(conf.Header) != "true" {
+			c.Next()
+			return
+		}
+		traceID := sanitizeName(c.GetHeader(conf.TraceIDHeader))
+		if traceID == "" {
+			traceID = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+		_, err := profile.CaptureCPUDuring(c.Request.Context(), traceID, conf.Option,
+			runtimepprof.Labels("trace_id", traceID), func(context.Context) { c.Next() })
+		if err != nil {
+			fmt.Fprintf(errOut, "[GIN][ERROR] %v |request profile failed|error:%s\n",
+				time.Now().Format("2006/01/02 - 15:04:05"), err.Error())
+		}
+	}
+}
+
+// sanitizeName keeps the characters of name which are safe in a file name.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// RouteCPUProfiler returns a middleware accumulating the cpu profiles of the invocations of the handlers
+// after it, labelled with route=routeName, and a handler dumping the accumulated profile, e.g.
+//
+//	profileCheckout, dump := RouteCPUProfiler("checkout")
+//	router.POST("/checkout", profileCheckout, checkout)
+//	admin.GET("/profile/checkout", dump)
+//
+// The runtime allows a single cpu profile at a time, so the invocations are serialized, which is only
+// fit for a targeted investigation. An invocation is not profiled while another cpu profile is running.
+func RouteCPUProfiler(routeName string) (HandlerFunc, HandlerFunc) {
+	accumulator := &profile.CPUAccumulator{}
+	labels := runtimepprof.Labels("route", routeName)
+
+	middleware := func(c *Context) {
+		err := accumulator.Run(c.Request.Context(), labels, func(context.Context) { c.Next() })
+		if err != nil {
+			fmt.Fprintf(DefaultErrorWriter, "[GIN][ERROR] %v |route profile of %q failed|error:%s\n",
+				time.Now().Format("2006/01/02 - 15:04:05"), routeName, err.Error())
+		}
+	}
+	dump := func(c *Context) {
+		var buf bytes.Buffer
+		runs, err := accumulator.Dump(&buf)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, H{"error": err.Error()})
+			return
+		}
+		if runs == 0 {
+			c.JSON(http.StatusNotFound, H{"error": fmt.Sprintf("route %q not profiled yet", routeName)})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="cpu_%s.profile"`,
+			sanitizeName(routeName)))
+		c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+	}
+	return middleware, dump
+}
+
+const (
+	defaultHeapProfileHeader  = "X-Debug-Heap-Profile"
+	defaultHeapProfileTrailer = "X-Heap-Profile"
+	defaultHeapProfileMaxSize = 16 * 1024
+)
+
+// HeapProfileHeaderConfig defines the config for HeapProfileHeader middleware.
+type HeapProfileHeaderConfig struct {
+	// Header flags the requests to profile when set to "true".
+	// Optional. Default value is "X-Debug-Heap-Profile".
+	Header string
+
+	// Trailer is the response trailer carrying the profile.
+	// Optional. Default value is "X-Heap-Profile".
+	Trailer string
+
+	// MaxSize bounds the size of the encoded profile, a larger one is left out.
+	// Optional. Default value is 16KB.
+	MaxSize int
+}
+
+// HeapProfileHeader returns a middleware attaching to the responses of the requests flagged by conf.Header
+// the heap profile of what was allocated while their handlers ran, base64 encoded in the trailer conf.Trailer,
+// so that a client can inspect it without access to the server's file system. The profile is a delta of
+// the whole heap, allocations of the concurrent requests included.
+func HeapProfileHeader(conf HeapProfileHeaderConfig) HandlerFunc {
+	if conf.Header == "" {
+		conf.Header = defaultHeapProfileHeader
+	}
+	if conf.Trailer == "" {
+		conf.Trailer = defaultHeapProfileTrailer
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = defaultHeapProfileMaxSize
+	}
+	logError := func(err error) {
+		fmt.Fprintf(DefaultErrorWriter, "[GIN][ERROR] %v |heap profile header failed|error:%s\n",
+			time.Now().Format("2006/01/02 - 15:04:05"), err.Error())
+	}
+
+	return func(c *Context) {
+		if c.GetHeader(conf.Header) != "true" {
+			c.Next()
+			return
+		}
+		// the heap profile is as of the last garbage collection, collect before each snapshot so that the
+		// delta holds the allocations of the handlers
+		runtime.GC()
+		baseline, err := profile.CaptureHeapDelta(nil, ioutil.Discard)
+		if err != nil {
+			logError(err)
+			c.Next()
+			return
+		}
+		// the headers are likely written by the handlers, a trailer is set afterwards
+		c.Header("Trailer", conf.Trailer)
+		c.Next()
+		runtime.GC()
+		var buf bytes.Buffer
+		if _, err = profile.CaptureHeapDelta(baseline, &buf); err != nil {
+			logError(err)
+			return
+		}
+		encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+		if len(encoded) > conf.MaxSize {
+			logError(fmt.Errorf("profile of %d bytes exceeds %d bytes", len(encoded), conf.MaxSize))
+			return
+		}
+		c.Writer.Header().Set(conf.Trailer, encoded)
+	}
+}
+
+const defaultSampledLabelsFraction = 0.01
+
+// SampledLabelsConfig defines the config for SampledLabels middleware.
+type SampledLabelsConfig struct {
+	// Fraction is the fraction of the requests labelled, in (0, 1].
+	// Optional. Default value is 0.01.
+	Fraction float64
+
+	// Labels returns the labels of the sampled request, after its route.
+	// Optional. Default value labels the route: route=<c.FullPath()>.
+	Labels func(c *Context) runtimepprof.LabelSet
+}
+
+// SampledLabels returns a middleware running the handlers of a random conf.Fraction of the requests under
+// pprof labels, the route by default, so that the cpu profiles of the periodical profiling attribute their
+// cpu over time, e.g. with `go tool pprof -tagfocus route=/checkout`, while the other requests don't pay for
+// the labelling. The request context of the sampled ones carries the labels, for pprof.Do to pass them on
+// to the goroutines the handlers start.
+func SampledLabels(conf SampledLabelsConfig) HandlerFunc {
+	if conf.Fraction <= 0 {
+		conf.Fraction = defaultSampledLabelsFraction
+	}
+	if conf.Labels == nil {
+		conf.Labels = func(c *Context) runtimepprof.LabelSet {
+			return runtimepprof.Labels("route", c.FullPath())
+		}
+	}
+
+	return func(c *Context) {
+		if rand.Float64() >= conf.Fraction {
+			c.Next()
+			return
+		}
+		runtimepprof.Do(c.Request.Context(), conf.Labels(c), func(ctx context.Context) {
+			c.Request = c.Request.WithContext(ctx)
+			c.Next()
+		})
+	}
+}